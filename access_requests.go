@@ -0,0 +1,408 @@
+package heracles
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/go-chi/chi"
+)
+
+// Returns whether the user may approve or deny the request, which owners of its
+// realm (and admins) may do for anyone's requests but their own.
+func (s *Server) canDecideAccessRequest(user *db.User, request *db.AccessRequest) (bool, error) {
+	if request.UserId == user.Id {
+		return false, nil
+	}
+
+	if user.IsAdmin() {
+		return true, nil
+	}
+
+	_, err := s.store.GetRealmOwner(request.RealmId, user.Id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Looks up the access request in the URL, reporting an error to the client if
+// it does not exist.
+func (s *Server) findAccessRequest(w http.ResponseWriter, r *http.Request) (*db.AccessRequest, bool) {
+	requestId, err := strconv.ParseInt(chi.URLParam(r, "requestId"), 10, 64)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid request ID")
+		return nil, false
+	}
+
+	request, err := s.store.GetAccessRequestById(requestId)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return nil, false
+	} else if err != nil {
+		reportInternalError(w, err)
+		return nil, false
+	}
+
+	return request, true
+}
+
+func (s *Server) GetIdentityAccessRequestsRoute(w http.ResponseWriter, r *http.Request) {
+	requests, err := s.store.GetAccessRequestsByUserId(getCurrentUser(r).Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"requests": requests,
+	})
+}
+
+type CreateAccessRequestPayload struct {
+	Realm  string `json:"realm" schema:"realm"`
+	Reason string `json:"reason" schema:"reason"`
+}
+
+func (s *Server) PostIdentityAccessRequestsRoute(w http.ResponseWriter, r *http.Request) {
+	var payload CreateAccessRequestPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	user := getCurrentUser(r)
+
+	realm, err := s.store.GetRealmByName(payload.Realm)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusBadRequest, "Unknown realm")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.GetUserRealmGrantByRealmName(user.Id, realm.Name)
+	if err == nil {
+		gores.Error(w, http.StatusConflict, "You already have access to this realm")
+		return
+	} else if err != sql.ErrNoRows {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.GetPendingAccessRequest(user.Id, realm.Id)
+	if err == nil {
+		gores.Error(w, http.StatusConflict, "You already have a pending request for this realm")
+		return
+	} else if err != sql.ErrNoRows {
+		reportInternalError(w, err)
+		return
+	}
+
+	request, err := s.store.CreateAccessRequest(user.Id, realm.Id, payload.Reason)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.access_request", user, map[string]interface{}{
+		"request": request.Id,
+		"realm":   realm.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, request)
+}
+
+func (s *Server) DeleteIdentityAccessRequestRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	request, ok := s.findAccessRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if request.UserId != user.Id {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	} else if request.Status != db.ACCESS_REQUEST_PENDING {
+		gores.Error(w, http.StatusBadRequest, "Request has already been decided")
+		return
+	}
+
+	err := s.store.DeleteAccessRequest(request)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.access_request_cancel", user, map[string]interface{}{
+		"request": request.Id,
+		"realm":   request.RealmId,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+// Lists pending requests the current user can decide on
+func (s *Server) GetAccessRequestsRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	var requests []db.AccessRequest
+	var err error
+	if user.IsAdmin() {
+		requests, err = s.store.GetPendingAccessRequests()
+	} else {
+		requests, err = s.store.GetPendingAccessRequestsByOwnerId(user.Id)
+	}
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	// Users can't decide their own requests, even for realms they own
+	decidable := make([]db.AccessRequest, 0, len(requests))
+	for _, request := range requests {
+		if request.UserId != user.Id {
+			decidable = append(decidable, request)
+		}
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"requests": decidable,
+	})
+}
+
+type ApproveAccessRequestPayload struct {
+	Alias     *string `json:"alias" schema:"alias"`
+	ExpiresAt *int64  `json:"expires_at" schema:"expires_at"`
+}
+
+func (s *Server) PostAccessRequestApproveRoute(w http.ResponseWriter, r *http.Request) {
+	var payload ApproveAccessRequestPayload
+	if r.ContentLength != 0 && !readRequestData(w, r, &payload) {
+		return
+	}
+
+	user := getCurrentUser(r)
+
+	request, ok := s.decidableAccessRequest(w, r, user)
+	if !ok {
+		return
+	}
+
+	if payload.ExpiresAt != nil && *payload.ExpiresAt <= time.Now().Unix() {
+		gores.Error(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	// The user may have been granted access since requesting it
+	_, err := s.store.GetEffectiveUserRealmGrant(request.UserId, request.RealmId)
+	if err == sql.ErrNoRows {
+		err = s.grantRequestedAccess(request, payload)
+	}
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.DecideAccessRequest(request, db.ACCESS_REQUEST_APPROVED, user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("realm.access_approve", user, map[string]interface{}{
+		"request":    request.Id,
+		"realm":      request.RealmId,
+		"user":       request.UserId,
+		"expires_at": payload.ExpiresAt,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, request)
+}
+
+// Grants the access an approved request asked for, replacing any direct grant
+// the user has which has expired or is not active yet.
+func (s *Server) grantRequestedAccess(request *db.AccessRequest, payload ApproveAccessRequestPayload) error {
+	existing, err := s.store.GetUserRealmGrant(request.UserId, request.RealmId)
+	if err == nil {
+		err = s.store.DeleteUserRealmGrant(existing)
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.store.CreateUserRealmGrant(request.UserId, request.RealmId, payload.Alias, nil, payload.ExpiresAt)
+	return err
+}
+
+func (s *Server) PostAccessRequestDenyRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	request, ok := s.decidableAccessRequest(w, r, user)
+	if !ok {
+		return
+	}
+
+	err := s.store.DecideAccessRequest(request, db.ACCESS_REQUEST_DENIED, user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("realm.access_deny", user, map[string]interface{}{
+		"request": request.Id,
+		"realm":   request.RealmId,
+		"user":    request.UserId,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, request)
+}
+
+// Looks up the pending access request in the URL, checking the user may decide
+// it.
+func (s *Server) decidableAccessRequest(w http.ResponseWriter, r *http.Request, user *db.User) (*db.AccessRequest, bool) {
+	request, ok := s.findAccessRequest(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	allowed, err := s.canDecideAccessRequest(user, request)
+	if err != nil {
+		reportInternalError(w, err)
+		return nil, false
+	} else if !allowed && request.UserId == user.Id {
+		gores.Error(w, http.StatusForbidden, "You cannot decide your own request")
+		return nil, false
+	} else if !allowed {
+		gores.Error(w, http.StatusForbidden, "You are not an owner of this realm")
+		return nil, false
+	}
+
+	if request.Status != db.ACCESS_REQUEST_PENDING {
+		gores.Error(w, http.StatusBadRequest, "Request has already been decided")
+		return nil, false
+	}
+
+	return request, true
+}
+
+func (s *Server) GetRealmOwnersRoute(w http.ResponseWriter, r *http.Request) {
+	owners, err := s.store.GetRealmOwnersByRealmId(getCurrentRealm(r).Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"owners": owners,
+	})
+}
+
+type CreateRealmOwnerPayload struct {
+	UserId int64 `json:"user_id" schema:"user_id"`
+}
+
+func (s *Server) PostRealmOwnersRoute(w http.ResponseWriter, r *http.Request) {
+	var payload CreateRealmOwnerPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	realm := getCurrentRealm(r)
+
+	user, err := s.store.GetUserById(payload.UserId)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusBadRequest, "Unknown User")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.GetRealmOwner(realm.Id, user.Id)
+	if err == nil {
+		gores.Error(w, http.StatusConflict, "User is already an owner")
+		return
+	} else if err != sql.ErrNoRows {
+		reportInternalError(w, err)
+		return
+	}
+
+	owner, err := s.store.CreateRealmOwner(realm.Id, user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_owner_add", getCurrentUser(r), map[string]interface{}{
+		"realm": realm.Id,
+		"user":  user.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, owner)
+}
+
+func (s *Server) DeleteRealmOwnerRoute(w http.ResponseWriter, r *http.Request) {
+	realm := getCurrentRealm(r)
+
+	userId, err := strconv.ParseInt(chi.URLParam(r, "userId"), 10, 64)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	owner, err := s.store.GetRealmOwner(realm.Id, userId)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.DeleteRealmOwner(owner)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_owner_remove", getCurrentUser(r), map[string]interface{}{
+		"realm": realm.Id,
+		"user":  userId,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
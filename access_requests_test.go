@@ -0,0 +1,154 @@
+package heracles
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+func TestAccessRequestApprovedByOwner(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	for _, username := range []string{"owner", "user"} {
+		_, err := store.CreateUser(username, "password", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	owner, _ := store.GetUserByUsername("owner")
+
+	admin := newLoggedInClient(t, ts, "admin", "admin")
+	ownerClient := newLoggedInClient(t, ts, "owner", "password")
+	c := newLoggedInClient(t, ts, "user", "password")
+
+	var realm db.Realm
+	admin.expect(admin.send("POST", "/api/realms", map[string]string{"name": "test"}), http.StatusOK, &realm)
+	admin.expect(admin.send("POST", fmt.Sprintf("/api/realms/%v/owners", realm.Id), map[string]int64{"user_id": owner.Id}), http.StatusOK)
+
+	var request db.AccessRequest
+	c.expect(c.send("POST", "/api/identity/access-requests", map[string]string{"realm": "test", "reason": "please"}), http.StatusOK, &request)
+	c.expect(c.send("POST", "/api/identity/access-requests", map[string]string{"realm": "test"}), http.StatusConflict)
+
+	var pending struct {
+		Requests []db.AccessRequest `json:"requests"`
+	}
+	ownerClient.expect(ownerClient.get("/api/access-requests", nil), http.StatusOK, &pending)
+	if len(pending.Requests) != 1 || pending.Requests[0].Id != request.Id {
+		t.Fatalf("unexpected pending requests %+v", pending.Requests)
+	}
+
+	// Users can't decide requests for realms they don't own
+	c.expect(c.send("POST", fmt.Sprintf("/api/access-requests/%v/approve", request.Id), nil), http.StatusForbidden)
+
+	ownerClient.expect(ownerClient.send("POST", fmt.Sprintf("/api/access-requests/%v/approve", request.Id), nil), http.StatusOK, &request)
+	if request.Status != db.ACCESS_REQUEST_APPROVED || request.DecidedBy == nil || *request.DecidedBy != owner.Id {
+		t.Fatalf("unexpected decided request %+v", request)
+	}
+
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "test"}), http.StatusNoContent)
+	ownerClient.expect(ownerClient.send("POST", fmt.Sprintf("/api/access-requests/%v/deny", request.Id), nil), http.StatusBadRequest)
+}
+
+func TestAccessRequestCannotBeSelfApproved(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	owner, err := store.CreateUser("owner", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realm, _ := store.CreateRealm("test", nil)
+	_, err = store.CreateRealmOwner(realm.Id, owner.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newLoggedInClient(t, ts, "admin", "admin")
+	c := newLoggedInClient(t, ts, "owner", "password")
+
+	var request db.AccessRequest
+	c.expect(c.send("POST", "/api/identity/access-requests", map[string]string{"realm": "test"}), http.StatusOK, &request)
+
+	var pending struct {
+		Requests []db.AccessRequest `json:"requests"`
+	}
+	c.expect(c.get("/api/access-requests", nil), http.StatusOK, &pending)
+	if len(pending.Requests) != 0 {
+		t.Fatalf("owner was offered their own request %+v", pending.Requests)
+	}
+
+	c.expect(c.send("POST", fmt.Sprintf("/api/access-requests/%v/approve", request.Id), nil), http.StatusForbidden)
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "test"}), http.StatusUnauthorized)
+
+	// Admins can't approve their own requests either
+	var adminRequest db.AccessRequest
+	admin.expect(admin.send("POST", "/api/identity/access-requests", map[string]string{"realm": "test"}), http.StatusOK, &adminRequest)
+	admin.expect(admin.send("POST", fmt.Sprintf("/api/access-requests/%v/approve", adminRequest.Id), nil), http.StatusForbidden)
+	admin.expect(admin.send("POST", fmt.Sprintf("/api/access-requests/%v/approve", request.Id), nil), http.StatusOK)
+}
+
+func TestAccessRequestReplacesExpiredGrant(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	user, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realm, _ := store.CreateRealm("test", nil)
+
+	// Not yet swept away
+	expired := time.Now().Unix() - 60
+	_, err = store.CreateUserRealmGrant(user.Id, realm.Id, nil, nil, &expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newLoggedInClient(t, ts, "admin", "admin")
+	c := newLoggedInClient(t, ts, "user", "password")
+
+	var request db.AccessRequest
+	c.expect(c.send("POST", "/api/identity/access-requests", map[string]string{"realm": "test"}), http.StatusOK, &request)
+	admin.expect(admin.send("POST", fmt.Sprintf("/api/access-requests/%v/approve", request.Id), nil), http.StatusOK)
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "test"}), http.StatusNoContent)
+
+	grant, err := store.GetUserRealmGrant(user.Id, realm.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.ExpiresAt != nil {
+		t.Fatalf("approved grant kept the old expiry %v", *grant.ExpiresAt)
+	}
+
+	// Access through a group counts too
+	other, _ := store.CreateRealm("other", nil)
+	group, _ := store.CreateGroup("staff")
+	store.CreateGroupMember(group.Id, user.Id)
+	store.CreateGroupRealmGrant(group.Id, other.Id)
+	c.expect(c.send("POST", "/api/identity/access-requests", map[string]string{"realm": "other"}), http.StatusConflict)
+}
+
+// The index page posts URLSearchParams, which browsers send with a charset
+func TestAccessRequestFromBrowserForm(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+	store.CreateRealm("test", nil)
+
+	c := newLoggedInClient(t, ts, "admin", "admin")
+
+	form := url.Values{"realm": {"test"}, "reason": {"please"}}
+	req := c.newRequest("POST", "/api/identity/access-requests", bytes.NewReader([]byte(form.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+
+	var request db.AccessRequest
+	c.expect(c.do(req), http.StatusOK, &request)
+	if request.Reason != "please" {
+		t.Fatalf("unexpected request %+v", request)
+	}
+
+	req = c.newRequest("POST", "/api/identity/access-requests", bytes.NewReader([]byte(`{"realm": "test"}`)))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	c.expect(c.do(req), http.StatusConflict)
+}
@@ -4,11 +4,10 @@ import (
 	"net/http"
 
 	"github.com/alioygur/gores"
-	"github.com/b1naryth1ef/heracles/db"
 )
 
-func GetRecentAuditLogRoute(w http.ResponseWriter, r *http.Request) {
-	entries, err := db.GetRecentAuditLogEntries(100)
+func (s *Server) GetRecentAuditLogRoute(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.store.GetRecentAuditLogEntries(100)
 	if err != nil {
 		reportInternalError(w, err)
 		return
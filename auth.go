@@ -2,33 +2,50 @@ package heracles
 
 import (
 	"database/sql"
-	"encoding/base64"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/alioygur/gores"
 	"github.com/b1naryth1ef/heracles/db"
-	"github.com/spf13/viper"
+	"github.com/gorilla/sessions"
 )
 
 var ErrNoUser = errors.New("No User")
 
-func GetLoginRoute(w http.ResponseWriter, r *http.Request) {
+// How long a user has to complete the second step of a login
+const secondFactorTimeout = 5 * time.Minute
+
+// How many bad codes a user may enter before having to start their login over
+const secondFactorMaxFailures = 5
+
+func init() {
+	// Required so audit data can be carried in the session between login steps
+	gob.Register(map[string]interface{}{})
+}
+
+func (s *Server) GetLoginRoute(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	t := template.Must(template.New("login.html").ParseFiles("static/login.html"))
-	t.Execute(w, r.Form.Get("r"))
+	t.Execute(w, map[string]interface{}{
+		"Redirect":  r.Form.Get("r"),
+		"Providers": s.loginProviders,
+		"Discord":   s.config.Discord.Enabled,
+		"WebAuthn":  s.config.WebAuthn.Enabled,
+	})
 }
 
-func GetIndexRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetIndexRoute(w http.ResponseWriter, r *http.Request) {
 	t := template.Must(template.New("index.html").ParseFiles("static/index.html"))
 	t.Execute(w, getCurrentUser(r))
 }
 
-func PostLoginRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PostLoginRoute(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		gores.Error(w, http.StatusBadRequest, "Bad Form Data")
@@ -38,40 +55,155 @@ func PostLoginRoute(w http.ResponseWriter, r *http.Request) {
 	username := r.PostForm.Get("username")
 	password := r.PostForm.Get("password")
 
-	user, err := db.GetUserByUsername(username)
-	if err == sql.ErrNoRows {
-		gores.Error(w, http.StatusBadRequest, "Unknown user")
+	user, backend, err := s.authenticate(username, password)
+	if err == ErrUserDisabled {
+		gores.Error(w, http.StatusForbidden, "Account disabled")
 		return
 	} else if err != nil {
+		_, err = s.store.GetUserByUsername(username)
+		if err == sql.ErrNoRows {
+			gores.Error(w, http.StatusBadRequest, "Unknown user")
+		} else if err != nil {
+			reportInternalError(w, err)
+		} else {
+			gores.Error(w, http.StatusBadRequest, "Bad password")
+		}
+		return
+	}
+
+	auditData := map[string]interface{}{
+		"backend": backend,
+	}
+
+	factors, err := s.getUserSecondFactors(user)
+	if err != nil {
 		reportInternalError(w, err)
 		return
 	}
 
-	if user.CheckPassword(password) != nil {
-		gores.Error(w, http.StatusBadRequest, "Bad password")
+	if factors.Required() {
+		// Clients may provide a TOTP code alongside the password, otherwise we
+		//  send them to the second step of the login flow.
+		code := r.PostForm.Get("code")
+		if code == "" || factors.TOTP == nil {
+			s.beginSecondFactorLogin(w, r, user, r.Form.Get("r"), auditData)
+			return
+		}
+
+		ok, err := s.acceptTOTPCode(factors.TOTP, code)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		} else if !ok {
+			gores.Error(w, http.StatusBadRequest, "Bad code")
+			return
+		}
+	}
+
+	s.completeLogin(w, r, user, r.Form.Get("r"), auditData)
+}
+
+// Records the partially authenticated user and redirects to the second factor
+// prompt. The login itself lives in the store rather than the (client side)
+// session so failures can't be reset by replaying an older cookie, and so any
+// server sharing the database can complete it.
+func (s *Server) beginSecondFactorLogin(w http.ResponseWriter, r *http.Request, user *db.User, redirectURL string, auditData map[string]interface{}) {
+	session := s.getSession(w, r)
+	if session == nil {
 		return
 	}
 
-	// Create our authentication cookie
-	authSecret := user.GetAuthSecret()
-	authSecretEncoded := base64.RawURLEncoding.EncodeToString(authSecret)
+	// Opportunistically clean up after logins which were never completed
+	err := s.store.DeleteExpiredSecondFactorLogins()
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
 
-	_, err = db.CreateAuditLogEntry("user.self_login", user, nil)
+	login, err := s.store.CreateSecondFactorLogin(user.Id, secondFactorTimeout)
 	if err != nil {
 		reportInternalError(w, err)
 		return
 	}
 
-	cookie := http.Cookie{
-		Name:   "heracles-auth",
-		Domain: viper.GetString("web.domain"),
-		Value:  authSecretEncoded,
-		Path:   "",
-		MaxAge: 60 * 60 * 24 * 14,
+	session.Values["mfa_login"] = login.Id
+	if auditData != nil {
+		session.Values["mfa_data"] = auditData
+	}
+	session.Values["r"] = redirectURL
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/login/mfa", http.StatusFound)
+}
+
+// Returns the login waiting on its second step for this session, or nil if
+// there is none.
+func (s *Server) getPendingSecondFactorLogin(session *sessions.Session) (*db.SecondFactorLogin, error) {
+	id, _ := session.Values["mfa_login"].(string)
+	if id == "" {
+		return nil, nil
+	}
+
+	login, err := s.store.GetSecondFactorLogin(id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return login, err
+}
+
+// Records a bad code for the pending second factor login, abandoning the login
+// (which the user must then start over) once there have been too many. Returns
+// whether the login was abandoned.
+func (s *Server) failPendingSecondFactorLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, login *db.SecondFactorLogin) (bool, error) {
+	err := s.store.AddSecondFactorLoginFailure(login)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	} else if err == nil && login.Failures < secondFactorMaxFailures {
+		return false, nil
+	}
+
+	_, _, err = s.takePendingSecondFactorLogin(w, r, session, login)
+	return true, err
+}
+
+// Clears the pending second factor login, returning the audit data and
+// redirect URL it was started with.
+func (s *Server) takePendingSecondFactorLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, login *db.SecondFactorLogin) (map[string]interface{}, string, error) {
+	auditData, _ := session.Values["mfa_data"].(map[string]interface{})
+	redirectURL, _ := session.Values["r"].(string)
+
+	err := s.store.DeleteSecondFactorLogin(login)
+	if err != nil {
+		return nil, "", err
+	}
+
+	delete(session.Values, "mfa_login")
+	delete(session.Values, "mfa_data")
+	session.Save(r, w)
+
+	return auditData, redirectURL, nil
+}
+
+// Issues the authentication cookie for a fully authenticated user and sends
+// them on to the requested redirect URL (if any).
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, user *db.User, redirectURLRaw string, auditData map[string]interface{}) {
+	if user.IsDisabled() {
+		gores.Error(w, http.StatusForbidden, "Account disabled")
+		return
+	}
+
+	_, err := s.store.CreateAuditLogEntry("user.self_login", user, auditData)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.startSession(w, r, user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
 	}
-	http.SetCookie(w, &cookie)
 
-	redirectURLRaw := r.Form.Get("r")
 	if redirectURLRaw == "" {
 		gores.NoContent(w)
 		return
@@ -86,13 +218,123 @@ func PostLoginRoute(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
 }
 
-func GetLogoutRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetLoginMFARoute(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	login, err := s.getPendingSecondFactorLogin(session)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	} else if login == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := s.store.GetUserById(login.UserId)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	factors, err := s.getUserSecondFactors(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	redirectURL, _ := session.Values["r"].(string)
+
+	t := template.Must(template.New("login_mfa.html").ParseFiles("static/login_mfa.html"))
+	t.Execute(w, map[string]interface{}{
+		"TOTP":     factors.TOTP != nil,
+		"WebAuthn": factors.WebAuthn,
+		"Redirect": redirectURL,
+	})
+}
+
+func (s *Server) PostLoginTOTPRoute(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Bad Form Data")
+		return
+	}
+
+	login, err := s.getPendingSecondFactorLogin(session)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	} else if login == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := s.store.GetUserById(login.UserId)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	userTOTP, err := s.getUserTOTP(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	ok := false
+	if userTOTP != nil {
+		ok, err = s.acceptTOTPCode(userTOTP, r.PostForm.Get("code"))
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
+	if !ok {
+		abandoned, err := s.failPendingSecondFactorLogin(w, r, session, login)
+		if err != nil {
+			reportInternalError(w, err)
+		} else if abandoned {
+			gores.Error(w, http.StatusBadRequest, "Too many bad codes, please log in again")
+		} else {
+			gores.Error(w, http.StatusBadRequest, "Bad code")
+		}
+		return
+	}
+
+	auditData, redirectURL, err := s.takePendingSecondFactorLogin(w, r, session, login)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+	s.completeLogin(w, r, user, redirectURL, auditData)
+}
+
+func (s *Server) GetLogoutRoute(w http.ResponseWriter, r *http.Request) {
+	session, err := s.findRequestSession(r)
+	if err == nil {
+		err = s.store.DeleteSession(session)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
 	cookie := http.Cookie{
-		Name:   "heracles-auth",
-		Domain: viper.GetString("web.domain"),
-		Value:  "",
-		Path:   "",
-		MaxAge: -1,
+		Name:     "heracles-auth",
+		Domain:   s.config.Web.Domain,
+		Value:    "",
+		Path:     "",
+		MaxAge:   -1,
+		Secure:   s.tlsConfig != nil,
+		SameSite: http.SameSiteLaxMode,
 	}
 
 	http.SetCookie(w, &cookie)
@@ -104,7 +346,7 @@ func GetLogoutRoute(w http.ResponseWriter, r *http.Request) {
 	gores.NoContent(w)
 }
 
-func ValidateRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ValidateRoute(w http.ResponseWriter, r *http.Request) {
 	quiet := false
 
 	quietArgs, ok := r.URL.Query()["quiet"]
@@ -112,7 +354,7 @@ func ValidateRoute(w http.ResponseWriter, r *http.Request) {
 		quiet = true
 	}
 
-	user, err := findRequestUser(r, false)
+	user, token, err := s.findRequestUser(r, false)
 	if err != nil {
 		if quiet {
 			gores.NoContent(w)
@@ -137,7 +379,17 @@ func ValidateRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	realmGrant, err := db.GetUserRealmGrantByRealmName(user.Id, realm)
+	if token != nil && !s.tokenAllowsRealm(token, realm) {
+		if quiet {
+			gores.NoContent(w)
+		} else {
+			log.Printf("[Validate] token %v for user %v is not allowed to access realm %v", token.Id, user.Username, realm)
+			gores.Error(w, http.StatusUnauthorized, "Unauthorized")
+		}
+		return
+	}
+
+	realmGrant, err := s.store.GetUserRealmGrantByRealmName(user.Id, realm)
 	if err != nil {
 		if quiet {
 			gores.NoContent(w)
@@ -154,5 +406,19 @@ func ValidateRoute(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Heracles-User", user.Username)
 	}
 
+	status := s.validateRealmRoles(w, r, user, realmGrant.RealmId)
+	if status != http.StatusNoContent {
+		w.Header().Del("X-Heracles-User")
+		w.Header().Del("X-Heracles-Roles")
+
+		if quiet {
+			gores.NoContent(w)
+		} else {
+			log.Printf("[Validate] role check for user %v and realm %v failed with status %v", user.Username, realm, status)
+			gores.Error(w, status, http.StatusText(status))
+		}
+		return
+	}
+
 	gores.NoContent(w)
 }
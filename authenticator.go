@@ -0,0 +1,86 @@
+package heracles
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+// An Authenticator verifies a username and password against some source of
+// credentials, returning the local user they belong to.
+type Authenticator interface {
+	Name() string
+	Authenticate(username, password string) (*db.User, error)
+}
+
+var ErrUserDisabled = errors.New("User is disabled")
+
+// Builds the ordered chain of authenticators, configured via `auth.backends`
+func (s *Server) initializeAuthenticators() error {
+	s.authenticators = make([]Authenticator, 0, len(s.config.Auth.Backends))
+	for _, name := range s.config.Auth.Backends {
+		switch name {
+		case "local":
+			s.authenticators = append(s.authenticators, &localAuthenticator{store: s.store})
+		case "ldap":
+			s.authenticators = append(s.authenticators, &ldapAuthenticator{
+				store:  s.store,
+				config: s.config.LDAP,
+			})
+		case "htpasswd":
+			s.authenticators = append(s.authenticators, &htpasswdAuthenticator{
+				store:  s.store,
+				path:   s.config.Auth.Htpasswd.Path,
+				create: s.config.Auth.Htpasswd.Create,
+				link:   s.config.Auth.Htpasswd.Link,
+			})
+		default:
+			return fmt.Errorf("Unknown authentication backend: %v", name)
+		}
+	}
+	return nil
+}
+
+// Tries each configured authenticator in order, returning the user and the name
+// of the authenticator which accepted their credentials.
+func (s *Server) authenticate(username, password string) (*db.User, string, error) {
+	for _, authenticator := range s.authenticators {
+		user, err := authenticator.Authenticate(username, password)
+		if err == nil && user.IsDisabled() {
+			return nil, "", ErrUserDisabled
+		} else if err == nil {
+			return user, authenticator.Name(), nil
+		} else if err != ErrNoUser {
+			log.Printf("[Auth] %v backend failed to authenticate %v: %v", authenticator.Name(), username, err)
+		}
+	}
+
+	return nil, "", ErrNoUser
+}
+
+// Authenticates users against the bcrypt password stored in the database
+type localAuthenticator struct {
+	store db.Store
+}
+
+func (a *localAuthenticator) Name() string {
+	return "local"
+}
+
+func (a *localAuthenticator) Authenticate(username, password string) (*db.User, error) {
+	user, err := a.store.GetUserByUsername(username)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoUser
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user.CheckPassword(password) != nil {
+		return nil, ErrNoUser
+	}
+
+	return user, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"strings"
 
 	"github.com/b1naryth1ef/heracles"
@@ -18,5 +19,10 @@ func main() {
 	viper.SetEnvKeyReplacer(replacer)
 	viper.ReadInConfig()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		heracles.Migrate()
+		return
+	}
+
 	heracles.Run()
 }
@@ -0,0 +1,299 @@
+package heracles
+
+import (
+	"time"
+
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/spf13/viper"
+)
+
+// Config holds all of the settings for a Server. Zero values fall back to the
+// same defaults the heracles binary uses, apart from LogRequests.
+type Config struct {
+	// Whether every HTTP request is logged. Off unless set, the heracles binary
+	// turns it on by default (`log_requests`).
+	LogRequests bool
+
+	Web      WebConfig
+	DB       DBConfig
+	Security SecurityConfig
+	Auth     AuthConfig
+	LDAP     LDAPConfig
+	Discord  DiscordConfig
+	WebAuthn WebAuthnConfig
+	OIDC     OIDCConfig
+	TOTP     TOTPConfig
+	Radius   RadiusConfig
+}
+
+type WebConfig struct {
+	// Either an address (e.g. `localhost:8080`) or a unix socket (e.g.
+	// `unix:///run/heracles.sock`)
+	Bind   string
+	Domain string
+
+	// Whether X-Real-IP and X-Forwarded-For are trusted, e.g. when listening
+	// on a unix socket behind nginx
+	TrustProxy bool
+
+	// How long in-flight requests are given to finish when shutting down
+	ShutdownTimeout time.Duration
+
+	TLS TLSConfig
+}
+
+// Serving TLS is enabled by setting Cert and Key, which are reloaded whenever
+// they change on disk or the server receives SIGHUP.
+type TLSConfig struct {
+	Cert string
+	Key  string
+
+	// PEM bundle of CAs which client certificates are verified against, users
+	// presenting a valid certificate are logged in as the user it names.
+	ClientCA          string
+	RequireClientCert bool
+
+	// Which part of a client certificate holds the username, either cn (the
+	// subject's common name) or email (the first email address)
+	ClientCertUsername string
+
+	// When set plain HTTP requests to this address are redirected to HTTPS
+	RedirectBind string
+}
+
+type DBConfig struct {
+	// Either sqlite3, where Path is a file, or postgres, where Path is a
+	// connection string
+	Driver string
+	Path   string
+}
+
+type SecurityConfig struct {
+	// Secret used to sign the cookies holding login state
+	Secret           string
+	BcryptDifficulty int
+
+	SessionLifetime time.Duration
+
+	// When set tokens may not be valid for longer than this
+	TokenMaxLifetime time.Duration
+
+	// How long expired tokens are kept before being deleted
+	ExpiredTokenRetention time.Duration
+}
+
+type AuthConfig struct {
+	// The ordered chain of authenticators, any of local, ldap and htpasswd
+	Backends []string
+
+	Htpasswd  HtpasswdConfig
+	Providers []LoginProviderConfig
+}
+
+type HtpasswdConfig struct {
+	Path string
+
+	// Whether users are created on their first login, and whether existing
+	// local users with the same username are linked to the file
+	Create bool
+	Link   bool
+}
+
+type LDAPConfig struct {
+	// Adds ldap to the authenticators when Auth.Backends is empty
+	Enabled bool
+
+	URL                string
+	InsecureSkipVerify bool
+	StartTLS           bool
+
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+
+	// Filter finding a user, `%s` is replaced with their escaped username
+	UserFilter     string
+	GroupAttribute string
+
+	// Whether users are created on their first login, and whether existing
+	// local users with the same username are linked to the directory
+	Create bool
+	Link   bool
+
+	// Maps group DNs to the realms their members are granted
+	Groups map[string][]string
+}
+
+type DiscordConfig struct {
+	Enabled      bool
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+
+	// Whether users are created on their first login
+	Create bool
+}
+
+type WebAuthnConfig struct {
+	Enabled     bool
+	DisplayName string
+	RPID        string
+	Origin      string
+
+	// Whether users with a security key must use it when logging in
+	RequireSecondFactor bool
+}
+
+type OIDCConfig struct {
+	Enabled bool
+	Issuer  string
+
+	// Path to the PEM encoded RSA key tokens are signed with, generated if it
+	// does not exist yet. Replicas must all share the same key.
+	SigningKey string
+}
+
+type TOTPConfig struct {
+	Issuer string
+}
+
+type RadiusConfig struct {
+	Enabled bool
+	Bind    string
+	Secret  string
+}
+
+// Builds a Config from viper, which the heracles binary loads from config.yaml
+// and the environment.
+func ConfigFromViper() (Config, error) {
+	config := Config{
+		LogRequests: viper.GetBool("log_requests"),
+		Web: WebConfig{
+			Bind:            viper.GetString("web.bind"),
+			Domain:          viper.GetString("web.domain"),
+			TrustProxy:      viper.GetBool("web.trust_proxy"),
+			ShutdownTimeout: viper.GetDuration("web.shutdown_timeout"),
+			TLS: TLSConfig{
+				Cert:               viper.GetString("web.tls.cert"),
+				Key:                viper.GetString("web.tls.key"),
+				ClientCA:           viper.GetString("web.tls.client_ca"),
+				RequireClientCert:  viper.GetBool("web.tls.require_client_cert"),
+				ClientCertUsername: viper.GetString("web.tls.client_cert_username"),
+				RedirectBind:       viper.GetString("web.tls.redirect_bind"),
+			},
+		},
+		DB: DBConfig{
+			Driver: viper.GetString("db.driver"),
+			Path:   viper.GetString("db.path"),
+		},
+		Security: SecurityConfig{
+			Secret:                viper.GetString("security.secret"),
+			BcryptDifficulty:      viper.GetInt("security.bcrypt.difficulty"),
+			SessionLifetime:       viper.GetDuration("security.session_lifetime"),
+			TokenMaxLifetime:      viper.GetDuration("security.token_max_lifetime"),
+			ExpiredTokenRetention: viper.GetDuration("security.expired_token_retention"),
+		},
+		Auth: AuthConfig{
+			Backends: viper.GetStringSlice("auth.backends"),
+			Htpasswd: HtpasswdConfig{
+				Path:   viper.GetString("auth.htpasswd.path"),
+				Create: viper.GetBool("auth.htpasswd.create"),
+				Link:   viper.GetBool("auth.htpasswd.link"),
+			},
+		},
+		LDAP: LDAPConfig{
+			Enabled:            viper.GetBool("ldap.enabled"),
+			URL:                viper.GetString("ldap.url"),
+			InsecureSkipVerify: viper.GetBool("ldap.insecure_skip_verify"),
+			StartTLS:           viper.GetBool("ldap.start_tls"),
+			BindDN:             viper.GetString("ldap.bind_dn"),
+			BindPassword:       viper.GetString("ldap.bind_password"),
+			BaseDN:             viper.GetString("ldap.base_dn"),
+			UserFilter:         viper.GetString("ldap.user_filter"),
+			GroupAttribute:     viper.GetString("ldap.group_attribute"),
+			Create:             viper.GetBool("ldap.create"),
+			Link:               viper.GetBool("ldap.link"),
+			Groups:             viper.GetStringMapStringSlice("ldap.groups"),
+		},
+		Discord: DiscordConfig{
+			Enabled:      viper.GetBool("discord.enabled"),
+			ClientID:     viper.GetString("discord.client_id"),
+			ClientSecret: viper.GetString("discord.client_secret"),
+			RedirectURI:  viper.GetString("discord.redirect_uri"),
+			Create:       viper.GetBool("discord.create"),
+		},
+		WebAuthn: WebAuthnConfig{
+			Enabled:             viper.GetBool("webauthn.enabled"),
+			DisplayName:         viper.GetString("webauthn.display_name"),
+			RPID:                viper.GetString("webauthn.rp_id"),
+			Origin:              viper.GetString("webauthn.origin"),
+			RequireSecondFactor: viper.GetBool("webauthn.require_second_factor"),
+		},
+		OIDC: OIDCConfig{
+			Enabled:    viper.GetBool("oidc.enabled"),
+			Issuer:     viper.GetString("oidc.issuer"),
+			SigningKey: viper.GetString("oidc.signing_key"),
+		},
+		TOTP: TOTPConfig{
+			Issuer: viper.GetString("mfa.totp.issuer"),
+		},
+		Radius: RadiusConfig{
+			Enabled: viper.GetBool("radius.enabled"),
+			Bind:    viper.GetString("radius.bind"),
+			Secret:  viper.GetString("radius.secret"),
+		},
+	}
+
+	err := viper.UnmarshalKey("auth.providers", &config.Auth.Providers)
+	return config, err
+}
+
+func (c *Config) setDefaults() {
+	if c.Web.Bind == "" {
+		c.Web.Bind = ":http"
+	}
+
+	if c.Web.ShutdownTimeout <= 0 {
+		c.Web.ShutdownTimeout = 30 * time.Second
+	}
+
+	if c.Web.TLS.ClientCertUsername == "" {
+		c.Web.TLS.ClientCertUsername = "cn"
+	}
+
+	if c.DB.Driver == "" {
+		c.DB.Driver = db.DRIVER_SQLITE
+	}
+
+	if c.Security.SessionLifetime <= 0 {
+		c.Security.SessionLifetime = 14 * 24 * time.Hour
+	}
+
+	// Deployments which predate `auth.backends` just toggle LDAP on
+	if len(c.Auth.Backends) == 0 {
+		c.Auth.Backends = []string{"local"}
+		if c.LDAP.Enabled {
+			c.Auth.Backends = append(c.Auth.Backends, "ldap")
+		}
+	}
+
+	if c.LDAP.UserFilter == "" {
+		c.LDAP.UserFilter = "(uid=%s)"
+	}
+
+	if c.LDAP.GroupAttribute == "" {
+		c.LDAP.GroupAttribute = "memberOf"
+	}
+
+	if c.WebAuthn.DisplayName == "" {
+		c.WebAuthn.DisplayName = "Heracles"
+	}
+
+	if c.TOTP.Issuer == "" {
+		c.TOTP.Issuer = "Heracles"
+	}
+
+	if c.Radius.Bind == "" {
+		c.Radius.Bind = ":1812"
+	}
+}
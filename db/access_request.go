@@ -0,0 +1,172 @@
+package db
+
+import (
+	"time"
+)
+
+const (
+	ACCESS_REQUEST_PENDING  = "pending"
+	ACCESS_REQUEST_APPROVED = "approved"
+	ACCESS_REQUEST_DENIED   = "denied"
+)
+
+// A user which may approve access requests for a realm
+type RealmOwner struct {
+	RealmId int64 `json:"realm_id" db:"realm_id"`
+	UserId  int64 `json:"user_id" db:"user_id"`
+}
+
+// A request from a user to be granted access to a realm
+type AccessRequest struct {
+	Id        int64  `json:"id" db:"id"`
+	UserId    int64  `json:"user_id" db:"user_id"`
+	RealmId   int64  `json:"realm_id" db:"realm_id"`
+	Reason    string `json:"reason" db:"reason"`
+	Status    string `json:"status" db:"status"`
+	CreatedAt int64  `json:"created_at" db:"created_at"`
+	DecidedBy *int64 `json:"decided_by" db:"decided_by"`
+	DecidedAt *int64 `json:"decided_at" db:"decided_at"`
+}
+
+func (s *SQLStore) DeleteRealmOwner(ro *RealmOwner) error {
+	_, err := s.db.Exec(`DELETE FROM realm_owners WHERE realm_id=? AND user_id=?`, ro.RealmId, ro.UserId)
+	return err
+}
+
+func (s *SQLStore) CreateRealmOwner(realmId, userId int64) (*RealmOwner, error) {
+	_, err := s.db.Exec(`INSERT INTO realm_owners (realm_id, user_id) VALUES (?, ?);`, realmId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RealmOwner{
+		RealmId: realmId,
+		UserId:  userId,
+	}, nil
+}
+
+func (s *SQLStore) GetRealmOwner(realmId, userId int64) (*RealmOwner, error) {
+	var owner RealmOwner
+	err := s.db.Get(&owner, `SELECT * FROM realm_owners WHERE realm_id=? AND user_id=?`, realmId, userId)
+	if err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
+
+func (s *SQLStore) GetRealmOwnersByRealmId(realmId int64) ([]RealmOwner, error) {
+	var owners []RealmOwner
+	err := s.db.Select(&owners, `SELECT * FROM realm_owners WHERE realm_id=?`, realmId)
+	if owners == nil {
+		return make([]RealmOwner, 0), err
+	}
+	return owners, err
+}
+
+// Marks the request as approved or denied by the given user
+func (s *SQLStore) DecideAccessRequest(ar *AccessRequest, status string, decidedBy int64) error {
+	ts := time.Now().Unix()
+
+	_, err := s.db.Exec(
+		`UPDATE access_requests SET status=?, decided_by=?, decided_at=? WHERE id=?`,
+		status,
+		decidedBy,
+		ts,
+		ar.Id,
+	)
+	if err != nil {
+		return err
+	}
+
+	ar.Status = status
+	ar.DecidedBy = &decidedBy
+	ar.DecidedAt = &ts
+	return nil
+}
+
+func (s *SQLStore) DeleteAccessRequest(ar *AccessRequest) error {
+	_, err := s.db.Exec(`DELETE FROM access_requests WHERE id=?`, ar.Id)
+	return err
+}
+
+func (s *SQLStore) CreateAccessRequest(userId, realmId int64, reason string) (*AccessRequest, error) {
+	ts := time.Now().Unix()
+
+	id, err := s.db.Insert(
+		`INSERT INTO access_requests (user_id, realm_id, reason, status, created_at) VALUES (?, ?, ?, ?, ?);`,
+		userId,
+		realmId,
+		reason,
+		ACCESS_REQUEST_PENDING,
+		ts,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessRequest{
+		Id:        id,
+		UserId:    userId,
+		RealmId:   realmId,
+		Reason:    reason,
+		Status:    ACCESS_REQUEST_PENDING,
+		CreatedAt: ts,
+	}, nil
+}
+
+func (s *SQLStore) GetAccessRequestById(id int64) (*AccessRequest, error) {
+	var request AccessRequest
+	err := s.db.Get(&request, `SELECT * FROM access_requests WHERE id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func (s *SQLStore) GetPendingAccessRequest(userId, realmId int64) (*AccessRequest, error) {
+	var request AccessRequest
+	err := s.db.Get(
+		&request,
+		`SELECT * FROM access_requests WHERE user_id=? AND realm_id=? AND status=?`,
+		userId,
+		realmId,
+		ACCESS_REQUEST_PENDING,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func (s *SQLStore) GetAccessRequestsByUserId(userId int64) ([]AccessRequest, error) {
+	var requests []AccessRequest
+	err := s.db.Select(&requests, `SELECT * FROM access_requests WHERE user_id=? ORDER BY id DESC`, userId)
+	if requests == nil {
+		return make([]AccessRequest, 0), err
+	}
+	return requests, err
+}
+
+func (s *SQLStore) GetPendingAccessRequests() ([]AccessRequest, error) {
+	var requests []AccessRequest
+	err := s.db.Select(&requests, `SELECT * FROM access_requests WHERE status=? ORDER BY id`, ACCESS_REQUEST_PENDING)
+	if requests == nil {
+		return make([]AccessRequest, 0), err
+	}
+	return requests, err
+}
+
+// Returns pending requests for realms owned by the given user
+func (s *SQLStore) GetPendingAccessRequestsByOwnerId(ownerId int64) ([]AccessRequest, error) {
+	var requests []AccessRequest
+	err := s.db.Select(&requests, `
+		SELECT ar.* FROM access_requests ar
+		JOIN realm_owners ro ON ro.realm_id = ar.realm_id
+		WHERE ro.user_id = ? AND ar.status = ?
+		ORDER BY ar.id
+	`, ownerId, ACCESS_REQUEST_PENDING)
+	if requests == nil {
+		return make([]AccessRequest, 0), err
+	}
+	return requests, err
+}
@@ -5,16 +5,6 @@ import (
 	"time"
 )
 
-const AUDIT_LOG_ENTRY_SCHEMA = `
-CREATE TABLE IF NOT EXISTS audit_log_entries (
-	id INTEGER PRIMARY KEY,
-	action TEXT,
-	user_id INTEGER,
-	created_at INTEGER,
-	data TEXT
-);
-`
-
 type AuditLogEntry struct {
 	Id        int64  `json:"id" db:"id"`
 	Action    string `json:"action" db:"action"`
@@ -25,7 +15,7 @@ type AuditLogEntry struct {
 	Data map[string]interface{} `json:"data" db:"-"`
 }
 
-func CreateAuditLogEntry(action string, user *User, data map[string]interface{}) (*AuditLogEntry, error) {
+func (s *SQLStore) CreateAuditLogEntry(action string, user *User, data map[string]interface{}) (*AuditLogEntry, error) {
 	dataEncoded, err := json.Marshal(data)
 	if err != nil {
 		return nil, err
@@ -33,7 +23,7 @@ func CreateAuditLogEntry(action string, user *User, data map[string]interface{})
 
 	ts := time.Now().Unix()
 
-	result, err := db.Exec(
+	id, err := s.db.Insert(
 		`INSERT INTO audit_log_entries (action, user_id, created_at, data) VALUES (?, ?, ?, ?);`,
 		action,
 		user.Id,
@@ -44,11 +34,6 @@ func CreateAuditLogEntry(action string, user *User, data map[string]interface{})
 		return nil, err
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
-
 	return &AuditLogEntry{
 		Id:        id,
 		Action:    action,
@@ -58,12 +43,19 @@ func CreateAuditLogEntry(action string, user *User, data map[string]interface{})
 	}, nil
 }
 
-func GetRecentAuditLogEntries(limit int) ([]AuditLogEntry, error) {
+func (s *SQLStore) GetRecentAuditLogEntries(limit int) ([]AuditLogEntry, error) {
 	var entries []AuditLogEntry
-	err := db.Select(&entries, `SELECT * FROM audit_log_entries ORDER BY action DESC LIMIT ?`, limit)
+	err := s.db.Select(&entries, `SELECT * FROM audit_log_entries ORDER BY action DESC LIMIT ?`, limit)
 	if err != nil {
 		return make([]AuditLogEntry, 0), err
 	}
 
-	return entries, err
+	for i := range entries {
+		err = json.Unmarshal([]byte(entries[i].RawData), &entries[i].Data)
+		if err != nil {
+			return make([]AuditLogEntry, 0), err
+		}
+	}
+
+	return entries, nil
 }
@@ -3,15 +3,105 @@ package db
 import (
 	"database/sql"
 	"log"
+	"strings"
 
-	"github.com/bwmarrin/go-alone"
 	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var difficulty int
-var db *sqlx.DB
-var signer *goalone.Sword
+const (
+	DRIVER_SQLITE   = "sqlite3"
+	DRIVER_POSTGRES = "postgres"
+)
+
+// Wraps the connection so queries can be written once using `?` placeholders,
+// which are rebound to whatever the driver expects.
+type database struct {
+	*sqlx.DB
+}
+
+type transaction struct {
+	*sqlx.Tx
+}
+
+func (d *database) IsPostgres() bool {
+	return d.DriverName() == DRIVER_POSTGRES
+}
+
+func (d *database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.DB.Exec(d.Rebind(query), args...)
+}
+
+func (d *database) MustExec(query string, args ...interface{}) sql.Result {
+	return d.DB.MustExec(d.Rebind(query), args...)
+}
+
+func (d *database) Get(dest interface{}, query string, args ...interface{}) error {
+	return d.DB.Get(dest, d.Rebind(query), args...)
+}
+
+func (d *database) Select(dest interface{}, query string, args ...interface{}) error {
+	return d.DB.Select(dest, d.Rebind(query), args...)
+}
+
+func (d *database) Beginx() (*transaction, error) {
+	tx, err := d.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{tx}, nil
+}
+
+// Runs an INSERT returning the id of the new row. Postgres has no equivalent
+// of LastInsertId so the id is returned from the query instead.
+func (d *database) Insert(query string, args ...interface{}) (int64, error) {
+	var id int64
+	if d.IsPostgres() {
+		query = strings.TrimSuffix(strings.TrimSpace(query), ";") + " RETURNING id"
+		err := d.DB.QueryRowx(d.Rebind(query), args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := d.DB.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (t *transaction) IsPostgres() bool {
+	return t.DriverName() == DRIVER_POSTGRES
+}
+
+func (t *transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.Tx.Exec(t.Rebind(query), args...)
+}
+
+func (t *transaction) Get(dest interface{}, query string, args ...interface{}) error {
+	return t.Tx.Get(dest, t.Rebind(query), args...)
+}
+
+func (t *transaction) Select(dest interface{}, query string, args ...interface{}) error {
+	return t.Tx.Select(dest, t.Rebind(query), args...)
+}
+
+// Runs an INSERT within the transaction returning the id of the new row, as
+// with database.Insert.
+func (t *transaction) Insert(query string, args ...interface{}) (int64, error) {
+	var id int64
+	if t.IsPostgres() {
+		query = strings.TrimSuffix(strings.TrimSpace(query), ";") + " RETURNING id"
+		err := t.Tx.QueryRowx(t.Rebind(query), args...).Scan(&id)
+		return id, err
+	}
+
+	result, err := t.Tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
 
 type Bits uint64
 
@@ -19,32 +109,53 @@ func (b Bits) Set(flag Bits) Bits   { return b | flag }
 func (b Bits) Clear(flag Bits) Bits { return b &^ flag }
 func (b Bits) Has(flag Bits) bool   { return b&flag != 0 }
 
-func InitDB(path, secretKey string, bcryptDifficulty int) {
-	difficulty = bcryptDifficulty
-	signer = goalone.New([]byte(secretKey))
+// Connects to the database, bringing its schema up to date and creating the
+// initial admin user if there are no users yet. The driver is either sqlite3,
+// where path is a file, or postgres, where path is a connection string.
+func OpenDB(driver, path string, bcryptDifficulty int) (*SQLStore, error) {
+	store, err := ConnectDB(driver, path)
+	if err != nil {
+		return nil, err
+	}
+	store.difficulty = bcryptDifficulty
 
-	db = sqlx.MustConnect("sqlite3", path)
-	db.MustExec(USER_SCHEMA)
-	db.MustExec(USER_TOKEN_SCHEMA)
-	db.MustExec(REALM_SCHEMA)
-	db.MustExec(USER_REALM_GRANT_SCHEMA)
-	db.MustExec(AUDIT_LOG_ENTRY_SCHEMA)
+	_, err = store.Migrate()
+	if err == nil {
+		var user User
+		err = store.db.Get(&user, `SELECT * FROM users LIMIT 1`)
+		if err == sql.ErrNoRows {
+			err = bootstrapDB(store)
+		}
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
 
-	var user User
-	err := db.Get(&user, `SELECT * FROM users LIMIT 1`)
-	if err == sql.ErrNoRows {
-		bootstrapDB()
+// Connects to the database without touching its contents
+func ConnectDB(driver, path string) (*SQLStore, error) {
+	conn, err := sqlx.Connect(driver, path)
+	if err != nil {
+		return nil, err
 	}
+
+	return &SQLStore{db: &database{conn}}, nil
+}
+
+// Escapes the wildcards in a string matched with `LIKE ? ESCAPE '\'`
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
 }
 
-func bootstrapDB() {
+func bootstrapDB(store Store) error {
 	log.Printf("Bootstraping Database w/ admin user")
 
 	var flags Bits
 	flags = flags.Set(USER_FLAG_ADMIN)
 
-	_, err := CreateUser("admin", "admin", flags, nil)
-	if err != nil {
-		panic(err)
-	}
+	_, err := store.CreateUser("admin", "admin", flags, nil)
+	return err
 }
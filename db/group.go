@@ -0,0 +1,200 @@
+package db
+
+// A set of users which can be granted access to realms together
+type Group struct {
+	Id   int64  `json:"id" db:"id"`
+	Name string `json:"name" db:"name"`
+}
+
+type GroupMember struct {
+	GroupId int64 `json:"group_id" db:"group_id"`
+	UserId  int64 `json:"user_id" db:"user_id"`
+}
+
+type GroupRealmGrant struct {
+	GroupId int64 `json:"group_id" db:"group_id"`
+	RealmId int64 `json:"realm_id" db:"realm_id"`
+}
+
+func (s *SQLStore) UpdateGroupName(g *Group, name string) error {
+	_, err := s.db.Exec(`UPDATE groups SET name=? WHERE id=?`, name, g.Id)
+	if err != nil {
+		return err
+	}
+
+	g.Name = name
+	return nil
+}
+
+// Deletes the group along with its memberships and grants
+func (s *SQLStore) DeleteGroup(g *Group) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM group_members WHERE group_id=?`,
+		`DELETE FROM group_realm_grants WHERE group_id=?`,
+		`DELETE FROM group_realm_grant_roles WHERE group_id=?`,
+		`DELETE FROM groups WHERE id=?`,
+	} {
+		_, err = tx.Exec(query, g.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) CreateGroup(name string) (*Group, error) {
+	id, err := s.db.Insert(`INSERT INTO groups (name) VALUES (?);`, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Group{
+		Id:   id,
+		Name: name,
+	}, nil
+}
+
+func (s *SQLStore) GetGroupById(id int64) (*Group, error) {
+	var group Group
+	err := s.db.Get(&group, `SELECT * FROM groups WHERE id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (s *SQLStore) GetGroupByName(name string) (*Group, error) {
+	var group Group
+	err := s.db.Get(&group, `SELECT * FROM groups WHERE name=?`, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (s *SQLStore) GetGroups() ([]Group, error) {
+	var groups []Group
+	err := s.db.Select(&groups, `SELECT * FROM groups`)
+	if groups == nil {
+		return make([]Group, 0), err
+	}
+	return groups, err
+}
+
+func (s *SQLStore) GetGroupsByUserId(userId int64) ([]Group, error) {
+	var groups []Group
+	err := s.db.Select(&groups, `
+		SELECT g.* FROM groups g
+		JOIN group_members gm ON gm.group_id = g.id
+		WHERE gm.user_id = ?
+	`, userId)
+	if groups == nil {
+		return make([]Group, 0), err
+	}
+	return groups, err
+}
+
+func (s *SQLStore) DeleteGroupMember(gm *GroupMember) error {
+	_, err := s.db.Exec(`DELETE FROM group_members WHERE group_id=? AND user_id=?`, gm.GroupId, gm.UserId)
+	return err
+}
+
+func (s *SQLStore) CreateGroupMember(groupId, userId int64) (*GroupMember, error) {
+	_, err := s.db.Exec(`INSERT INTO group_members (group_id, user_id) VALUES (?, ?);`, groupId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupMember{
+		GroupId: groupId,
+		UserId:  userId,
+	}, nil
+}
+
+func (s *SQLStore) GetGroupMember(groupId, userId int64) (*GroupMember, error) {
+	var member GroupMember
+	err := s.db.Get(&member, `SELECT * FROM group_members WHERE group_id=? AND user_id=?`, groupId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
+
+func (s *SQLStore) GetGroupMembersByGroupId(groupId int64) ([]GroupMember, error) {
+	var members []GroupMember
+	err := s.db.Select(&members, `SELECT * FROM group_members WHERE group_id=?`, groupId)
+	if members == nil {
+		return make([]GroupMember, 0), err
+	}
+	return members, err
+}
+
+func (s *SQLStore) DeleteGroupRealmGrant(g *GroupRealmGrant) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM group_realm_grant_roles WHERE group_id=? AND realm_id=?`,
+		`DELETE FROM group_realm_grants WHERE group_id=? AND realm_id=?`,
+	} {
+		_, err = tx.Exec(query, g.GroupId, g.RealmId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) CreateGroupRealmGrant(groupId, realmId int64) (*GroupRealmGrant, error) {
+	_, err := s.db.Exec(`INSERT INTO group_realm_grants (group_id, realm_id) VALUES (?, ?);`, groupId, realmId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupRealmGrant{
+		GroupId: groupId,
+		RealmId: realmId,
+	}, nil
+}
+
+func (s *SQLStore) GetGroupRealmGrant(groupId, realmId int64) (*GroupRealmGrant, error) {
+	var grant GroupRealmGrant
+	err := s.db.Get(&grant, `SELECT * FROM group_realm_grants WHERE group_id=? AND realm_id=?`, groupId, realmId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grant, nil
+}
+
+func (s *SQLStore) GetGroupRealmGrantsByGroupId(groupId int64) ([]GroupRealmGrant, error) {
+	var grants []GroupRealmGrant
+	err := s.db.Select(&grants, `SELECT * FROM group_realm_grants WHERE group_id=?`, groupId)
+	if grants == nil {
+		return make([]GroupRealmGrant, 0), err
+	}
+	return grants, err
+}
+
+func (s *SQLStore) GetGroupRealmGrantsByRealmId(realmId int64) ([]GroupRealmGrant, error) {
+	var grants []GroupRealmGrant
+	err := s.db.Select(&grants, `SELECT * FROM group_realm_grants WHERE realm_id=?`, realmId)
+	if grants == nil {
+		return make([]GroupRealmGrant, 0), err
+	}
+	return grants, err
+}
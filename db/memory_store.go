@@ -0,0 +1,1748 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Returned where the SQL store would fail on a unique constraint
+var ErrMemoryStoreConflict = errors.New("row already exists")
+
+type userRealmGrantKey struct {
+	UserId  int64
+	RealmId int64
+}
+
+type groupMemberKey struct {
+	GroupId int64
+	UserId  int64
+}
+
+type groupRealmGrantKey struct {
+	GroupId int64
+	RealmId int64
+}
+
+type realmOwnerKey struct {
+	RealmId int64
+	UserId  int64
+}
+
+type userIdentityKey struct {
+	Provider string
+	Subject  string
+}
+
+// MemoryStore implements Store without a database, for use in tests. Passwords
+// are hashed with the minimum bcrypt cost to keep tests fast.
+type MemoryStore struct {
+	sync.Mutex
+
+	lastId int64
+
+	users               map[int64]User
+	tokens              map[int64]UserToken
+	realms              map[int64]Realm
+	grants              map[userRealmGrantKey]UserRealmGrant
+	grantRoles          map[userRealmGrantKey][]int64
+	roles               map[int64]RealmRole
+	groups              map[int64]Group
+	groupMembers        map[groupMemberKey]GroupMember
+	groupGrants         map[groupRealmGrantKey]GroupRealmGrant
+	groupGrantRoles     map[groupRealmGrantKey][]int64
+	owners              map[realmOwnerKey]RealmOwner
+	accessRequests      map[int64]AccessRequest
+	sessions            map[int64]Session
+	secondFactorLogins  map[string]SecondFactorLogin
+	radiusChallenges    map[string]RadiusChallenge
+	totp                map[int64]UserTOTP
+	webAuthnCredentials map[int64]UserWebAuthnCredential
+	identities          map[userIdentityKey]UserIdentity
+	oidcClients         map[string]OIDCClient
+	oidcAuthorizations  map[string]OIDCAuthorization
+	auditLog            []AuditLogEntry
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:               make(map[int64]User),
+		tokens:              make(map[int64]UserToken),
+		realms:              make(map[int64]Realm),
+		grants:              make(map[userRealmGrantKey]UserRealmGrant),
+		grantRoles:          make(map[userRealmGrantKey][]int64),
+		roles:               make(map[int64]RealmRole),
+		groups:              make(map[int64]Group),
+		groupMembers:        make(map[groupMemberKey]GroupMember),
+		groupGrants:         make(map[groupRealmGrantKey]GroupRealmGrant),
+		groupGrantRoles:     make(map[groupRealmGrantKey][]int64),
+		owners:              make(map[realmOwnerKey]RealmOwner),
+		accessRequests:      make(map[int64]AccessRequest),
+		sessions:            make(map[int64]Session),
+		secondFactorLogins:  make(map[string]SecondFactorLogin),
+		radiusChallenges:    make(map[string]RadiusChallenge),
+		totp:                make(map[int64]UserTOTP),
+		webAuthnCredentials: make(map[int64]UserWebAuthnCredential),
+		identities:          make(map[userIdentityKey]UserIdentity),
+		oidcClients:         make(map[string]OIDCClient),
+		oidcAuthorizations:  make(map[string]OIDCAuthorization),
+	}
+}
+
+func (m *MemoryStore) nextId() int64 {
+	m.lastId++
+	return m.lastId
+}
+
+func (m *MemoryStore) CreateUser(username, password string, flags Bits, discordId *int64) (*User, error) {
+	passwordHash, err := hashPassword(password, bcrypt.MinCost)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	user := User{
+		Id:        m.nextId(),
+		Username:  username,
+		Password:  passwordHash,
+		Flags:     flags,
+		DiscordId: discordId,
+	}
+	m.users[user.Id] = user
+	return &user, nil
+}
+
+func (m *MemoryStore) findUser(match func(*User) bool) (*User, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, user := range m.users {
+		if match(&user) {
+			return &user, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) GetUserById(id int64) (*User, error) {
+	return m.findUser(func(u *User) bool { return u.Id == id })
+}
+
+func (m *MemoryStore) GetUserByUsername(username string) (*User, error) {
+	return m.findUser(func(u *User) bool { return u.Username == username })
+}
+
+func (m *MemoryStore) GetUserByDiscordId(id int64) (*User, error) {
+	return m.findUser(func(u *User) bool { return u.DiscordId != nil && *u.DiscordId == id })
+}
+
+func (m *MemoryStore) GetUsers() ([]User, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	users := make([]User, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	return users, nil
+}
+
+// Applies the change to both the caller's copy of the user and the stored one
+func (m *MemoryStore) updateUser(u *User, update func(*User)) error {
+	m.Lock()
+	defer m.Unlock()
+
+	stored, ok := m.users[u.Id]
+	if !ok {
+		return nil
+	}
+
+	update(u)
+	update(&stored)
+	m.users[u.Id] = stored
+	return nil
+}
+
+func (m *MemoryStore) UpdateUsername(u *User, username string) error {
+	return m.updateUser(u, func(user *User) { user.Username = username })
+}
+
+func (m *MemoryStore) UpdateUserDiscordId(u *User, discordId *int64) error {
+	return m.updateUser(u, func(user *User) { user.DiscordId = discordId })
+}
+
+func (m *MemoryStore) UpdateUserFlags(u *User, flags Bits) error {
+	return m.updateUser(u, func(user *User) { user.Flags = flags })
+}
+
+func (m *MemoryStore) UpdateUserPassword(u *User, password string) error {
+	passwordHash, err := hashPassword(password, bcrypt.MinCost)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if stored, ok := m.users[u.Id]; ok {
+		stored.Password = passwordHash
+		m.users[u.Id] = stored
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(u *User) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.deleteUserTokensByUserId(u.Id)
+	for key := range m.grants {
+		if key.UserId == u.Id {
+			delete(m.grants, key)
+			delete(m.grantRoles, key)
+		}
+	}
+	for key := range m.groupMembers {
+		if key.UserId == u.Id {
+			delete(m.groupMembers, key)
+		}
+	}
+	for key := range m.owners {
+		if key.UserId == u.Id {
+			delete(m.owners, key)
+		}
+	}
+	for id, request := range m.accessRequests {
+		if request.UserId == u.Id {
+			delete(m.accessRequests, id)
+		}
+	}
+	for id, session := range m.sessions {
+		if session.UserId == u.Id {
+			delete(m.sessions, id)
+		}
+	}
+	for id, login := range m.secondFactorLogins {
+		if login.UserId == u.Id {
+			delete(m.secondFactorLogins, id)
+		}
+	}
+	for code, authorization := range m.oidcAuthorizations {
+		if authorization.UserId == u.Id {
+			delete(m.oidcAuthorizations, code)
+		}
+	}
+	for state, challenge := range m.radiusChallenges {
+		if challenge.UserId == u.Id {
+			delete(m.radiusChallenges, state)
+		}
+	}
+	for id, credential := range m.webAuthnCredentials {
+		if credential.UserId == u.Id {
+			delete(m.webAuthnCredentials, id)
+		}
+	}
+	for key, identity := range m.identities {
+		if identity.UserId == u.Id {
+			delete(m.identities, key)
+		}
+	}
+	delete(m.totp, u.Id)
+	delete(m.users, u.Id)
+	return nil
+}
+
+func (m *MemoryStore) CreateUserToken(userId int64, name string, flags Bits, expiresAt *int64, realms, scopes []string) (*UserToken, error) {
+	tokenEncoded, err := GenerateUserTokenContents()
+	if err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	ts := time.Now().Unix()
+	userToken := UserToken{
+		Id:          m.nextId(),
+		UserId:      userId,
+		Name:        name,
+		TokenHash:   hashUserToken(tokenEncoded),
+		TokenPrefix: tokenEncoded[:userTokenPrefixLength],
+		Flags:       flags,
+		CreatedAt:   &ts,
+		ExpiresAt:   expiresAt,
+		Realms:      uniqueSorted(realms),
+		Scopes:      uniqueSorted(scopes),
+	}
+	m.tokens[userToken.Id] = userToken
+
+	userToken.Token = tokenEncoded
+	return &userToken, nil
+}
+
+func (m *MemoryStore) GetUserTokenById(id int64) (*UserToken, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	userToken, ok := m.tokens[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &userToken, nil
+}
+
+func (m *MemoryStore) GetUserTokenByToken(token string, isAPI bool) (*UserToken, error) {
+	tokenHash := hashUserToken(token)
+
+	userTokens := m.filterUserTokens(func(ut *UserToken) bool { return ut.TokenHash == tokenHash })
+	if len(userTokens) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	userToken := userTokens[0]
+	if userToken.IsExpired() || (isAPI && !userToken.Flags.Has(USER_TOKEN_FLAG_API)) {
+		return nil, sql.ErrNoRows
+	}
+	return &userToken, nil
+}
+
+// Returns copies of the tokens matching the filter, ordered by id
+func (m *MemoryStore) filterUserTokens(match func(*UserToken) bool) []UserToken {
+	m.Lock()
+	defer m.Unlock()
+
+	userTokens := make([]UserToken, 0)
+	for _, userToken := range m.tokens {
+		if match(&userToken) {
+			userTokens = append(userTokens, userToken)
+		}
+	}
+	sort.Slice(userTokens, func(i, j int) bool { return userTokens[i].Id < userTokens[j].Id })
+	return userTokens
+}
+
+func (m *MemoryStore) GetUserTokensByUserId(id int64) ([]UserToken, error) {
+	return m.filterUserTokens(func(ut *UserToken) bool { return ut.UserId == id }), nil
+}
+
+func (m *MemoryStore) SearchUserTokens(name, prefix string) ([]UserToken, error) {
+	name = strings.ToLower(name)
+	return m.filterUserTokens(func(ut *UserToken) bool {
+		return strings.Contains(strings.ToLower(ut.Name), name) && strings.HasPrefix(ut.TokenPrefix, prefix)
+	}), nil
+}
+
+func (m *MemoryStore) GetUserTokensExpiredBefore(ts int64) ([]UserToken, error) {
+	return m.filterUserTokens(func(ut *UserToken) bool {
+		return ut.ExpiresAt != nil && *ut.ExpiresAt <= ts
+	}), nil
+}
+
+// Applies the change to both the caller's copy of the token and the stored one
+func (m *MemoryStore) updateUserToken(ut *UserToken, update func(*UserToken)) error {
+	m.Lock()
+	defer m.Unlock()
+
+	stored, ok := m.tokens[ut.Id]
+	if !ok {
+		return nil
+	}
+
+	update(ut)
+	update(&stored)
+	m.tokens[ut.Id] = stored
+	return nil
+}
+
+func (m *MemoryStore) SaveUserToken(ut *UserToken) error {
+	realms := uniqueSorted(ut.Realms)
+	scopes := uniqueSorted(ut.Scopes)
+	return m.updateUserToken(ut, func(userToken *UserToken) {
+		userToken.Name = ut.Name
+		userToken.Flags = ut.Flags
+		userToken.ExpiresAt = ut.ExpiresAt
+		userToken.TokenHash = ut.TokenHash
+		userToken.TokenPrefix = ut.TokenPrefix
+		userToken.Realms = realms
+		userToken.Scopes = scopes
+	})
+}
+
+// Mirrors the ordering and de-duplication the SQL store gets from its queries
+func uniqueSorted(values []string) []string {
+	result := make([]string, 0, len(values))
+	seen := make(map[string]bool)
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (m *MemoryStore) TouchUserToken(ut *UserToken, ip string) error {
+	ts := time.Now().Unix()
+	return m.updateUserToken(ut, func(userToken *UserToken) {
+		userToken.LastUsedAt = &ts
+		userToken.LastUsedIP = &ip
+	})
+}
+
+func (m *MemoryStore) DeleteUserToken(ut *UserToken) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.tokens, ut.Id)
+	return nil
+}
+
+func (m *MemoryStore) DeleteUserTokensByUserId(id int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.deleteUserTokensByUserId(id)
+	return nil
+}
+
+func (m *MemoryStore) deleteUserTokensByUserId(id int64) {
+	for tokenId, userToken := range m.tokens {
+		if userToken.UserId == id {
+			delete(m.tokens, tokenId)
+		}
+	}
+}
+
+func (m *MemoryStore) CreateRealm(name string, parentId *int64) (*Realm, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	realm := Realm{
+		Id:       m.nextId(),
+		Name:     name,
+		ParentId: parentId,
+	}
+	m.realms[realm.Id] = realm
+	return &realm, nil
+}
+
+func (m *MemoryStore) GetRealmById(id int64) (*Realm, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	realm, ok := m.realms[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &realm, nil
+}
+
+func (m *MemoryStore) GetRealmByName(name string) (*Realm, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, realm := range m.realms {
+		if realm.Name == name {
+			return &realm, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) GetRealmLineage(name string) ([]Realm, error) {
+	return getRealmLineage(m, name)
+}
+
+func (m *MemoryStore) GetRealms() ([]Realm, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	realms := make([]Realm, 0, len(m.realms))
+	for _, realm := range m.realms {
+		realms = append(realms, realm)
+	}
+	sort.Slice(realms, func(i, j int) bool { return realms[i].Id < realms[j].Id })
+	return realms, nil
+}
+
+func (m *MemoryStore) UpdateRealmName(r *Realm, name string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	stored, ok := m.realms[r.Id]
+	if !ok {
+		return nil
+	}
+
+	// Tokens are restricted by name here, so they have to follow the rename
+	for id, realms := range m.userTokensRealmsWithout(stored.Name) {
+		userToken := m.tokens[id]
+		userToken.Realms = uniqueSorted(append(realms, name))
+		m.tokens[id] = userToken
+	}
+
+	stored.Name = name
+	m.realms[r.Id] = stored
+	r.Name = name
+	return nil
+}
+
+// Returns the other realms of each token restricted to the named one, by the
+// token's id.
+func (m *MemoryStore) userTokensRealmsWithout(name string) map[int64][]string {
+	result := make(map[int64][]string)
+	for id, userToken := range m.tokens {
+		realms := make([]string, 0, len(userToken.Realms))
+		for _, realm := range userToken.Realms {
+			if realm != name {
+				realms = append(realms, realm)
+			}
+		}
+		if len(realms) != len(userToken.Realms) {
+			result[id] = realms
+		}
+	}
+	return result
+}
+
+func (m *MemoryStore) UpdateRealmParent(r *Realm, parentId *int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if stored, ok := m.realms[r.Id]; ok {
+		stored.ParentId = parentId
+		m.realms[r.Id] = stored
+		r.ParentId = parentId
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteRealm(r *Realm) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if stored, ok := m.realms[r.Id]; ok {
+		for id, realms := range m.userTokensRealmsWithout(stored.Name) {
+			if len(realms) == 0 {
+				delete(m.tokens, id)
+				continue
+			}
+
+			userToken := m.tokens[id]
+			userToken.Realms = realms
+			m.tokens[id] = userToken
+		}
+	}
+
+	for id, realm := range m.realms {
+		if realm.ParentId != nil && *realm.ParentId == r.Id {
+			realm.ParentId = nil
+			m.realms[id] = realm
+		}
+	}
+
+	for key := range m.grants {
+		if key.RealmId == r.Id {
+			delete(m.grants, key)
+			delete(m.grantRoles, key)
+		}
+	}
+	for key := range m.groupGrants {
+		if key.RealmId == r.Id {
+			delete(m.groupGrants, key)
+			delete(m.groupGrantRoles, key)
+		}
+	}
+	for id, role := range m.roles {
+		if role.RealmId == r.Id {
+			delete(m.roles, id)
+		}
+	}
+	for key := range m.owners {
+		if key.RealmId == r.Id {
+			delete(m.owners, key)
+		}
+	}
+	for id, request := range m.accessRequests {
+		if request.RealmId == r.Id {
+			delete(m.accessRequests, id)
+		}
+	}
+	for id, client := range m.oidcClients {
+		if client.RealmId == r.Id {
+			delete(m.oidcClients, id)
+		}
+	}
+	delete(m.realms, r.Id)
+	return nil
+}
+
+func (m *MemoryStore) CreateUserRealmGrant(userId int64, realmId int64, alias *string, notBefore, expiresAt *int64) (*UserRealmGrant, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := userRealmGrantKey{userId, realmId}
+	if _, exists := m.grants[key]; exists {
+		return nil, ErrMemoryStoreConflict
+	}
+
+	grant := UserRealmGrant{
+		UserId:    userId,
+		RealmId:   realmId,
+		Alias:     alias,
+		NotBefore: notBefore,
+		ExpiresAt: expiresAt,
+	}
+	m.grants[key] = grant
+	return &grant, nil
+}
+
+func (m *MemoryStore) GetUserRealmGrant(userId int64, realmId int64) (*UserRealmGrant, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	grant, ok := m.grants[userRealmGrantKey{userId, realmId}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &grant, nil
+}
+
+func isActiveUserRealmGrant(grant *UserRealmGrant, now int64) bool {
+	return (grant.NotBefore == nil || *grant.NotBefore <= now) && (grant.ExpiresAt == nil || *grant.ExpiresAt > now)
+}
+
+// Returns whether the user is a member of a group granted access to the realm
+func (m *MemoryStore) hasGroupRealmGrant(userId int64, realmId int64) bool {
+	for key := range m.groupGrants {
+		if key.RealmId != realmId {
+			continue
+		}
+
+		if _, ok := m.groupMembers[groupMemberKey{key.GroupId, userId}]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) GetEffectiveUserRealmGrant(userId int64, realmId int64) (*UserRealmGrant, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	grant, ok := m.grants[userRealmGrantKey{userId, realmId}]
+	if ok && isActiveUserRealmGrant(&grant, time.Now().Unix()) {
+		return &grant, nil
+	}
+
+	if m.hasGroupRealmGrant(userId, realmId) {
+		return &UserRealmGrant{
+			UserId:  userId,
+			RealmId: realmId,
+		}, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) GetUserRealmGrantByRealmName(userId int64, realmName string) (*UserRealmGrant, error) {
+	return getUserRealmGrantByRealmName(m, userId, realmName)
+}
+
+// Returns copies of the grants matching the filter, ordered by user
+func (m *MemoryStore) filterUserRealmGrants(match func(*UserRealmGrant) bool) []UserRealmGrant {
+	m.Lock()
+	defer m.Unlock()
+
+	grants := make([]UserRealmGrant, 0)
+	for _, grant := range m.grants {
+		if match(&grant) {
+			grants = append(grants, grant)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].UserId != grants[j].UserId {
+			return grants[i].UserId < grants[j].UserId
+		}
+		return grants[i].RealmId < grants[j].RealmId
+	})
+	return grants
+}
+
+func (m *MemoryStore) GetUserRealmGrantsByRealmId(realmId int64) ([]UserRealmGrant, error) {
+	return m.filterUserRealmGrants(func(g *UserRealmGrant) bool { return g.RealmId == realmId }), nil
+}
+
+func (m *MemoryStore) GetUserRealmGrantsByUserId(userId int64) ([]UserRealmGrant, error) {
+	return m.filterUserRealmGrants(func(g *UserRealmGrant) bool { return g.UserId == userId }), nil
+}
+
+func (m *MemoryStore) GetExpiredUserRealmGrants() ([]UserRealmGrant, error) {
+	now := time.Now().Unix()
+	return m.filterUserRealmGrants(func(g *UserRealmGrant) bool {
+		return g.ExpiresAt != nil && *g.ExpiresAt <= now
+	}), nil
+}
+
+func (m *MemoryStore) UpdateUserRealmGrantAlias(g *UserRealmGrant, alias *string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	key := userRealmGrantKey{g.UserId, g.RealmId}
+	if stored, ok := m.grants[key]; ok {
+		stored.Alias = alias
+		m.grants[key] = stored
+		g.Alias = alias
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateUserRealmGrantLDAPGroup(g *UserRealmGrant, group *string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	key := userRealmGrantKey{g.UserId, g.RealmId}
+	if stored, ok := m.grants[key]; ok {
+		stored.LDAPGroup = group
+		m.grants[key] = stored
+		g.LDAPGroup = group
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteUserRealmGrant(g *UserRealmGrant) error {
+	m.Lock()
+	defer m.Unlock()
+
+	key := userRealmGrantKey{g.UserId, g.RealmId}
+	delete(m.grants, key)
+	delete(m.grantRoles, key)
+	return nil
+}
+
+func (m *MemoryStore) CreateRealmRole(realmId int64, name string, level int64) (*RealmRole, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	role := RealmRole{
+		Id:      m.nextId(),
+		RealmId: realmId,
+		Name:    name,
+		Level:   level,
+	}
+	m.roles[role.Id] = role
+	return &role, nil
+}
+
+func (m *MemoryStore) GetRealmRoleById(id int64) (*RealmRole, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	role, ok := m.roles[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &role, nil
+}
+
+func (m *MemoryStore) GetRealmRoleByName(realmId int64, name string) (*RealmRole, error) {
+	roles := m.filterRealmRoles(func(r *RealmRole) bool { return r.RealmId == realmId && r.Name == name })
+	if len(roles) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &roles[0], nil
+}
+
+// Returns copies of the roles matching the filter, ordered by level
+func (m *MemoryStore) filterRealmRoles(match func(*RealmRole) bool) []RealmRole {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.filterRealmRolesLocked(match)
+}
+
+func (m *MemoryStore) filterRealmRolesLocked(match func(*RealmRole) bool) []RealmRole {
+	roles := make([]RealmRole, 0)
+	for _, role := range m.roles {
+		if match(&role) {
+			roles = append(roles, role)
+		}
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		if roles[i].Level != roles[j].Level {
+			return roles[i].Level < roles[j].Level
+		}
+		return roles[i].Id < roles[j].Id
+	})
+	return roles
+}
+
+// Returns the roles with the given ids, ordered by level
+func (m *MemoryStore) getRealmRolesLocked(roleIds []int64) []RealmRole {
+	wanted := make(map[int64]bool)
+	for _, roleId := range roleIds {
+		wanted[roleId] = true
+	}
+	return m.filterRealmRolesLocked(func(r *RealmRole) bool { return wanted[r.Id] })
+}
+
+func (m *MemoryStore) GetRealmRolesByRealmId(realmId int64) ([]RealmRole, error) {
+	return m.filterRealmRoles(func(r *RealmRole) bool { return r.RealmId == realmId }), nil
+}
+
+// Returns the role ids without the given one
+func removeRoleId(roleIds []int64, roleId int64) []int64 {
+	result := make([]int64, 0, len(roleIds))
+	for _, id := range roleIds {
+		if id != roleId {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func (m *MemoryStore) DeleteRealmRole(r *RealmRole) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for key, roleIds := range m.grantRoles {
+		m.grantRoles[key] = removeRoleId(roleIds, r.Id)
+	}
+	for key, roleIds := range m.groupGrantRoles {
+		m.groupGrantRoles[key] = removeRoleId(roleIds, r.Id)
+	}
+	delete(m.roles, r.Id)
+	return nil
+}
+
+func (m *MemoryStore) SetUserRealmGrantRoles(userId, realmId int64, roleIds []int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.grantRoles[userRealmGrantKey{userId, realmId}] = append([]int64{}, roleIds...)
+	return nil
+}
+
+func (m *MemoryStore) GetUserRealmGrantRoles(userId, realmId int64) ([]RealmRole, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.getRealmRolesLocked(m.grantRoles[userRealmGrantKey{userId, realmId}]), nil
+}
+
+func (m *MemoryStore) SetGroupRealmGrantRoles(groupId, realmId int64, roleIds []int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.groupGrantRoles[groupRealmGrantKey{groupId, realmId}] = append([]int64{}, roleIds...)
+	return nil
+}
+
+func (m *MemoryStore) GetGroupRealmGrantRoles(groupId, realmId int64) ([]RealmRole, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.getRealmRolesLocked(m.groupGrantRoles[groupRealmGrantKey{groupId, realmId}]), nil
+}
+
+func (m *MemoryStore) GetEffectiveUserRealmRoles(userId, realmId int64) ([]RealmRole, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	roleIds := make([]int64, 0)
+
+	key := userRealmGrantKey{userId, realmId}
+	if grant, ok := m.grants[key]; ok && isActiveUserRealmGrant(&grant, time.Now().Unix()) {
+		roleIds = append(roleIds, m.grantRoles[key]...)
+	}
+
+	for groupKey := range m.groupGrants {
+		if groupKey.RealmId != realmId {
+			continue
+		}
+
+		if _, ok := m.groupMembers[groupMemberKey{groupKey.GroupId, userId}]; ok {
+			roleIds = append(roleIds, m.groupGrantRoles[groupKey]...)
+		}
+	}
+
+	return m.getRealmRolesLocked(roleIds), nil
+}
+
+func (m *MemoryStore) CreateGroup(name string) (*Group, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	group := Group{
+		Id:   m.nextId(),
+		Name: name,
+	}
+	m.groups[group.Id] = group
+	return &group, nil
+}
+
+func (m *MemoryStore) GetGroupById(id int64) (*Group, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	group, ok := m.groups[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &group, nil
+}
+
+func (m *MemoryStore) GetGroupByName(name string) (*Group, error) {
+	groups := m.filterGroups(func(g *Group) bool { return g.Name == name })
+	if len(groups) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &groups[0], nil
+}
+
+// Returns copies of the groups matching the filter, ordered by id
+func (m *MemoryStore) filterGroups(match func(*Group) bool) []Group {
+	m.Lock()
+	defer m.Unlock()
+
+	groups := make([]Group, 0)
+	for _, group := range m.groups {
+		if match(&group) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Id < groups[j].Id })
+	return groups
+}
+
+func (m *MemoryStore) GetGroups() ([]Group, error) {
+	return m.filterGroups(func(g *Group) bool { return true }), nil
+}
+
+func (m *MemoryStore) GetGroupsByUserId(userId int64) ([]Group, error) {
+	return m.filterGroups(func(g *Group) bool {
+		_, ok := m.groupMembers[groupMemberKey{g.Id, userId}]
+		return ok
+	}), nil
+}
+
+func (m *MemoryStore) UpdateGroupName(g *Group, name string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if stored, ok := m.groups[g.Id]; ok {
+		stored.Name = name
+		m.groups[g.Id] = stored
+		g.Name = name
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteGroup(g *Group) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for key := range m.groupMembers {
+		if key.GroupId == g.Id {
+			delete(m.groupMembers, key)
+		}
+	}
+	for key := range m.groupGrants {
+		if key.GroupId == g.Id {
+			delete(m.groupGrants, key)
+			delete(m.groupGrantRoles, key)
+		}
+	}
+	delete(m.groups, g.Id)
+	return nil
+}
+
+func (m *MemoryStore) CreateGroupMember(groupId, userId int64) (*GroupMember, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := groupMemberKey{groupId, userId}
+	if _, exists := m.groupMembers[key]; exists {
+		return nil, ErrMemoryStoreConflict
+	}
+
+	member := GroupMember{
+		GroupId: groupId,
+		UserId:  userId,
+	}
+	m.groupMembers[key] = member
+	return &member, nil
+}
+
+func (m *MemoryStore) GetGroupMember(groupId, userId int64) (*GroupMember, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	member, ok := m.groupMembers[groupMemberKey{groupId, userId}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &member, nil
+}
+
+func (m *MemoryStore) GetGroupMembersByGroupId(groupId int64) ([]GroupMember, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	members := make([]GroupMember, 0)
+	for _, member := range m.groupMembers {
+		if member.GroupId == groupId {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].UserId < members[j].UserId })
+	return members, nil
+}
+
+func (m *MemoryStore) DeleteGroupMember(gm *GroupMember) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.groupMembers, groupMemberKey{gm.GroupId, gm.UserId})
+	return nil
+}
+
+func (m *MemoryStore) CreateGroupRealmGrant(groupId, realmId int64) (*GroupRealmGrant, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := groupRealmGrantKey{groupId, realmId}
+	if _, exists := m.groupGrants[key]; exists {
+		return nil, ErrMemoryStoreConflict
+	}
+
+	grant := GroupRealmGrant{
+		GroupId: groupId,
+		RealmId: realmId,
+	}
+	m.groupGrants[key] = grant
+	return &grant, nil
+}
+
+func (m *MemoryStore) GetGroupRealmGrant(groupId, realmId int64) (*GroupRealmGrant, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	grant, ok := m.groupGrants[groupRealmGrantKey{groupId, realmId}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &grant, nil
+}
+
+// Returns copies of the group grants matching the filter, ordered by group
+func (m *MemoryStore) filterGroupRealmGrants(match func(*GroupRealmGrant) bool) []GroupRealmGrant {
+	m.Lock()
+	defer m.Unlock()
+
+	grants := make([]GroupRealmGrant, 0)
+	for _, grant := range m.groupGrants {
+		if match(&grant) {
+			grants = append(grants, grant)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].GroupId != grants[j].GroupId {
+			return grants[i].GroupId < grants[j].GroupId
+		}
+		return grants[i].RealmId < grants[j].RealmId
+	})
+	return grants
+}
+
+func (m *MemoryStore) GetGroupRealmGrantsByGroupId(groupId int64) ([]GroupRealmGrant, error) {
+	return m.filterGroupRealmGrants(func(g *GroupRealmGrant) bool { return g.GroupId == groupId }), nil
+}
+
+func (m *MemoryStore) GetGroupRealmGrantsByRealmId(realmId int64) ([]GroupRealmGrant, error) {
+	return m.filterGroupRealmGrants(func(g *GroupRealmGrant) bool { return g.RealmId == realmId }), nil
+}
+
+func (m *MemoryStore) DeleteGroupRealmGrant(g *GroupRealmGrant) error {
+	m.Lock()
+	defer m.Unlock()
+
+	key := groupRealmGrantKey{g.GroupId, g.RealmId}
+	delete(m.groupGrants, key)
+	delete(m.groupGrantRoles, key)
+	return nil
+}
+
+func (m *MemoryStore) CreateRealmOwner(realmId, userId int64) (*RealmOwner, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := realmOwnerKey{realmId, userId}
+	if _, exists := m.owners[key]; exists {
+		return nil, ErrMemoryStoreConflict
+	}
+
+	owner := RealmOwner{
+		RealmId: realmId,
+		UserId:  userId,
+	}
+	m.owners[key] = owner
+	return &owner, nil
+}
+
+func (m *MemoryStore) GetRealmOwner(realmId, userId int64) (*RealmOwner, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	owner, ok := m.owners[realmOwnerKey{realmId, userId}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &owner, nil
+}
+
+func (m *MemoryStore) GetRealmOwnersByRealmId(realmId int64) ([]RealmOwner, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	owners := make([]RealmOwner, 0)
+	for _, owner := range m.owners {
+		if owner.RealmId == realmId {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].UserId < owners[j].UserId })
+	return owners, nil
+}
+
+func (m *MemoryStore) DeleteRealmOwner(ro *RealmOwner) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.owners, realmOwnerKey{ro.RealmId, ro.UserId})
+	return nil
+}
+
+func (m *MemoryStore) CreateAccessRequest(userId, realmId int64, reason string) (*AccessRequest, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	request := AccessRequest{
+		Id:        m.nextId(),
+		UserId:    userId,
+		RealmId:   realmId,
+		Reason:    reason,
+		Status:    ACCESS_REQUEST_PENDING,
+		CreatedAt: time.Now().Unix(),
+	}
+	m.accessRequests[request.Id] = request
+	return &request, nil
+}
+
+func (m *MemoryStore) GetAccessRequestById(id int64) (*AccessRequest, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	request, ok := m.accessRequests[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &request, nil
+}
+
+// Returns copies of the access requests matching the filter, ordered by id
+func (m *MemoryStore) filterAccessRequests(match func(*AccessRequest) bool) []AccessRequest {
+	m.Lock()
+	defer m.Unlock()
+
+	requests := make([]AccessRequest, 0)
+	for _, request := range m.accessRequests {
+		if match(&request) {
+			requests = append(requests, request)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Id < requests[j].Id })
+	return requests
+}
+
+func (m *MemoryStore) GetPendingAccessRequest(userId, realmId int64) (*AccessRequest, error) {
+	requests := m.filterAccessRequests(func(ar *AccessRequest) bool {
+		return ar.UserId == userId && ar.RealmId == realmId && ar.Status == ACCESS_REQUEST_PENDING
+	})
+	if len(requests) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &requests[0], nil
+}
+
+func (m *MemoryStore) GetAccessRequestsByUserId(userId int64) ([]AccessRequest, error) {
+	requests := m.filterAccessRequests(func(ar *AccessRequest) bool { return ar.UserId == userId })
+
+	// Newest first, like the SQL store
+	for i, j := 0, len(requests)-1; i < j; i, j = i+1, j-1 {
+		requests[i], requests[j] = requests[j], requests[i]
+	}
+	return requests, nil
+}
+
+func (m *MemoryStore) GetPendingAccessRequests() ([]AccessRequest, error) {
+	return m.filterAccessRequests(func(ar *AccessRequest) bool { return ar.Status == ACCESS_REQUEST_PENDING }), nil
+}
+
+func (m *MemoryStore) GetPendingAccessRequestsByOwnerId(ownerId int64) ([]AccessRequest, error) {
+	return m.filterAccessRequests(func(ar *AccessRequest) bool {
+		_, owned := m.owners[realmOwnerKey{ar.RealmId, ownerId}]
+		return owned && ar.Status == ACCESS_REQUEST_PENDING
+	}), nil
+}
+
+func (m *MemoryStore) DecideAccessRequest(ar *AccessRequest, status string, decidedBy int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	stored, ok := m.accessRequests[ar.Id]
+	if !ok {
+		return nil
+	}
+
+	ts := time.Now().Unix()
+	for _, request := range []*AccessRequest{ar, &stored} {
+		request.Status = status
+		request.DecidedBy = &decidedBy
+		request.DecidedAt = &ts
+	}
+	m.accessRequests[ar.Id] = stored
+	return nil
+}
+
+func (m *MemoryStore) DeleteAccessRequest(ar *AccessRequest) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.accessRequests, ar.Id)
+	return nil
+}
+
+func (m *MemoryStore) CreateSession(userId int64, lifetime time.Duration, ip, userAgent string) (*Session, string, error) {
+	session, token, err := newSession(userId, lifetime, ip, userAgent)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	session.Id = m.nextId()
+	m.sessions[session.Id] = *session
+	return session, token, nil
+}
+
+// Returns copies of the sessions matching the filter, most recently seen first
+func (m *MemoryStore) filterSessions(match func(*Session) bool) []Session {
+	m.Lock()
+	defer m.Unlock()
+
+	sessions := make([]Session, 0)
+	for _, session := range m.sessions {
+		if match(&session) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].LastSeenAt != sessions[j].LastSeenAt {
+			return sessions[i].LastSeenAt > sessions[j].LastSeenAt
+		}
+		return sessions[i].Id > sessions[j].Id
+	})
+	return sessions
+}
+
+func (m *MemoryStore) GetSessionByToken(token string) (*Session, error) {
+	tokenHash := hashSessionToken(token)
+	now := time.Now().Unix()
+
+	sessions := m.filterSessions(func(s *Session) bool { return s.TokenHash == tokenHash && s.ExpiresAt > now })
+	if len(sessions) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &sessions[0], nil
+}
+
+func (m *MemoryStore) GetSessionById(id int64) (*Session, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &session, nil
+}
+
+func (m *MemoryStore) GetSessionsByUserId(id int64) ([]Session, error) {
+	now := time.Now().Unix()
+	return m.filterSessions(func(s *Session) bool { return s.UserId == id && s.ExpiresAt > now }), nil
+}
+
+func (m *MemoryStore) GetSessions() ([]Session, error) {
+	now := time.Now().Unix()
+	return m.filterSessions(func(s *Session) bool { return s.ExpiresAt > now }), nil
+}
+
+func (m *MemoryStore) TouchSession(session *Session, ip string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	stored, ok := m.sessions[session.Id]
+	if !ok {
+		return nil
+	}
+
+	ts := time.Now().Unix()
+	for _, s := range []*Session{session, &stored} {
+		s.LastSeenAt = ts
+		s.IP = ip
+	}
+	m.sessions[session.Id] = stored
+	return nil
+}
+
+func (m *MemoryStore) DeleteSession(session *Session) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.sessions, session.Id)
+	return nil
+}
+
+func (m *MemoryStore) DeleteSessionsByUserId(id int64, exceptId int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for sessionId, session := range m.sessions {
+		if session.UserId == id && sessionId != exceptId {
+			delete(m.sessions, sessionId)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpiredSessions() error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now().Unix()
+	for sessionId, session := range m.sessions {
+		if session.ExpiresAt <= now {
+			delete(m.sessions, sessionId)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateSecondFactorLogin(userId int64, lifetime time.Duration) (*SecondFactorLogin, error) {
+	login, err := newSecondFactorLogin(userId, lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.secondFactorLogins[login.Id] = *login
+	return login, nil
+}
+
+func (m *MemoryStore) GetSecondFactorLogin(id string) (*SecondFactorLogin, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	login, ok := m.secondFactorLogins[id]
+	if !ok || login.ExpiresAt <= time.Now().Unix() {
+		return nil, sql.ErrNoRows
+	}
+	return &login, nil
+}
+
+func (m *MemoryStore) AddSecondFactorLoginFailure(login *SecondFactorLogin) error {
+	m.Lock()
+	defer m.Unlock()
+
+	stored, ok := m.secondFactorLogins[login.Id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	stored.Failures++
+	m.secondFactorLogins[login.Id] = stored
+	login.Failures = stored.Failures
+	return nil
+}
+
+func (m *MemoryStore) DeleteSecondFactorLogin(login *SecondFactorLogin) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.secondFactorLogins, login.Id)
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpiredSecondFactorLogins() error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now().Unix()
+	for id, login := range m.secondFactorLogins {
+		if login.ExpiresAt <= now {
+			delete(m.secondFactorLogins, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateRadiusChallenge(c *RadiusChallenge) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, exists := m.radiusChallenges[c.State]; exists {
+		return ErrMemoryStoreConflict
+	}
+
+	m.radiusChallenges[c.State] = *c
+	return nil
+}
+
+func (m *MemoryStore) TakeRadiusChallenge(state string) (*RadiusChallenge, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	challenge, ok := m.radiusChallenges[state]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	delete(m.radiusChallenges, state)
+	if challenge.ExpiresAt <= time.Now().Unix() {
+		return nil, sql.ErrNoRows
+	}
+	return &challenge, nil
+}
+
+func (m *MemoryStore) DeleteExpiredRadiusChallenges() error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now().Unix()
+	for state, challenge := range m.radiusChallenges {
+		if challenge.ExpiresAt <= now {
+			delete(m.radiusChallenges, state)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateUserTOTP(userId int64, secret string) (*UserTOTP, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	userTOTP := UserTOTP{
+		UserId:    userId,
+		Secret:    secret,
+		Confirmed: false,
+		CreatedAt: time.Now().Unix(),
+	}
+	m.totp[userId] = userTOTP
+	return &userTOTP, nil
+}
+
+func (m *MemoryStore) GetUserTOTPByUserId(id int64) (*UserTOTP, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	userTOTP, ok := m.totp[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &userTOTP, nil
+}
+
+func (m *MemoryStore) ConfirmUserTOTP(t *UserTOTP) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if stored, ok := m.totp[t.UserId]; ok {
+		stored.Confirmed = true
+		m.totp[t.UserId] = stored
+		t.Confirmed = true
+	}
+	return nil
+}
+
+func (m *MemoryStore) UseUserTOTPCounter(t *UserTOTP, counter int64) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	stored, ok := m.totp[t.UserId]
+	if !ok || stored.LastCounter >= counter {
+		return false, nil
+	}
+
+	stored.LastCounter = counter
+	m.totp[t.UserId] = stored
+	t.LastCounter = counter
+	return true, nil
+}
+
+func (m *MemoryStore) DeleteUserTOTP(t *UserTOTP) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.totp, t.UserId)
+	return nil
+}
+
+func (m *MemoryStore) CreateUserWebAuthnCredential(userId int64, name string, credentialId, publicKey []byte, attestationType string, aaguid []byte, signCount uint32) (*UserWebAuthnCredential, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	credential := UserWebAuthnCredential{
+		Id:              m.nextId(),
+		UserId:          userId,
+		Name:            name,
+		CredentialId:    credentialId,
+		PublicKey:       publicKey,
+		AttestationType: attestationType,
+		AAGUID:          aaguid,
+		SignCount:       signCount,
+		CreatedAt:       time.Now().Unix(),
+	}
+	m.webAuthnCredentials[credential.Id] = credential
+	return &credential, nil
+}
+
+func (m *MemoryStore) GetUserWebAuthnCredentialById(id int64) (*UserWebAuthnCredential, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	credential, ok := m.webAuthnCredentials[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &credential, nil
+}
+
+func (m *MemoryStore) GetUserWebAuthnCredentialsByUserId(id int64) ([]UserWebAuthnCredential, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	credentials := make([]UserWebAuthnCredential, 0)
+	for _, credential := range m.webAuthnCredentials {
+		if credential.UserId == id {
+			credentials = append(credentials, credential)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool { return credentials[i].Id < credentials[j].Id })
+	return credentials, nil
+}
+
+func (m *MemoryStore) UpdateUserWebAuthnCredentialSignCount(c *UserWebAuthnCredential, signCount uint32) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if stored, ok := m.webAuthnCredentials[c.Id]; ok {
+		stored.SignCount = signCount
+		m.webAuthnCredentials[c.Id] = stored
+		c.SignCount = signCount
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteUserWebAuthnCredential(c *UserWebAuthnCredential) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.webAuthnCredentials, c.Id)
+	return nil
+}
+
+func (m *MemoryStore) CreateUserIdentity(userId int64, provider, subject string) (*UserIdentity, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := userIdentityKey{provider, subject}
+	if _, exists := m.identities[key]; exists {
+		return nil, ErrMemoryStoreConflict
+	}
+
+	identity := UserIdentity{
+		Provider:  provider,
+		Subject:   subject,
+		UserId:    userId,
+		CreatedAt: time.Now().Unix(),
+	}
+	m.identities[key] = identity
+	return &identity, nil
+}
+
+func (m *MemoryStore) GetUserIdentity(provider, subject string) (*UserIdentity, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	identity, ok := m.identities[userIdentityKey{provider, subject}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &identity, nil
+}
+
+func (m *MemoryStore) GetUserIdentitiesByUserId(id int64) ([]UserIdentity, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	identities := make([]UserIdentity, 0)
+	for _, identity := range m.identities {
+		if identity.UserId == id {
+			identities = append(identities, identity)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		if identities[i].Provider != identities[j].Provider {
+			return identities[i].Provider < identities[j].Provider
+		}
+		return identities[i].Subject < identities[j].Subject
+	})
+	return identities, nil
+}
+
+func (m *MemoryStore) DeleteUserIdentity(ui *UserIdentity) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.identities, userIdentityKey{ui.Provider, ui.Subject})
+	return nil
+}
+
+func (m *MemoryStore) CreateOIDCClient(id, name, secret string, realmId int64, redirectURIs []string) (*OIDCClient, error) {
+	client, err := newOIDCClient(id, name, secret, realmId, redirectURIs)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, exists := m.oidcClients[id]; exists {
+		return nil, ErrMemoryStoreConflict
+	}
+
+	m.oidcClients[id] = *client
+	return client, nil
+}
+
+func (m *MemoryStore) GetOIDCClientById(id string) (*OIDCClient, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	client, ok := m.oidcClients[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &client, nil
+}
+
+func (m *MemoryStore) GetOIDCClients() ([]OIDCClient, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	clients := make([]OIDCClient, 0, len(m.oidcClients))
+	for _, client := range m.oidcClients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Id < clients[j].Id })
+	return clients, nil
+}
+
+func (m *MemoryStore) DeleteOIDCClient(c *OIDCClient) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.oidcClients, c.Id)
+	return nil
+}
+
+func (m *MemoryStore) CreateOIDCAuthorization(a *OIDCAuthorization) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, exists := m.oidcAuthorizations[a.Code]; exists {
+		return ErrMemoryStoreConflict
+	}
+
+	m.oidcAuthorizations[a.Code] = *a
+	return nil
+}
+
+func (m *MemoryStore) TakeOIDCAuthorization(code string) (*OIDCAuthorization, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	authorization, ok := m.oidcAuthorizations[code]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	delete(m.oidcAuthorizations, code)
+	if authorization.ExpiresAt <= time.Now().Unix() {
+		return nil, sql.ErrNoRows
+	}
+	return &authorization, nil
+}
+
+func (m *MemoryStore) DeleteExpiredOIDCAuthorizations() error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now().Unix()
+	for code, authorization := range m.oidcAuthorizations {
+		if authorization.ExpiresAt <= now {
+			delete(m.oidcAuthorizations, code)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateAuditLogEntry(action string, user *User, data map[string]interface{}) (*AuditLogEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	entry := AuditLogEntry{
+		Id:        m.nextId(),
+		Action:    action,
+		UserId:    user.Id,
+		CreatedAt: time.Now().Unix(),
+		Data:      data,
+	}
+	m.auditLog = append(m.auditLog, entry)
+	return &entry, nil
+}
+
+func (m *MemoryStore) GetRecentAuditLogEntries(limit int) ([]AuditLogEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	entries := make([]AuditLogEntry, 0, limit)
+	for i := len(m.auditLog) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, m.auditLog[i])
+	}
+	return entries, nil
+}
@@ -0,0 +1,481 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const SCHEMA_MIGRATION_SCHEMA = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT,
+	applied_at INTEGER
+);
+`
+
+// A single step in the evolution of the schema. Migrations are applied in
+// order and never change once released, new changes always get a new version.
+//
+// Databases from before migrations were tracked have no schema_migrations
+// table and run every migration, so each one must be safe to apply on top of
+// tables which already have its changes.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *transaction) error
+}
+
+// Records a migration which has been applied to the database
+type SchemaMigration struct {
+	Version   int    `json:"version" db:"version"`
+	Name      string `json:"name" db:"name"`
+	AppliedAt int64  `json:"applied_at" db:"applied_at"`
+}
+
+var migrations = []migration{
+	{1, "create_users_tokens_realms", execStatements(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY,
+			username TEXT,
+			password TEXT,
+			flags INTEGER,
+			discord_id INTEGER
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS user_tokens (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER,
+			name TEXT,
+			token TEXT,
+			flags INTEGER
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS realms (
+			id INTEGER PRIMARY KEY,
+			name TEXT
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS user_realm_grants (
+			user_id INTEGER,
+			realm_id INTEGER,
+			alias TEXT,
+
+			PRIMARY KEY (user_id, realm_id)
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS audit_log_entries (
+			id INTEGER PRIMARY KEY,
+			action TEXT,
+			user_id INTEGER,
+			created_at INTEGER,
+			data TEXT
+		);
+	`)},
+	{2, "create_user_totp", execStatements(`
+		CREATE TABLE IF NOT EXISTS user_totp (
+			user_id INTEGER PRIMARY KEY,
+			secret TEXT,
+			confirmed INTEGER,
+			created_at INTEGER
+		);
+	`)},
+	{3, "create_user_webauthn_credentials", execStatements(`
+		CREATE TABLE IF NOT EXISTS user_webauthn_credentials (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER,
+			name TEXT,
+			credential_id BLOB,
+			public_key BLOB,
+			attestation_type TEXT,
+			aaguid BLOB,
+			sign_count INTEGER,
+			created_at INTEGER
+		);
+	`)},
+	{4, "create_user_identities", execStatements(`
+		CREATE TABLE IF NOT EXISTS user_identities (
+			provider TEXT,
+			subject TEXT,
+			user_id INTEGER,
+			created_at INTEGER,
+
+			PRIMARY KEY (provider, subject)
+		);
+	`)},
+	{5, "create_oidc_clients", execStatements(`
+		CREATE TABLE IF NOT EXISTS oidc_clients (
+			id TEXT PRIMARY KEY,
+			name TEXT,
+			secret_hash TEXT,
+			realm_id INTEGER,
+			redirect_uris TEXT,
+			created_at INTEGER
+		);
+	`)},
+	{6, "create_sessions", execStatements(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER,
+			token_hash TEXT UNIQUE,
+			created_at INTEGER,
+			last_seen_at INTEGER,
+			expires_at INTEGER,
+			ip TEXT,
+			user_agent TEXT
+		);
+	`)},
+	{7, "create_groups", execStatements(`
+		CREATE TABLE IF NOT EXISTS groups (
+			id INTEGER PRIMARY KEY,
+			name TEXT
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS group_members (
+			group_id INTEGER,
+			user_id INTEGER,
+
+			PRIMARY KEY (group_id, user_id)
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS group_realm_grants (
+			group_id INTEGER,
+			realm_id INTEGER,
+
+			PRIMARY KEY (group_id, realm_id)
+		);
+	`)},
+	{8, "create_realm_roles", execStatements(`
+		CREATE TABLE IF NOT EXISTS realm_roles (
+			id INTEGER PRIMARY KEY,
+			realm_id INTEGER,
+			name TEXT,
+			level INTEGER,
+
+			UNIQUE (realm_id, name)
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS user_realm_grant_roles (
+			user_id INTEGER,
+			realm_id INTEGER,
+			role_id INTEGER,
+
+			PRIMARY KEY (user_id, realm_id, role_id)
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS group_realm_grant_roles (
+			group_id INTEGER,
+			realm_id INTEGER,
+			role_id INTEGER,
+
+			PRIMARY KEY (group_id, realm_id, role_id)
+		);
+	`)},
+	{9, "add_user_realm_grant_validity", addColumns("user_realm_grants",
+		"not_before INTEGER",
+		"expires_at INTEGER",
+	)},
+	{10, "create_access_requests", execStatements(`
+		CREATE TABLE IF NOT EXISTS realm_owners (
+			realm_id INTEGER,
+			user_id INTEGER,
+
+			PRIMARY KEY (realm_id, user_id)
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS access_requests (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER,
+			realm_id INTEGER,
+			reason TEXT,
+			status TEXT,
+			created_at INTEGER,
+			decided_by INTEGER,
+			decided_at INTEGER
+		);
+	`)},
+	{11, "create_user_token_restrictions", execStatements(`
+		CREATE TABLE IF NOT EXISTS user_token_realms (
+			token_id INTEGER,
+			realm TEXT,
+
+			PRIMARY KEY (token_id, realm)
+		);
+	`, `
+		CREATE TABLE IF NOT EXISTS user_token_scopes (
+			token_id INTEGER,
+			scope TEXT,
+
+			PRIMARY KEY (token_id, scope)
+		);
+	`)},
+	{12, "add_user_token_timestamps", addColumns("user_tokens",
+		"created_at INTEGER",
+		"expires_at INTEGER",
+		"last_used_at INTEGER",
+		"last_used_ip TEXT",
+	)},
+	{13, "hash_user_tokens", hashUserTokens},
+	{14, "add_user_totp_last_counter", addColumns("user_totp",
+		"last_counter INTEGER NOT NULL DEFAULT 0",
+	)},
+	{15, "add_realm_parents", addColumns("realms",
+		"parent_id INTEGER",
+	)},
+	{16, "add_user_realm_grant_ldap_group", addColumns("user_realm_grants",
+		"ldap_group TEXT",
+	)},
+	{17, "create_second_factor_logins", execStatements(`
+		CREATE TABLE IF NOT EXISTS second_factor_logins (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER,
+			failures INTEGER,
+			expires_at INTEGER
+		);
+	`)},
+	{18, "create_oidc_authorizations", execStatements(`
+		CREATE TABLE IF NOT EXISTS oidc_authorizations (
+			code TEXT PRIMARY KEY,
+			client_id TEXT,
+			user_id INTEGER,
+			redirect_uri TEXT,
+			scope TEXT,
+			nonce TEXT,
+			code_challenge TEXT,
+			code_challenge_method TEXT,
+			auth_time INTEGER,
+			expires_at INTEGER
+		);
+	`)},
+	{19, "create_radius_challenges", execStatements(`
+		CREATE TABLE IF NOT EXISTS radius_challenges (
+			state TEXT PRIMARY KEY,
+			user_id INTEGER,
+			backend TEXT,
+			expires_at INTEGER
+		);
+	`)},
+	{20, "store_user_token_realm_ids", storeUserTokenRealmIds},
+}
+
+// Returns a migration which executes each of the statements in turn
+func execStatements(statements ...string) func(tx *transaction) error {
+	return func(tx *transaction) error {
+		for _, statement := range statements {
+			_, err := tx.Exec(translateSchema(tx, statement))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Returns a migration which adds each column (e.g. "expires_at INTEGER") to the
+// table, skipping any it already has.
+func addColumns(table string, columns ...string) func(tx *transaction) error {
+	return func(tx *transaction) error {
+		for _, column := range columns {
+			var name, definition string
+			fmt.Sscan(column, &name, &definition)
+
+			exists, err := hasColumn(tx, table, name)
+			if err != nil {
+				return err
+			} else if exists {
+				continue
+			}
+
+			_, err = tx.Exec(translateSchema(tx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s`, table, column)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Schemas are written for SQLite, this adjusts them for Postgres which needs
+// explicit auto-incrementing ids, 64-bit integers and has no BLOB type.
+func translateSchema(tx *transaction, statement string) string {
+	if !tx.IsPostgres() {
+		return statement
+	}
+
+	statement = serialIdPattern.ReplaceAllString(statement, "${1}id BIGSERIAL PRIMARY KEY")
+	return strings.NewReplacer("INTEGER", "BIGINT", "BLOB", "BYTEA").Replace(statement)
+}
+
+var serialIdPattern = regexp.MustCompile(`(?m)^(\s*)id INTEGER PRIMARY KEY`)
+
+func hasColumn(tx *transaction, table, column string) (bool, error) {
+	var count int
+	var err error
+	if tx.IsPostgres() {
+		err = tx.Get(
+			&count,
+			`SELECT COUNT(*) FROM information_schema.columns WHERE table_schema=current_schema() AND table_name=? AND column_name=?`,
+			table,
+			column,
+		)
+	} else {
+		err = tx.Get(&count, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?`, table, column)
+	}
+	return count > 0, err
+}
+
+// Token realm restrictions used to be stored by name, which left them applying
+// to whichever realm next took the name of a renamed or deleted one. Tokens
+// whose realms are all gone could only be left unrestricted, so are deleted.
+func storeUserTokenRealmIds(tx *transaction) error {
+	migrated, err := hasColumn(tx, "user_token_realms", "realm_id")
+	if err != nil || migrated {
+		return err
+	}
+
+	return execStatements(`
+		CREATE TABLE user_token_realm_ids (
+			token_id INTEGER,
+			realm_id INTEGER,
+
+			PRIMARY KEY (token_id, realm_id)
+		);
+	`, `
+		INSERT INTO user_token_realm_ids (token_id, realm_id)
+		SELECT DISTINCT user_token_realms.token_id, realms.id FROM user_token_realms
+		JOIN realms ON realms.name = user_token_realms.realm;
+	`, `
+		DELETE FROM user_token_scopes WHERE token_id IN (SELECT token_id FROM user_token_realms)
+		AND token_id NOT IN (SELECT token_id FROM user_token_realm_ids);
+	`, `
+		DELETE FROM user_tokens WHERE id IN (SELECT token_id FROM user_token_realms)
+		AND id NOT IN (SELECT token_id FROM user_token_realm_ids);
+	`, `
+		DROP TABLE user_token_realms;
+	`, `
+		ALTER TABLE user_token_realm_ids RENAME TO user_token_realms;
+	`)(tx)
+}
+
+// Tokens used to be stored in plaintext, this moves them over to a hash and a
+// short prefix which is kept to help identify them.
+func hashUserTokens(tx *transaction) error {
+	err := addColumns("user_tokens", "token_hash TEXT", "token_prefix TEXT")(tx)
+	if err != nil {
+		return err
+	}
+
+	hasPlaintext, err := hasColumn(tx, "user_tokens", "token")
+	if err != nil {
+		return err
+	}
+
+	if hasPlaintext {
+		var tokens []struct {
+			Id    int64  `db:"id"`
+			Token string `db:"token"`
+		}
+		err = tx.Select(&tokens, `SELECT id, token FROM user_tokens WHERE token IS NOT NULL AND token != ''`)
+		if err != nil {
+			return err
+		}
+
+		for _, token := range tokens {
+			prefix := token.Token
+			if len(prefix) > userTokenPrefixLength {
+				prefix = prefix[:userTokenPrefixLength]
+			}
+
+			_, err = tx.Exec(
+				`UPDATE user_tokens SET token_hash=?, token_prefix=?, token=NULL WHERE id=?`,
+				hashUserToken(token.Token),
+				prefix,
+				token.Id,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS user_tokens_token_hash ON user_tokens (token_hash);`)
+	return err
+}
+
+// Returns the migrations which have been applied to the database
+func (s *SQLStore) GetSchemaMigrations() ([]SchemaMigration, error) {
+	var applied []SchemaMigration
+	err := s.db.Select(&applied, `SELECT * FROM schema_migrations ORDER BY version`)
+	if applied == nil {
+		return make([]SchemaMigration, 0), err
+	}
+	return applied, err
+}
+
+// Applies any migrations the database is missing, returning how many ran
+func (s *SQLStore) Migrate() (int, error) {
+	count := 0
+	for _, m := range migrations {
+		applied, err := s.applyMigration(m)
+		if err != nil {
+			return count, fmt.Errorf("migration %v (%v) failed: %v", m.Version, m.Name, err)
+		} else if applied {
+			log.Printf("Applied migration %v (%v)", m.Version, m.Name)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Applies the migration unless it already has been. On Postgres several
+// replicas may start at once, so they take turns holding a lock.
+func (s *SQLStore) applyMigration(m migration) (bool, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if tx.IsPostgres() {
+		_, err = tx.Exec(`SELECT pg_advisory_xact_lock(?)`, migrationLockId)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec(translateSchema(tx, SCHEMA_MIGRATION_SCHEMA))
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	err = tx.Get(&count, `SELECT COUNT(*) FROM schema_migrations WHERE version=?`, m.Version)
+	if err != nil {
+		return false, err
+	} else if count > 0 {
+		return false, nil
+	}
+
+	err = m.Up(tx)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?);`,
+		m.Version,
+		m.Name,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Arbitrary key for the Postgres advisory lock held while migrating
+const migrationLockId = 0x68657261
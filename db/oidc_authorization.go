@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// An authorization code issued to an OpenID Connect client, waiting to be
+// exchanged for tokens.
+type OIDCAuthorization struct {
+	Code                string `json:"-" db:"code"`
+	ClientId            string `json:"client_id" db:"client_id"`
+	UserId              int64  `json:"user_id" db:"user_id"`
+	RedirectURI         string `json:"redirect_uri" db:"redirect_uri"`
+	Scope               string `json:"scope" db:"scope"`
+	Nonce               string `json:"nonce" db:"nonce"`
+	CodeChallenge       string `json:"code_challenge" db:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method" db:"code_challenge_method"`
+
+	// When the user logged in, as a unix timestamp
+	AuthTime  int64 `json:"auth_time" db:"auth_time"`
+	ExpiresAt int64 `json:"expires_at" db:"expires_at"`
+}
+
+func (s *SQLStore) CreateOIDCAuthorization(a *OIDCAuthorization) error {
+	_, err := s.db.Exec(`
+		INSERT INTO oidc_authorizations (
+			code, client_id, user_id, redirect_uri, scope, nonce, code_challenge, code_challenge_method, auth_time, expires_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`,
+		a.Code,
+		a.ClientId,
+		a.UserId,
+		a.RedirectURI,
+		a.Scope,
+		a.Nonce,
+		a.CodeChallenge,
+		a.CodeChallengeMethod,
+		a.AuthTime,
+		a.ExpiresAt,
+	)
+	return err
+}
+
+// Deletes and returns the unexpired authorization for the code. Each code can
+// only be taken once, even by concurrent callers.
+func (s *SQLStore) TakeOIDCAuthorization(code string) (*OIDCAuthorization, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var authorization OIDCAuthorization
+	err = tx.Get(&authorization, `SELECT * FROM oidc_authorizations WHERE code=?`, code)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM oidc_authorizations WHERE code=?`, code)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	if deleted == 0 || authorization.ExpiresAt <= time.Now().Unix() {
+		return nil, sql.ErrNoRows
+	}
+	return &authorization, nil
+}
+
+func (s *SQLStore) DeleteExpiredOIDCAuthorizations() error {
+	_, err := s.db.Exec(`DELETE FROM oidc_authorizations WHERE expires_at <= ?`, time.Now().Unix())
+	return err
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// An application which authenticates users via Heracles using OpenID Connect.
+// Users may only log in to a client if they hold a grant for its realm.
+type OIDCClient struct {
+	Id              string `json:"id" db:"id"`
+	Name            string `json:"name" db:"name"`
+	SecretHash      string `json:"-" db:"secret_hash"`
+	RealmId         int64  `json:"realm_id" db:"realm_id"`
+	RawRedirectURIs string `json:"-" db:"redirect_uris"`
+	CreatedAt       int64  `json:"created_at" db:"created_at"`
+
+	RedirectURIs []string `json:"redirect_uris" db:"-"`
+}
+
+func hashOIDCClientSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// Public clients (e.g. single page apps) have no secret and must use PKCE
+func (c *OIDCClient) IsPublic() bool {
+	return c.SecretHash == ""
+}
+
+func (c *OIDCClient) CheckSecret(secret string) bool {
+	if c.IsPublic() {
+		return false
+	}
+
+	hash := hashOIDCClientSecret(secret)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(c.SecretHash)) == 1
+}
+
+func (c *OIDCClient) HasRedirectURI(redirectURI string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SQLStore) DeleteOIDCClient(c *OIDCClient) error {
+	_, err := s.db.Exec(`DELETE FROM oidc_clients WHERE id=?`, c.Id)
+	return err
+}
+
+func (c *OIDCClient) decode() error {
+	return json.Unmarshal([]byte(c.RawRedirectURIs), &c.RedirectURIs)
+}
+
+// Builds a client, an empty secret builds a public client
+func newOIDCClient(id, name, secret string, realmId int64, redirectURIs []string) (*OIDCClient, error) {
+	redirectURIsEncoded, err := json.Marshal(redirectURIs)
+	if err != nil {
+		return nil, err
+	}
+
+	var secretHash string
+	if secret != "" {
+		secretHash = hashOIDCClientSecret(secret)
+	}
+
+	return &OIDCClient{
+		Id:              id,
+		Name:            name,
+		SecretHash:      secretHash,
+		RealmId:         realmId,
+		RawRedirectURIs: string(redirectURIsEncoded),
+		CreatedAt:       time.Now().Unix(),
+		RedirectURIs:    redirectURIs,
+	}, nil
+}
+
+// Creates a new client, an empty secret creates a public client
+func (s *SQLStore) CreateOIDCClient(id, name, secret string, realmId int64, redirectURIs []string) (*OIDCClient, error) {
+	client, err := newOIDCClient(id, name, secret, realmId, redirectURIs)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO oidc_clients (id, name, secret_hash, realm_id, redirect_uris, created_at) VALUES (?, ?, ?, ?, ?, ?);`,
+		client.Id,
+		client.Name,
+		client.SecretHash,
+		client.RealmId,
+		client.RawRedirectURIs,
+		client.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (s *SQLStore) GetOIDCClientById(id string) (*OIDCClient, error) {
+	var client OIDCClient
+	err := s.db.Get(&client, `SELECT * FROM oidc_clients WHERE id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+func (s *SQLStore) GetOIDCClients() ([]OIDCClient, error) {
+	var clients []OIDCClient
+	err := s.db.Select(&clients, `SELECT * FROM oidc_clients`)
+	if clients == nil {
+		return make([]OIDCClient, 0), err
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i := range clients {
+		err = clients[i].decode()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return clients, nil
+}
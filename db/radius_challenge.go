@@ -0,0 +1,67 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// An Access-Challenge sent to a RADIUS client for a user who has given their
+// password, waiting on their second factor.
+type RadiusChallenge struct {
+	State     string `json:"-" db:"state"`
+	UserId    int64  `json:"user_id" db:"user_id"`
+	Backend   string `json:"backend" db:"backend"`
+	ExpiresAt int64  `json:"expires_at" db:"expires_at"`
+}
+
+func (s *SQLStore) CreateRadiusChallenge(c *RadiusChallenge) error {
+	_, err := s.db.Exec(
+		`INSERT INTO radius_challenges (state, user_id, backend, expires_at) VALUES (?, ?, ?, ?);`,
+		c.State,
+		c.UserId,
+		c.Backend,
+		c.ExpiresAt,
+	)
+	return err
+}
+
+// Deletes and returns the unexpired challenge for the state. Each challenge
+// can only be answered once, even by concurrent callers.
+func (s *SQLStore) TakeRadiusChallenge(state string) (*RadiusChallenge, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var challenge RadiusChallenge
+	err = tx.Get(&challenge, `SELECT * FROM radius_challenges WHERE state=?`, state)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM radius_challenges WHERE state=?`, state)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	if deleted == 0 || challenge.ExpiresAt <= time.Now().Unix() {
+		return nil, sql.ErrNoRows
+	}
+	return &challenge, nil
+}
+
+func (s *SQLStore) DeleteExpiredRadiusChallenges() error {
+	_, err := s.db.Exec(`DELETE FROM radius_challenges WHERE expires_at <= ?`, time.Now().Unix())
+	return err
+}
@@ -1,37 +1,102 @@
 package db
 
-const REALM_SCHEMA = `
-CREATE TABLE IF NOT EXISTS realms (
-	id INTEGER PRIMARY KEY,
-	name TEXT
-);
-`
+import (
+	"database/sql"
+)
 
 type Realm struct {
 	Id   int64  `json:"id" db:"id"`
 	Name string `json:"name" db:"name"`
+
+	// Access to the parent realm implies access to this one
+	ParentId *int64 `json:"parent_id" db:"parent_id"`
 }
 
-func CreateRealm(name string) (*Realm, error) {
-	result, err := db.Exec(`INSERT INTO realms (name) VALUES (?);`, name)
+func (s *SQLStore) UpdateRealmName(r *Realm, name string) error {
+	_, err := s.db.Exec(`UPDATE realms SET name=? WHERE id=?`, name, r.Id)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	id, err := result.LastInsertId()
+	r.Name = name
+	return nil
+}
+
+func (s *SQLStore) UpdateRealmParent(r *Realm, parentId *int64) error {
+	_, err := s.db.Exec(`UPDATE realms SET parent_id=? WHERE id=?`, parentId, r.Id)
+	if err != nil {
+		return err
+	}
+
+	r.ParentId = parentId
+	return nil
+}
+
+// Deletes the realm along with all roles, grants and OpenID Connect clients
+// for it, any child realms are left without a parent. Tokens restricted to
+// other realms as well lose the restriction, those restricted to this realm
+// alone are deleted.
+func (s *SQLStore) DeleteRealm(r *Realm) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tokenIds []int64
+	err = tx.Select(&tokenIds, `
+		SELECT token_id FROM user_token_realms WHERE realm_id=?
+		AND token_id NOT IN (SELECT token_id FROM user_token_realms WHERE realm_id!=?)
+	`, r.Id, r.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, tokenId := range tokenIds {
+		err = deleteUserToken(tx, tokenId)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, query := range []string{
+		`DELETE FROM user_token_realms WHERE realm_id=?`,
+		`DELETE FROM user_realm_grants WHERE realm_id=?`,
+		`DELETE FROM group_realm_grants WHERE realm_id=?`,
+		`DELETE FROM user_realm_grant_roles WHERE realm_id=?`,
+		`DELETE FROM group_realm_grant_roles WHERE realm_id=?`,
+		`DELETE FROM realm_roles WHERE realm_id=?`,
+		`DELETE FROM realm_owners WHERE realm_id=?`,
+		`DELETE FROM access_requests WHERE realm_id=?`,
+		`DELETE FROM oidc_clients WHERE realm_id=?`,
+		`UPDATE realms SET parent_id=NULL WHERE parent_id=?`,
+		`DELETE FROM realms WHERE id=?`,
+	} {
+		_, err = tx.Exec(query, r.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) CreateRealm(name string, parentId *int64) (*Realm, error) {
+	id, err := s.db.Insert(`INSERT INTO realms (name, parent_id) VALUES (?, ?);`, name, parentId)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Realm{
-		Id:   id,
-		Name: name,
+		Id:       id,
+		Name:     name,
+		ParentId: parentId,
 	}, nil
 }
 
-func GetRealmById(id int64) (*Realm, error) {
+func (s *SQLStore) GetRealmById(id int64) (*Realm, error) {
 	var realm Realm
-	err := db.Get(&realm, `SELECT * FROM realms WHERE id=?`, id)
+	err := s.db.Get(&realm, `SELECT * FROM realms WHERE id=?`, id)
 	if err != nil {
 		return nil, err
 	}
@@ -39,11 +104,55 @@ func GetRealmById(id int64) (*Realm, error) {
 	return &realm, nil
 }
 
-func GetRealms() ([]Realm, error) {
+func (s *SQLStore) GetRealmByName(name string) (*Realm, error) {
+	var realm Realm
+	err := s.db.Get(&realm, `SELECT * FROM realms WHERE name=?`, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &realm, nil
+}
+
+func (s *SQLStore) GetRealms() ([]Realm, error) {
 	var realms []Realm
-	err := db.Select(&realms, `SELECT * FROM realms`)
+	err := s.db.Select(&realms, `SELECT * FROM realms`)
 	if realms == nil {
 		return make([]Realm, 0), err
 	}
 	return realms, err
 }
+
+// Returns the named realm followed by each of its parents in turn
+func (s *SQLStore) GetRealmLineage(name string) ([]Realm, error) {
+	return getRealmLineage(s, name)
+}
+
+func getRealmLineage(store Store, name string) ([]Realm, error) {
+	realm, err := store.GetRealmByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	lineage := []Realm{*realm}
+	seen := map[int64]bool{realm.Id: true}
+	for realm.ParentId != nil {
+		realm, err = store.GetRealmById(*realm.ParentId)
+		if err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Cycles are refused when parents are set, this just stops us looping
+		//  forever should one exist anyway.
+		if seen[realm.Id] {
+			break
+		}
+		seen[realm.Id] = true
+
+		lineage = append(lineage, *realm)
+	}
+
+	return lineage, nil
+}
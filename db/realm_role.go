@@ -0,0 +1,195 @@
+package db
+
+import (
+	"time"
+)
+
+// A role defined within a realm. Roles are ordered by their level so upstream
+// applications can require a minimum role (e.g. viewer < editor < admin).
+type RealmRole struct {
+	Id      int64  `json:"id" db:"id"`
+	RealmId int64  `json:"realm_id" db:"realm_id"`
+	Name    string `json:"name" db:"name"`
+	Level   int64  `json:"level" db:"level"`
+}
+
+// Deletes the role, removing it from any grants which carry it
+func (s *SQLStore) DeleteRealmRole(r *RealmRole) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM user_realm_grant_roles WHERE role_id=?`,
+		`DELETE FROM group_realm_grant_roles WHERE role_id=?`,
+		`DELETE FROM realm_roles WHERE id=?`,
+	} {
+		_, err = tx.Exec(query, r.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) CreateRealmRole(realmId int64, name string, level int64) (*RealmRole, error) {
+	id, err := s.db.Insert(
+		`INSERT INTO realm_roles (realm_id, name, level) VALUES (?, ?, ?);`,
+		realmId,
+		name,
+		level,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RealmRole{
+		Id:      id,
+		RealmId: realmId,
+		Name:    name,
+		Level:   level,
+	}, nil
+}
+
+func (s *SQLStore) GetRealmRoleById(id int64) (*RealmRole, error) {
+	var role RealmRole
+	err := s.db.Get(&role, `SELECT * FROM realm_roles WHERE id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (s *SQLStore) GetRealmRoleByName(realmId int64, name string) (*RealmRole, error) {
+	var role RealmRole
+	err := s.db.Get(&role, `SELECT * FROM realm_roles WHERE realm_id=? AND name=?`, realmId, name)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (s *SQLStore) GetRealmRolesByRealmId(realmId int64) ([]RealmRole, error) {
+	var roles []RealmRole
+	err := s.db.Select(&roles, `SELECT * FROM realm_roles WHERE realm_id=? ORDER BY level`, realmId)
+	if roles == nil {
+		return make([]RealmRole, 0), err
+	}
+	return roles, err
+}
+
+// Replaces the roles carried by a users direct grant for a realm
+func (s *SQLStore) SetUserRealmGrantRoles(userId, realmId int64, roleIds []int64) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM user_realm_grant_roles WHERE user_id=? AND realm_id=?`, userId, realmId)
+	if err != nil {
+		return err
+	}
+
+	for _, roleId := range roleIds {
+		_, err = tx.Exec(
+			`INSERT INTO user_realm_grant_roles (user_id, realm_id, role_id) VALUES (?, ?, ?);`,
+			userId,
+			realmId,
+			roleId,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) GetUserRealmGrantRoles(userId, realmId int64) ([]RealmRole, error) {
+	var roles []RealmRole
+	err := s.db.Select(&roles, `
+		SELECT rr.* FROM realm_roles rr
+		JOIN user_realm_grant_roles urgr ON urgr.role_id = rr.id
+		WHERE urgr.user_id = ? AND urgr.realm_id = ?
+		ORDER BY rr.level
+	`, userId, realmId)
+	if roles == nil {
+		return make([]RealmRole, 0), err
+	}
+	return roles, err
+}
+
+// Replaces the roles carried by a groups grant for a realm
+func (s *SQLStore) SetGroupRealmGrantRoles(groupId, realmId int64, roleIds []int64) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM group_realm_grant_roles WHERE group_id=? AND realm_id=?`, groupId, realmId)
+	if err != nil {
+		return err
+	}
+
+	for _, roleId := range roleIds {
+		_, err = tx.Exec(
+			`INSERT INTO group_realm_grant_roles (group_id, realm_id, role_id) VALUES (?, ?, ?);`,
+			groupId,
+			realmId,
+			roleId,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) GetGroupRealmGrantRoles(groupId, realmId int64) ([]RealmRole, error) {
+	var roles []RealmRole
+	err := s.db.Select(&roles, `
+		SELECT rr.* FROM realm_roles rr
+		JOIN group_realm_grant_roles grgr ON grgr.role_id = rr.id
+		WHERE grgr.group_id = ? AND grgr.realm_id = ?
+		ORDER BY rr.level
+	`, groupId, realmId)
+	if roles == nil {
+		return make([]RealmRole, 0), err
+	}
+	return roles, err
+}
+
+// Returns every role the user holds within the realm, through their direct
+// grant (while it is active) as well as any of their groups grants.
+func (s *SQLStore) GetEffectiveUserRealmRoles(userId, realmId int64) ([]RealmRole, error) {
+	now := time.Now().Unix()
+
+	var roles []RealmRole
+	err := s.db.Select(&roles, `
+		SELECT * FROM realm_roles WHERE id IN (
+			SELECT urgr.role_id FROM user_realm_grant_roles urgr
+			JOIN user_realm_grants urg ON urg.user_id = urgr.user_id AND urg.realm_id = urgr.realm_id
+			WHERE urgr.user_id = ? AND urgr.realm_id = ? AND
+				(urg.not_before IS NULL OR urg.not_before <= ?) AND
+				(urg.expires_at IS NULL OR urg.expires_at > ?)
+
+			UNION
+
+			SELECT grgr.role_id FROM group_realm_grant_roles grgr
+			JOIN group_members gm ON gm.group_id = grgr.group_id
+			JOIN group_realm_grants grg ON grg.group_id = grgr.group_id AND grg.realm_id = grgr.realm_id
+			WHERE gm.user_id = ? AND grgr.realm_id = ?
+		)
+		ORDER BY level
+	`, userId, realmId, now, now, userId, realmId)
+	if roles == nil {
+		return make([]RealmRole, 0), err
+	}
+	return roles, err
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+)
+
+// A login which has passed its first factor and is waiting on the second. The
+// id is handed to the client (within its session) to pick the login back up.
+type SecondFactorLogin struct {
+	Id        string `json:"id" db:"id"`
+	UserId    int64  `json:"user_id" db:"user_id"`
+	Failures  int    `json:"failures" db:"failures"`
+	ExpiresAt int64  `json:"expires_at" db:"expires_at"`
+}
+
+func newSecondFactorLogin(userId int64, lifetime time.Duration) (*SecondFactorLogin, error) {
+	idRaw := make([]byte, 32)
+	_, err := rand.Read(idRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecondFactorLogin{
+		Id:        base64.RawURLEncoding.EncodeToString(idRaw),
+		UserId:    userId,
+		ExpiresAt: time.Now().Add(lifetime).Unix(),
+	}, nil
+}
+
+func (s *SQLStore) CreateSecondFactorLogin(userId int64, lifetime time.Duration) (*SecondFactorLogin, error) {
+	login, err := newSecondFactorLogin(userId, lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT INTO second_factor_logins (id, user_id, failures, expires_at) VALUES (?, ?, ?, ?);`,
+		login.Id,
+		login.UserId,
+		login.Failures,
+		login.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return login, nil
+}
+
+// Returns the unexpired login with the given id
+func (s *SQLStore) GetSecondFactorLogin(id string) (*SecondFactorLogin, error) {
+	var login SecondFactorLogin
+	err := s.db.Get(
+		&login,
+		`SELECT * FROM second_factor_logins WHERE id=? AND expires_at > ?`,
+		id,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+// Counts a bad code against the login, updating it with the new total
+func (s *SQLStore) AddSecondFactorLoginFailure(login *SecondFactorLogin) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE second_factor_logins SET failures=failures+1 WHERE id=?`, login.Id)
+	if err != nil {
+		return err
+	}
+
+	var failures int
+	err = tx.Get(&failures, `SELECT failures FROM second_factor_logins WHERE id=?`, login.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	login.Failures = failures
+	return nil
+}
+
+func (s *SQLStore) DeleteSecondFactorLogin(login *SecondFactorLogin) error {
+	_, err := s.db.Exec(`DELETE FROM second_factor_logins WHERE id=?`, login.Id)
+	return err
+}
+
+func (s *SQLStore) DeleteExpiredSecondFactorLogins() error {
+	_, err := s.db.Exec(`DELETE FROM second_factor_logins WHERE expires_at <= ?`, time.Now().Unix())
+	return err
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// A logged in browser (or other client) for a user. Only a hash of the session
+// token is stored, the token itself lives in the clients cookie.
+type Session struct {
+	Id         int64  `json:"id" db:"id"`
+	UserId     int64  `json:"user_id" db:"user_id"`
+	TokenHash  string `json:"-" db:"token_hash"`
+	CreatedAt  int64  `json:"created_at" db:"created_at"`
+	LastSeenAt int64  `json:"last_seen_at" db:"last_seen_at"`
+	ExpiresAt  int64  `json:"expires_at" db:"expires_at"`
+	IP         string `json:"ip" db:"ip"`
+	UserAgent  string `json:"user_agent" db:"user_agent"`
+}
+
+func hashSessionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *SQLStore) DeleteSession(session *Session) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id=?`, session.Id)
+	return err
+}
+
+func (s *SQLStore) TouchSession(session *Session, ip string) error {
+	ts := time.Now().Unix()
+
+	_, err := s.db.Exec(`UPDATE sessions SET last_seen_at=?, ip=? WHERE id=?`, ts, ip, session.Id)
+	if err != nil {
+		return err
+	}
+
+	session.LastSeenAt = ts
+	session.IP = ip
+	return nil
+}
+
+// Builds a session with a newly generated token, which is returned alongside it
+func newSession(userId int64, lifetime time.Duration, ip, userAgent string) (*Session, string, error) {
+	tokenRaw := make([]byte, 32)
+	_, err := rand.Read(tokenRaw)
+	if err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenRaw)
+
+	now := time.Now()
+	return &Session{
+		UserId:     userId,
+		TokenHash:  hashSessionToken(token),
+		CreatedAt:  now.Unix(),
+		LastSeenAt: now.Unix(),
+		ExpiresAt:  now.Add(lifetime).Unix(),
+		IP:         ip,
+		UserAgent:  userAgent,
+	}, token, nil
+}
+
+// Creates a new session, returning it along with the token to hand the client
+func (s *SQLStore) CreateSession(userId int64, lifetime time.Duration, ip, userAgent string) (*Session, string, error) {
+	session, token, err := newSession(userId, lifetime, ip, userAgent)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session.Id, err = s.db.Insert(
+		`INSERT INTO sessions (user_id, token_hash, created_at, last_seen_at, expires_at, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?, ?);`,
+		session.UserId,
+		session.TokenHash,
+		session.CreatedAt,
+		session.LastSeenAt,
+		session.ExpiresAt,
+		session.IP,
+		session.UserAgent,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return session, token, nil
+}
+
+// Returns the unexpired session for the given token
+func (s *SQLStore) GetSessionByToken(token string) (*Session, error) {
+	var session Session
+	err := s.db.Get(
+		&session,
+		`SELECT * FROM sessions WHERE token_hash=? AND expires_at > ?`,
+		hashSessionToken(token),
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *SQLStore) GetSessionById(id int64) (*Session, error) {
+	var session Session
+	err := s.db.Get(&session, `SELECT * FROM sessions WHERE id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *SQLStore) GetSessionsByUserId(id int64) ([]Session, error) {
+	var sessions []Session
+	err := s.db.Select(
+		&sessions,
+		`SELECT * FROM sessions WHERE user_id=? AND expires_at > ? ORDER BY last_seen_at DESC`,
+		id,
+		time.Now().Unix(),
+	)
+	if sessions == nil {
+		return make([]Session, 0), err
+	}
+	return sessions, err
+}
+
+// Returns every unexpired session across all users
+func (s *SQLStore) GetSessions() ([]Session, error) {
+	var sessions []Session
+	err := s.db.Select(
+		&sessions,
+		`SELECT * FROM sessions WHERE expires_at > ? ORDER BY last_seen_at DESC`,
+		time.Now().Unix(),
+	)
+	if sessions == nil {
+		return make([]Session, 0), err
+	}
+	return sessions, err
+}
+
+// Deletes all of a users sessions except for the one given (which may be zero)
+func (s *SQLStore) DeleteSessionsByUserId(id int64, exceptId int64) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE user_id=? AND id != ?`, id, exceptId)
+	return err
+}
+
+func (s *SQLStore) DeleteExpiredSessions() error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, time.Now().Unix())
+	return err
+}
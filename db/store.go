@@ -0,0 +1,157 @@
+package db
+
+import (
+	"time"
+)
+
+// Store holds everything heracles keeps between requests: users and their
+// tokens, sessions, second factors and logins waiting on them, realms and the grants, roles, groups
+// and owners controlling access to them, OpenID Connect clients and the codes
+// issued to them, pending RADIUS challenges and the audit log. Lookups return sql.ErrNoRows when nothing matches, no matter the
+// implementation.
+type Store interface {
+	CreateUser(username, password string, flags Bits, discordId *int64) (*User, error)
+	GetUserById(id int64) (*User, error)
+	GetUserByUsername(username string) (*User, error)
+	GetUserByDiscordId(id int64) (*User, error)
+	GetUsers() ([]User, error)
+	UpdateUsername(user *User, username string) error
+	UpdateUserDiscordId(user *User, discordId *int64) error
+	UpdateUserFlags(user *User, flags Bits) error
+	UpdateUserPassword(user *User, password string) error
+	DeleteUser(user *User) error
+
+	CreateUserToken(userId int64, name string, flags Bits, expiresAt *int64, realms, scopes []string) (*UserToken, error)
+	GetUserTokenById(id int64) (*UserToken, error)
+	GetUserTokenByToken(token string, isAPI bool) (*UserToken, error)
+	GetUserTokensByUserId(id int64) ([]UserToken, error)
+	SearchUserTokens(name, prefix string) ([]UserToken, error)
+	GetUserTokensExpiredBefore(ts int64) ([]UserToken, error)
+	SaveUserToken(token *UserToken) error
+	TouchUserToken(token *UserToken, ip string) error
+	DeleteUserToken(token *UserToken) error
+	DeleteUserTokensByUserId(id int64) error
+
+	CreateRealm(name string, parentId *int64) (*Realm, error)
+	GetRealmById(id int64) (*Realm, error)
+	GetRealmByName(name string) (*Realm, error)
+	GetRealmLineage(name string) ([]Realm, error)
+	GetRealms() ([]Realm, error)
+	UpdateRealmName(realm *Realm, name string) error
+	UpdateRealmParent(realm *Realm, parentId *int64) error
+	DeleteRealm(realm *Realm) error
+
+	CreateUserRealmGrant(userId int64, realmId int64, alias *string, notBefore, expiresAt *int64) (*UserRealmGrant, error)
+	GetUserRealmGrant(userId int64, realmId int64) (*UserRealmGrant, error)
+	GetEffectiveUserRealmGrant(userId int64, realmId int64) (*UserRealmGrant, error)
+	GetUserRealmGrantByRealmName(userId int64, realmName string) (*UserRealmGrant, error)
+	GetUserRealmGrantsByRealmId(realmId int64) ([]UserRealmGrant, error)
+	GetUserRealmGrantsByUserId(userId int64) ([]UserRealmGrant, error)
+	GetExpiredUserRealmGrants() ([]UserRealmGrant, error)
+	UpdateUserRealmGrantAlias(grant *UserRealmGrant, alias *string) error
+	UpdateUserRealmGrantLDAPGroup(grant *UserRealmGrant, group *string) error
+	DeleteUserRealmGrant(grant *UserRealmGrant) error
+
+	CreateRealmRole(realmId int64, name string, level int64) (*RealmRole, error)
+	GetRealmRoleById(id int64) (*RealmRole, error)
+	GetRealmRoleByName(realmId int64, name string) (*RealmRole, error)
+	GetRealmRolesByRealmId(realmId int64) ([]RealmRole, error)
+	DeleteRealmRole(role *RealmRole) error
+	SetUserRealmGrantRoles(userId, realmId int64, roleIds []int64) error
+	GetUserRealmGrantRoles(userId, realmId int64) ([]RealmRole, error)
+	SetGroupRealmGrantRoles(groupId, realmId int64, roleIds []int64) error
+	GetGroupRealmGrantRoles(groupId, realmId int64) ([]RealmRole, error)
+	GetEffectiveUserRealmRoles(userId, realmId int64) ([]RealmRole, error)
+
+	CreateGroup(name string) (*Group, error)
+	GetGroupById(id int64) (*Group, error)
+	GetGroupByName(name string) (*Group, error)
+	GetGroups() ([]Group, error)
+	GetGroupsByUserId(userId int64) ([]Group, error)
+	UpdateGroupName(group *Group, name string) error
+	DeleteGroup(group *Group) error
+	CreateGroupMember(groupId, userId int64) (*GroupMember, error)
+	GetGroupMember(groupId, userId int64) (*GroupMember, error)
+	GetGroupMembersByGroupId(groupId int64) ([]GroupMember, error)
+	DeleteGroupMember(member *GroupMember) error
+	CreateGroupRealmGrant(groupId, realmId int64) (*GroupRealmGrant, error)
+	GetGroupRealmGrant(groupId, realmId int64) (*GroupRealmGrant, error)
+	GetGroupRealmGrantsByGroupId(groupId int64) ([]GroupRealmGrant, error)
+	GetGroupRealmGrantsByRealmId(realmId int64) ([]GroupRealmGrant, error)
+	DeleteGroupRealmGrant(grant *GroupRealmGrant) error
+
+	CreateRealmOwner(realmId, userId int64) (*RealmOwner, error)
+	GetRealmOwner(realmId, userId int64) (*RealmOwner, error)
+	GetRealmOwnersByRealmId(realmId int64) ([]RealmOwner, error)
+	DeleteRealmOwner(owner *RealmOwner) error
+	CreateAccessRequest(userId, realmId int64, reason string) (*AccessRequest, error)
+	GetAccessRequestById(id int64) (*AccessRequest, error)
+	GetPendingAccessRequest(userId, realmId int64) (*AccessRequest, error)
+	GetAccessRequestsByUserId(userId int64) ([]AccessRequest, error)
+	GetPendingAccessRequests() ([]AccessRequest, error)
+	GetPendingAccessRequestsByOwnerId(ownerId int64) ([]AccessRequest, error)
+	DecideAccessRequest(request *AccessRequest, status string, decidedBy int64) error
+	DeleteAccessRequest(request *AccessRequest) error
+
+	CreateSession(userId int64, lifetime time.Duration, ip, userAgent string) (*Session, string, error)
+	GetSessionByToken(token string) (*Session, error)
+	GetSessionById(id int64) (*Session, error)
+	GetSessionsByUserId(id int64) ([]Session, error)
+	GetSessions() ([]Session, error)
+	TouchSession(session *Session, ip string) error
+	DeleteSession(session *Session) error
+	DeleteSessionsByUserId(id int64, exceptId int64) error
+	DeleteExpiredSessions() error
+
+	CreateSecondFactorLogin(userId int64, lifetime time.Duration) (*SecondFactorLogin, error)
+	GetSecondFactorLogin(id string) (*SecondFactorLogin, error)
+	AddSecondFactorLoginFailure(login *SecondFactorLogin) error
+	DeleteSecondFactorLogin(login *SecondFactorLogin) error
+	DeleteExpiredSecondFactorLogins() error
+	CreateRadiusChallenge(challenge *RadiusChallenge) error
+	TakeRadiusChallenge(state string) (*RadiusChallenge, error)
+	DeleteExpiredRadiusChallenges() error
+
+	CreateUserTOTP(userId int64, secret string) (*UserTOTP, error)
+	GetUserTOTPByUserId(id int64) (*UserTOTP, error)
+	ConfirmUserTOTP(userTOTP *UserTOTP) error
+	UseUserTOTPCounter(userTOTP *UserTOTP, counter int64) (bool, error)
+	DeleteUserTOTP(userTOTP *UserTOTP) error
+
+	CreateUserWebAuthnCredential(userId int64, name string, credentialId, publicKey []byte, attestationType string, aaguid []byte, signCount uint32) (*UserWebAuthnCredential, error)
+	GetUserWebAuthnCredentialById(id int64) (*UserWebAuthnCredential, error)
+	GetUserWebAuthnCredentialsByUserId(id int64) ([]UserWebAuthnCredential, error)
+	UpdateUserWebAuthnCredentialSignCount(credential *UserWebAuthnCredential, signCount uint32) error
+	DeleteUserWebAuthnCredential(credential *UserWebAuthnCredential) error
+
+	CreateUserIdentity(userId int64, provider, subject string) (*UserIdentity, error)
+	GetUserIdentity(provider, subject string) (*UserIdentity, error)
+	GetUserIdentitiesByUserId(id int64) ([]UserIdentity, error)
+	DeleteUserIdentity(identity *UserIdentity) error
+
+	CreateOIDCClient(id, name, secret string, realmId int64, redirectURIs []string) (*OIDCClient, error)
+	GetOIDCClientById(id string) (*OIDCClient, error)
+	GetOIDCClients() ([]OIDCClient, error)
+	DeleteOIDCClient(client *OIDCClient) error
+	CreateOIDCAuthorization(authorization *OIDCAuthorization) error
+	TakeOIDCAuthorization(code string) (*OIDCAuthorization, error)
+	DeleteExpiredOIDCAuthorizations() error
+
+	CreateAuditLogEntry(action string, user *User, data map[string]interface{}) (*AuditLogEntry, error)
+	GetRecentAuditLogEntries(limit int) ([]AuditLogEntry, error)
+}
+
+// SQLStore implements Store on top of the connected database. Deleting users
+// and realms also removes the rows other parts of the schema keep for them.
+type SQLStore struct {
+	db *database
+
+	// The bcrypt cost new passwords are hashed with
+	difficulty int
+}
+
+var _ Store = (*SQLStore)(nil)
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
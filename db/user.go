@@ -1,30 +1,27 @@
 package db
 
 import (
-	"strconv"
-
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	USER_FLAG_ADMIN = 1 << iota
-)
 
-const USER_SCHEMA = `
-CREATE TABLE IF NOT EXISTS users (
-	id INTEGER PRIMARY KEY,
-	username TEXT,
-	password TEXT,
-	flags INTEGER,
-	discord_id INTEGER
-);
-`
+	// Whether the user is authenticated against the LDAP directory
+	USER_FLAG_LDAP
+
+	// Disabled users can no longer log in or use their sessions and tokens
+	USER_FLAG_DISABLED
+
+	// Whether the user is authenticated against the htpasswd file
+	USER_FLAG_HTPASSWD
+)
 
 type User struct {
 	Id        int64  `json:"id" db:"id"`
 	Username  string `json:"username" db:"username"`
 	Password  string `json:"-" db:"password"`
-	Flags     Bits   `json:"-" db:"flags"`
+	Flags     Bits   `json:"flags" db:"flags"`
 	DiscordId *int64 `json:"discord_id" db:"discord_id"`
 }
 
@@ -32,26 +29,100 @@ func (u *User) CheckPassword(password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
 }
 
-func (u *User) GetAuthSecret() []byte {
-	return signer.Sign([]byte(strconv.Itoa(int(u.Id))))
-}
-
 func (u *User) IsAdmin() bool {
 	return u.Flags.Has(USER_FLAG_ADMIN)
 }
 
-func (u *User) UpdatePassword(password string) error {
-	var passwordHash string
+func (u *User) IsDisabled() bool {
+	return u.Flags.Has(USER_FLAG_DISABLED)
+}
+
+// Users without a password (e.g. those from LDAP or Discord) store an empty
+// hash, which never matches.
+func hashPassword(password string, difficulty int) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), difficulty)
+	return string(passwordHash), err
+}
+
+func (s *SQLStore) UpdateUsername(u *User, username string) error {
+	_, err := s.db.Exec(`UPDATE users SET username=? WHERE id=?`, username, u.Id)
+	if err != nil {
+		return err
+	}
+
+	u.Username = username
+	return nil
+}
+
+func (s *SQLStore) UpdateUserDiscordId(u *User, discordId *int64) error {
+	_, err := s.db.Exec(`UPDATE users SET discord_id=? WHERE id=?`, discordId, u.Id)
+	if err != nil {
+		return err
+	}
+
+	u.DiscordId = discordId
+	return nil
+}
 
-	if password != "" {
-		passwordHashRaw, err := bcrypt.GenerateFromPassword([]byte(password), difficulty)
+// Deletes the user along with everything that belongs to them. Audit log
+// entries are kept.
+func (s *SQLStore) DeleteUser(u *User) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteUserTokensByUserId(tx, u.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM user_realm_grants WHERE user_id=?`,
+		`DELETE FROM user_realm_grant_roles WHERE user_id=?`,
+		`DELETE FROM user_totp WHERE user_id=?`,
+		`DELETE FROM user_webauthn_credentials WHERE user_id=?`,
+		`DELETE FROM user_identities WHERE user_id=?`,
+		`DELETE FROM sessions WHERE user_id=?`,
+		`DELETE FROM second_factor_logins WHERE user_id=?`,
+		`DELETE FROM oidc_authorizations WHERE user_id=?`,
+		`DELETE FROM radius_challenges WHERE user_id=?`,
+		`DELETE FROM group_members WHERE user_id=?`,
+		`DELETE FROM realm_owners WHERE user_id=?`,
+		`DELETE FROM access_requests WHERE user_id=?`,
+		`DELETE FROM users WHERE id=?`,
+	} {
+		_, err = tx.Exec(query, u.Id)
 		if err != nil {
 			return err
 		}
-		passwordHash = string(passwordHashRaw)
 	}
 
-	_, err := db.Exec(
+	return tx.Commit()
+}
+
+func (s *SQLStore) UpdateUserFlags(u *User, flags Bits) error {
+	_, err := s.db.Exec(`UPDATE users SET flags=? WHERE id=?`, flags, u.Id)
+	if err != nil {
+		return err
+	}
+
+	u.Flags = flags
+	return nil
+}
+
+func (s *SQLStore) UpdateUserPassword(u *User, password string) error {
+	passwordHash, err := hashPassword(password, s.difficulty)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
 		`UPDATE users SET password=? WHERE id=?`,
 		passwordHash,
 		u.Id,
@@ -59,17 +130,13 @@ func (u *User) UpdatePassword(password string) error {
 	return err
 }
 
-func CreateUser(username, password string, flags Bits, discordId *int64) (*User, error) {
-	var passwordHash string
-	if password != "" {
-		passwordHashRaw, err := bcrypt.GenerateFromPassword([]byte(password), difficulty)
-		if err != nil {
-			return nil, err
-		}
-		passwordHash = string(passwordHashRaw)
+func (s *SQLStore) CreateUser(username, password string, flags Bits, discordId *int64) (*User, error) {
+	passwordHash, err := hashPassword(password, s.difficulty)
+	if err != nil {
+		return nil, err
 	}
 
-	result, err := db.Exec(
+	id, err := s.db.Insert(
 		`INSERT INTO users (username, password, flags, discord_id) VALUES (?, ?, ?, ?);`,
 		username,
 		passwordHash,
@@ -80,11 +147,6 @@ func CreateUser(username, password string, flags Bits, discordId *int64) (*User,
 		return nil, err
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
-
 	return &User{
 		Id:        id,
 		Username:  username,
@@ -94,35 +156,10 @@ func CreateUser(username, password string, flags Bits, discordId *int64) (*User,
 	}, nil
 }
 
-func GetUserByAuthSecret(data []byte) (*User, error) {
-	userIdRaw, err := signer.Unsign(data)
-	if err != nil {
-		return nil, err
-	}
-
-	userId, err := strconv.Atoi(string(userIdRaw))
-	if err != nil {
-		return nil, err
-	}
-
-	return GetUserById(int64(userId))
-}
-
-func GetUserById(id int64) (*User, error) {
-	var user User
-
-	err := db.Get(&user, `SELECT * FROM users WHERE id=?`, id)
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
-
-func GetUserByDiscordId(id int64) (*User, error) {
+func (s *SQLStore) GetUserById(id int64) (*User, error) {
 	var user User
 
-	err := db.Get(&user, `SELECT * FROM users WHERE discord_id=?`, id)
+	err := s.db.Get(&user, `SELECT * FROM users WHERE id=?`, id)
 	if err != nil {
 		return nil, err
 	}
@@ -130,24 +167,10 @@ func GetUserByDiscordId(id int64) (*User, error) {
 	return &user, nil
 }
 
-func GetUserByToken(token string, isAPI bool) (*User, error) {
+func (s *SQLStore) GetUserByDiscordId(id int64) (*User, error) {
 	var user User
 
-	var err error
-	if isAPI {
-		err = db.Get(&user, `
-			SELECT u.* FROM users u
-			JOIN user_tokens ut ON u.id = ut.user_id
-			WHERE ut.token = ? AND ut.flags & ?
-		`, token, USER_TOKEN_FLAG_API)
-	} else {
-		err = db.Get(&user, `
-			SELECT u.* FROM users u
-			JOIN user_tokens ut ON u.id = ut.user_id
-			WHERE ut.token = ?
-		`, token)
-	}
-
+	err := s.db.Get(&user, `SELECT * FROM users WHERE discord_id=?`, id)
 	if err != nil {
 		return nil, err
 	}
@@ -155,10 +178,10 @@ func GetUserByToken(token string, isAPI bool) (*User, error) {
 	return &user, nil
 }
 
-func GetUserByUsername(username string) (*User, error) {
+func (s *SQLStore) GetUserByUsername(username string) (*User, error) {
 	var user User
 
-	err := db.Get(&user, `SELECT * FROM users WHERE username=?`, username)
+	err := s.db.Get(&user, `SELECT * FROM users WHERE username=?`, username)
 	if err != nil {
 		return nil, err
 	}
@@ -166,9 +189,9 @@ func GetUserByUsername(username string) (*User, error) {
 	return &user, nil
 }
 
-func GetUsers() ([]User, error) {
+func (s *SQLStore) GetUsers() ([]User, error) {
 	var users []User
-	err := db.Select(&users, `SELECT * FROM users`)
+	err := s.db.Select(&users, `SELECT * FROM users`)
 	if users == nil {
 		return make([]User, 0), err
 	}
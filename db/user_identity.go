@@ -0,0 +1,58 @@
+package db
+
+import (
+	"time"
+)
+
+// Links an account on an external login provider to a user
+type UserIdentity struct {
+	Provider  string `json:"provider" db:"provider"`
+	Subject   string `json:"subject" db:"subject"`
+	UserId    int64  `json:"user_id" db:"user_id"`
+	CreatedAt int64  `json:"created_at" db:"created_at"`
+}
+
+func (s *SQLStore) DeleteUserIdentity(ui *UserIdentity) error {
+	_, err := s.db.Exec(`DELETE FROM user_identities WHERE provider=? AND subject=?`, ui.Provider, ui.Subject)
+	return err
+}
+
+func (s *SQLStore) CreateUserIdentity(userId int64, provider, subject string) (*UserIdentity, error) {
+	ts := time.Now().Unix()
+
+	_, err := s.db.Exec(
+		`INSERT INTO user_identities (provider, subject, user_id, created_at) VALUES (?, ?, ?, ?);`,
+		provider,
+		subject,
+		userId,
+		ts,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserIdentity{
+		Provider:  provider,
+		Subject:   subject,
+		UserId:    userId,
+		CreatedAt: ts,
+	}, nil
+}
+
+func (s *SQLStore) GetUserIdentity(provider, subject string) (*UserIdentity, error) {
+	var identity UserIdentity
+	err := s.db.Get(&identity, `SELECT * FROM user_identities WHERE provider=? AND subject=?`, provider, subject)
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (s *SQLStore) GetUserIdentitiesByUserId(id int64) ([]UserIdentity, error) {
+	var identities []UserIdentity
+	err := s.db.Select(&identities, `SELECT * FROM user_identities WHERE user_id=?`, id)
+	if identities == nil {
+		return make([]UserIdentity, 0), err
+	}
+	return identities, err
+}
@@ -1,48 +1,190 @@
 package db
 
-const USER_REALM_GRANT_SCHEMA = `
-CREATE TABLE IF NOT EXISTS user_realm_grants (
-	user_id INTEGER,
-	realm_id INTEGER,
-	alias TEXT,
-
-	PRIMARY KEY (user_id, realm_id)
-);
+import (
+	"database/sql"
+	"time"
+)
+
+// SQL condition matching grants which are currently within their validity
+// window, takes the current unix timestamp twice.
+const activeUserRealmGrantCondition = `
+	(not_before IS NULL OR not_before <= ?) AND (expires_at IS NULL OR expires_at > ?)
 `
 
 type UserRealmGrant struct {
 	UserId  int64   `json:"user_id" db:"user_id"`
 	RealmId int64   `json:"realm_id" db:"realm_id"`
 	Alias   *string `json:"alias" db:"alias"`
+
+	// Optional unix timestamps bounding when the grant gives access
+	NotBefore *int64 `json:"not_before" db:"not_before"`
+	ExpiresAt *int64 `json:"expires_at" db:"expires_at"`
+
+	// The LDAP group this grant was synced from, it is removed again once the
+	// user leaves the group. Nil for grants made by hand.
+	LDAPGroup *string `json:"ldap_group" db:"ldap_group"`
+}
+
+func (s *SQLStore) UpdateUserRealmGrantAlias(g *UserRealmGrant, alias *string) error {
+	_, err := s.db.Exec(
+		`UPDATE user_realm_grants SET alias=? WHERE user_id=? AND realm_id=?`,
+		alias,
+		g.UserId,
+		g.RealmId,
+	)
+	if err != nil {
+		return err
+	}
+
+	g.Alias = alias
+	return nil
+}
+
+func (s *SQLStore) UpdateUserRealmGrantLDAPGroup(g *UserRealmGrant, group *string) error {
+	_, err := s.db.Exec(
+		`UPDATE user_realm_grants SET ldap_group=? WHERE user_id=? AND realm_id=?`,
+		group,
+		g.UserId,
+		g.RealmId,
+	)
+	if err != nil {
+		return err
+	}
+
+	g.LDAPGroup = group
+	return nil
 }
 
-func CreateUserRealmGrant(userId int64, realmId int64, alias *string) (*UserRealmGrant, error) {
-	_, err := db.Exec(`
-		INSERT INTO user_realm_grants (user_id, realm_id, alias)
-		VALUES (?, ?, ?);
-	`, userId, realmId, alias)
+func (s *SQLStore) DeleteUserRealmGrant(g *UserRealmGrant) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM user_realm_grant_roles WHERE user_id=? AND realm_id=?`,
+		`DELETE FROM user_realm_grants WHERE user_id=? AND realm_id=?`,
+	} {
+		_, err = tx.Exec(query, g.UserId, g.RealmId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) CreateUserRealmGrant(userId int64, realmId int64, alias *string, notBefore, expiresAt *int64) (*UserRealmGrant, error) {
+	_, err := s.db.Exec(`
+		INSERT INTO user_realm_grants (user_id, realm_id, alias, not_before, expires_at)
+		VALUES (?, ?, ?, ?, ?);
+	`, userId, realmId, alias, notBefore, expiresAt)
 	if err != nil {
 		return nil, err
 	}
 
 	return &UserRealmGrant{
-		UserId:  userId,
-		RealmId: realmId,
-		Alias:   alias,
+		UserId:    userId,
+		RealmId:   realmId,
+		Alias:     alias,
+		NotBefore: notBefore,
+		ExpiresAt: expiresAt,
 	}, nil
 }
 
-func GetUserRealmGrantByRealmName(userId int64, realmName string) (*UserRealmGrant, error) {
+func (s *SQLStore) GetUserRealmGrant(userId int64, realmId int64) (*UserRealmGrant, error) {
 	var grant UserRealmGrant
 
-	err := db.Get(&grant, `
-		SELECT urg.* FROM user_realm_grants urg
-		JOIN realms r ON r.id = urg.realm_id
-		WHERE r.name = ? AND urg.user_id = ?
-	`, realmName, userId)
+	err := s.db.Get(&grant, `
+		SELECT * FROM user_realm_grants WHERE user_id = ? AND realm_id = ?
+	`, userId, realmId)
 	if err != nil {
 		return nil, err
 	}
 
 	return &grant, nil
 }
+
+// Returns the active grant giving the user access to the realm, either directly
+// or via one of their groups. Grants inherited from a group have no alias.
+func (s *SQLStore) GetEffectiveUserRealmGrant(userId int64, realmId int64) (*UserRealmGrant, error) {
+	now := time.Now().Unix()
+
+	var grant UserRealmGrant
+	err := s.db.Get(&grant, `
+		SELECT * FROM user_realm_grants WHERE user_id = ? AND realm_id = ? AND
+	`+activeUserRealmGrantCondition, userId, realmId, now, now)
+	if err != sql.ErrNoRows {
+		if err != nil {
+			return nil, err
+		}
+		return &grant, nil
+	}
+
+	var groupGrant UserRealmGrant
+	err = s.db.Get(&groupGrant, `
+		SELECT gm.user_id, grg.realm_id, NULL AS alias FROM group_realm_grants grg
+		JOIN group_members gm ON gm.group_id = grg.group_id
+		WHERE gm.user_id = ? AND grg.realm_id = ?
+		LIMIT 1
+	`, userId, realmId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &groupGrant, nil
+}
+
+// Returns the grant giving the user access to the named realm, either on the
+// realm itself or the nearest of its parents. The returned grant belongs to the
+// realm which matched, which is not necessarily the one requested.
+func (s *SQLStore) GetUserRealmGrantByRealmName(userId int64, realmName string) (*UserRealmGrant, error) {
+	return getUserRealmGrantByRealmName(s, userId, realmName)
+}
+
+func getUserRealmGrantByRealmName(store Store, userId int64, realmName string) (*UserRealmGrant, error) {
+	lineage, err := store.GetRealmLineage(realmName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, realm := range lineage {
+		grant, err := store.GetEffectiveUserRealmGrant(userId, realm.Id)
+		if err == nil {
+			return grant, nil
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *SQLStore) GetUserRealmGrantsByRealmId(realmId int64) ([]UserRealmGrant, error) {
+	var grants []UserRealmGrant
+	err := s.db.Select(&grants, `SELECT * FROM user_realm_grants WHERE realm_id=?`, realmId)
+	if grants == nil {
+		return make([]UserRealmGrant, 0), err
+	}
+	return grants, err
+}
+
+func (s *SQLStore) GetUserRealmGrantsByUserId(userId int64) ([]UserRealmGrant, error) {
+	var grants []UserRealmGrant
+	err := s.db.Select(&grants, `SELECT * FROM user_realm_grants WHERE user_id=?`, userId)
+	if grants == nil {
+		return make([]UserRealmGrant, 0), err
+	}
+	return grants, err
+}
+
+// Returns grants whose expiry has passed
+func (s *SQLStore) GetExpiredUserRealmGrants() ([]UserRealmGrant, error) {
+	var grants []UserRealmGrant
+	err := s.db.Select(&grants, `SELECT * FROM user_realm_grants WHERE expires_at <= ?`, time.Now().Unix())
+	if grants == nil {
+		return make([]UserRealmGrant, 0), err
+	}
+	return grants, err
+}
@@ -2,7 +2,12 @@ package db
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
 )
 
 const (
@@ -10,38 +15,249 @@ const (
 	USER_TOKEN_FLAG_API = 1 << iota
 )
 
-const USER_TOKEN_SCHEMA = `
-CREATE TABLE IF NOT EXISTS user_tokens (
-	id INTEGER PRIMARY KEY,
-	user_id INTEGER,
-	name TEXT,
-	token TEXT,
-	flags INTEGER
-);
+// Scopes restricting which parts of the API a token may be used for. A token
+// holding "<scope>:read" may only make read-only requests within that scope.
+const (
+	USER_TOKEN_SCOPE_IDENTITY = "identity"
+	USER_TOKEN_SCOPE_TOKENS   = "tokens"
+	USER_TOKEN_SCOPE_ADMIN    = "admin"
+)
+
+var UserTokenScopes = []string{
+	USER_TOKEN_SCOPE_IDENTITY,
+	USER_TOKEN_SCOPE_IDENTITY + ":read",
+	USER_TOKEN_SCOPE_TOKENS,
+	USER_TOKEN_SCOPE_TOKENS + ":read",
+	USER_TOKEN_SCOPE_ADMIN,
+	USER_TOKEN_SCOPE_ADMIN + ":read",
+}
+
+// Tokens are only stored hashed, so every query must select these explicitly
+// to skip the plaintext token column which is no longer used.
+const userTokenColumns = `
+	id, user_id, name, token_hash, token_prefix, flags, created_at, expires_at, last_used_at, last_used_ip
 `
 
+// How many characters of a token are kept in plaintext to help identify it
+const userTokenPrefixLength = 8
+
 type UserToken struct {
 	Id     int64  `json:"id" db:"id"`
-	UserId int64  `json:"-" db:"user_id"`
+	UserId int64  `json:"user_id" db:"user_id"`
 	Name   string `json:"name" db:"name"`
-	Token  string `json:"token" db:"token"`
 	Flags  Bits   `json:"flags" db:"flags"`
+
+	// The full token is only known when it is created or reset
+	Token       string `json:"token,omitempty" db:"-"`
+	TokenHash   string `json:"-" db:"token_hash"`
+	TokenPrefix string `json:"token_prefix" db:"token_prefix"`
+
+	// Tokens created before these were tracked have no created_at, and tokens
+	// without an expires_at never expire.
+	CreatedAt  *int64  `json:"created_at" db:"created_at"`
+	ExpiresAt  *int64  `json:"expires_at" db:"expires_at"`
+	LastUsedAt *int64  `json:"last_used_at" db:"last_used_at"`
+	LastUsedIP *string `json:"last_used_ip" db:"last_used_ip"`
+
+	// When empty the token is not restricted to any realms or scopes. Realms
+	// are stored by id so they follow renames, and tokens restricted only to a
+	// realm are deleted along with it rather than left unrestricted.
+	Realms []string `json:"realms" db:"-"`
+	Scopes []string `json:"scopes" db:"-"`
+}
+
+func hashUserToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func IsValidUserTokenScope(scope string) bool {
+	for _, valid := range UserTokenScopes {
+		if scope == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the token may be used within the given scope, readOnly
+// requests are also allowed by the read-only variant of the scope.
+func (ut *UserToken) HasScope(scope string, readOnly bool) bool {
+	if len(ut.Scopes) == 0 {
+		return true
+	}
+
+	for _, tokenScope := range ut.Scopes {
+		if tokenScope == scope || (readOnly && tokenScope == scope+":read") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the token may be used to validate against a realm, given its
+// lineage (as from GetRealmLineage). Tokens restricted to a realm are allowed
+// its child realms too.
+func (ut *UserToken) AllowsRealm(lineage []Realm) bool {
+	if len(ut.Realms) == 0 {
+		return true
+	}
+
+	for _, candidate := range lineage {
+		for _, realm := range ut.Realms {
+			if realm == candidate.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *SQLStore) loadUserTokenRestrictions(ut *UserToken) error {
+	ut.Realms = make([]string, 0)
+	err := s.db.Select(&ut.Realms, `
+		SELECT realms.name FROM user_token_realms
+		JOIN realms ON realms.id = user_token_realms.realm_id
+		WHERE user_token_realms.token_id=?
+		ORDER BY realms.name
+	`, ut.Id)
+	if err != nil {
+		return err
+	}
+
+	ut.Scopes = make([]string, 0)
+	return s.db.Select(&ut.Scopes, `SELECT scope FROM user_token_scopes WHERE token_id=? ORDER BY scope`, ut.Id)
 }
 
-func (ut *UserToken) Delete() error {
-	_, err := db.Exec(`DELETE FROM user_tokens WHERE id=?`, ut.Id)
-	return err
+func (s *SQLStore) DeleteUserToken(ut *UserToken) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteUserToken(tx, ut.Id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (ut *UserToken) Save() error {
-	_, err := db.Exec(
-		`UPDATE user_tokens SET name=? AND token=? AND flags=? WHERE id=?`,
+func deleteUserToken(tx *transaction, id int64) error {
+	for _, query := range []string{
+		`DELETE FROM user_token_realms WHERE token_id=?`,
+		`DELETE FROM user_token_scopes WHERE token_id=?`,
+		`DELETE FROM user_tokens WHERE id=?`,
+	} {
+		_, err := tx.Exec(query, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Saves the token's name, flags, expiry and restrictions, along with its new
+// contents if it was regenerated, all at once.
+func (s *SQLStore) SaveUserToken(ut *UserToken) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`UPDATE user_tokens SET name=?, flags=?, expires_at=?, token_hash=?, token_prefix=? WHERE id=?`,
 		ut.Name,
-		ut.Token,
 		ut.Flags,
+		ut.ExpiresAt,
+		ut.TokenHash,
+		ut.TokenPrefix,
 		ut.Id,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM user_token_realms WHERE token_id=?`,
+		`DELETE FROM user_token_scopes WHERE token_id=?`,
+	} {
+		_, err = tx.Exec(query, ut.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = insertUserTokenRestrictions(tx, ut.Id, ut.Realms, ut.Scopes)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return s.loadUserTokenRestrictions(ut)
+}
+
+func insertUserTokenRestrictions(tx *transaction, id int64, realms, scopes []string) error {
+	for _, realm := range realms {
+		// Fails with sql.ErrNoRows rather than leave the token unrestricted
+		//  if the realm has since been deleted.
+		var realmId int64
+		err := tx.Get(&realmId, `SELECT id FROM realms WHERE name=?`, realm)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO user_token_realms (token_id, realm_id) VALUES (?, ?) ON CONFLICT DO NOTHING;`, id, realmId)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, scope := range scopes {
+		_, err := tx.Exec(`INSERT INTO user_token_scopes (token_id, scope) VALUES (?, ?) ON CONFLICT DO NOTHING;`, id, scope)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the token's contents with newly generated ones, which take effect
+// once the token is saved and are only available on this struct until then.
+func (ut *UserToken) Regenerate() error {
+	token, err := GenerateUserTokenContents()
+	if err != nil {
+		return err
+	}
+
+	ut.Token = token
+	ut.TokenHash = hashUserToken(token)
+	ut.TokenPrefix = token[:userTokenPrefixLength]
+	return nil
+}
+
+// Records that the token was just used from the given IP
+func (s *SQLStore) TouchUserToken(ut *UserToken, ip string) error {
+	ts := time.Now().Unix()
+
+	_, err := s.db.Exec(`UPDATE user_tokens SET last_used_at=?, last_used_ip=? WHERE id=?`, ts, ip, ut.Id)
+	if err != nil {
+		return err
+	}
+
+	ut.LastUsedAt = &ts
+	ut.LastUsedIP = &ip
+	return nil
+}
+
+func (ut *UserToken) IsExpired() bool {
+	return ut.ExpiresAt != nil && *ut.ExpiresAt <= time.Now().Unix()
 }
 
 func GenerateUserTokenContents() (string, error) {
@@ -54,52 +270,161 @@ func GenerateUserTokenContents() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(tokenRaw), nil
 }
 
-func CreateUserToken(userId int64, name string, flags Bits) (*UserToken, error) {
+// Creates a token restricted to the given realms and scopes (if any), which
+// are stored along with it all at once.
+func (s *SQLStore) CreateUserToken(userId int64, name string, flags Bits, expiresAt *int64, realms, scopes []string) (*UserToken, error) {
 	tokenEncoded, err := GenerateUserTokenContents()
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := db.Exec(
-		`INSERT INTO user_tokens (user_id, name, token, flags) VALUES (?, ?, ?, ?);`,
+	ts := time.Now().Unix()
+
+	tokenHash := hashUserToken(tokenEncoded)
+	tokenPrefix := tokenEncoded[:userTokenPrefixLength]
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	id, err := tx.Insert(
+		`INSERT INTO user_tokens (user_id, name, token_hash, token_prefix, flags, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?);`,
 		userId,
 		name,
-		tokenEncoded,
+		tokenHash,
+		tokenPrefix,
 		flags,
+		ts,
+		expiresAt,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	userToken := &UserToken{
-		UserId: userId,
-		Name:   name,
-		Token:  tokenEncoded,
-		Flags:  flags,
+	err = insertUserTokenRestrictions(tx, id, realms, scopes)
+	if err != nil {
+		return nil, err
 	}
 
-	userToken.Id, err = result.LastInsertId()
+	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
 
-	return userToken, nil
+	userToken := &UserToken{
+		Id:          id,
+		UserId:      userId,
+		Name:        name,
+		Token:       tokenEncoded,
+		TokenHash:   tokenHash,
+		TokenPrefix: tokenPrefix,
+		Flags:       flags,
+		CreatedAt:   &ts,
+		ExpiresAt:   expiresAt,
+	}
+
+	return userToken, s.loadUserTokenRestrictions(userToken)
+}
+
+func (s *SQLStore) GetUserTokenById(id int64) (*UserToken, error) {
+	var userToken UserToken
+	err := s.db.Get(&userToken, `SELECT `+userTokenColumns+` FROM user_tokens WHERE id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &userToken, s.loadUserTokenRestrictions(&userToken)
 }
 
-func GetUserTokenById(id int64) (*UserToken, error) {
+// Looks up an unexpired token by its contents, if isAPI is set only tokens
+// which can access the heracles API are matched.
+func (s *SQLStore) GetUserTokenByToken(token string, isAPI bool) (*UserToken, error) {
 	var userToken UserToken
-	err := db.Get(&userToken, `SELECT * FROM user_tokens WHERE id=?`, id)
+	err := s.db.Get(&userToken, `SELECT `+userTokenColumns+` FROM user_tokens WHERE token_hash=?`, hashUserToken(token))
 	if err != nil {
 		return nil, err
 	}
-	return &userToken, nil
+
+	if userToken.IsExpired() || (isAPI && !userToken.Flags.Has(USER_TOKEN_FLAG_API)) {
+		return nil, sql.ErrNoRows
+	}
+
+	return &userToken, s.loadUserTokenRestrictions(&userToken)
+}
+
+func (s *SQLStore) GetUserTokensByUserId(id int64) ([]UserToken, error) {
+	return s.selectUserTokens(`SELECT `+userTokenColumns+` FROM user_tokens WHERE user_id=?`, id)
 }
 
-func GetUserTokensByUserId(id int64) ([]UserToken, error) {
+// Finds tokens across all users whose name contains the given string and
+// whose prefix starts with the given prefix, either of which may be empty.
+func (s *SQLStore) SearchUserTokens(name, prefix string) ([]UserToken, error) {
+	return s.selectUserTokens(`
+		SELECT `+userTokenColumns+` FROM user_tokens
+		WHERE lower(name) LIKE ? ESCAPE '\' AND token_prefix LIKE ? ESCAPE '\'
+		ORDER BY id
+	`, "%"+escapeLike(strings.ToLower(name))+"%", escapeLike(prefix)+"%")
+}
+
+// Selects tokens along with the realms and scopes they are restricted to
+func (s *SQLStore) selectUserTokens(query string, args ...interface{}) ([]UserToken, error) {
 	var userTokens []UserToken
-	err := db.Select(&userTokens, `SELECT * FROM user_tokens WHERE user_id=?`, id)
+	err := s.db.Select(&userTokens, query, args...)
+	if err != nil {
+		return nil, err
+	} else if userTokens == nil {
+		return make([]UserToken, 0), nil
+	}
+
+	for i := range userTokens {
+		err = s.loadUserTokenRestrictions(&userTokens[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return userTokens, nil
+}
+
+// Returns tokens which expired before the given unix timestamp
+func (s *SQLStore) GetUserTokensExpiredBefore(ts int64) ([]UserToken, error) {
+	var userTokens []UserToken
+	err := s.db.Select(
+		&userTokens,
+		`SELECT `+userTokenColumns+` FROM user_tokens WHERE expires_at IS NOT NULL AND expires_at <= ?`,
+		ts,
+	)
 	if userTokens == nil {
 		return make([]UserToken, 0), err
 	}
 	return userTokens, err
 }
+
+func (s *SQLStore) DeleteUserTokensByUserId(id int64) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = deleteUserTokensByUserId(tx, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func deleteUserTokensByUserId(tx *transaction, id int64) error {
+	for _, query := range []string{
+		`DELETE FROM user_token_realms WHERE token_id IN (SELECT id FROM user_tokens WHERE user_id=?)`,
+		`DELETE FROM user_token_scopes WHERE token_id IN (SELECT id FROM user_tokens WHERE user_id=?)`,
+		`DELETE FROM user_tokens WHERE user_id=?`,
+	} {
+		_, err := tx.Exec(query, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
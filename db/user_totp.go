@@ -0,0 +1,89 @@
+package db
+
+import (
+	"time"
+)
+
+type UserTOTP struct {
+	UserId    int64  `json:"user_id" db:"user_id"`
+	Secret    string `json:"-" db:"secret"`
+	Confirmed bool   `json:"confirmed" db:"confirmed"`
+	CreatedAt int64  `json:"created_at" db:"created_at"`
+
+	// The time step of the last code accepted, codes from it or any earlier
+	//  step are rejected so a code can't be used twice.
+	LastCounter int64 `json:"-" db:"last_counter"`
+}
+
+func (s *SQLStore) ConfirmUserTOTP(t *UserTOTP) error {
+	_, err := s.db.Exec(`UPDATE user_totp SET confirmed=1 WHERE user_id=?`, t.UserId)
+	if err != nil {
+		return err
+	}
+
+	t.Confirmed = true
+	return nil
+}
+
+// Records counter as the last time step a code was accepted for, returning
+// false if a code from it (or a later step) was already accepted.
+func (s *SQLStore) UseUserTOTPCounter(t *UserTOTP, counter int64) (bool, error) {
+	result, err := s.db.Exec(
+		`UPDATE user_totp SET last_counter=? WHERE user_id=? AND last_counter<?`,
+		counter,
+		t.UserId,
+		counter,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if updated == 0 {
+		return false, nil
+	}
+
+	t.LastCounter = counter
+	return true, nil
+}
+
+func (s *SQLStore) DeleteUserTOTP(t *UserTOTP) error {
+	_, err := s.db.Exec(`DELETE FROM user_totp WHERE user_id=?`, t.UserId)
+	return err
+}
+
+// Creates (or replaces any existing) unconfirmed TOTP secret for the given user
+func (s *SQLStore) CreateUserTOTP(userId int64, secret string) (*UserTOTP, error) {
+	ts := time.Now().Unix()
+
+	_, err := s.db.Exec(
+		`INSERT INTO user_totp (user_id, secret, confirmed, created_at, last_counter) VALUES (?, ?, 0, ?, 0)
+		ON CONFLICT (user_id) DO UPDATE SET secret=excluded.secret, confirmed=0, created_at=excluded.created_at, last_counter=0;`,
+		userId,
+		secret,
+		ts,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserTOTP{
+		UserId:    userId,
+		Secret:    secret,
+		Confirmed: false,
+		CreatedAt: ts,
+	}, nil
+}
+
+func (s *SQLStore) GetUserTOTPByUserId(id int64) (*UserTOTP, error) {
+	var userTOTP UserTOTP
+	err := s.db.Get(&userTOTP, `SELECT * FROM user_totp WHERE user_id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &userTOTP, nil
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"time"
+)
+
+type UserWebAuthnCredential struct {
+	Id              int64  `json:"id" db:"id"`
+	UserId          int64  `json:"-" db:"user_id"`
+	Name            string `json:"name" db:"name"`
+	CredentialId    []byte `json:"-" db:"credential_id"`
+	PublicKey       []byte `json:"-" db:"public_key"`
+	AttestationType string `json:"attestation_type" db:"attestation_type"`
+	AAGUID          []byte `json:"-" db:"aaguid"`
+	SignCount       uint32 `json:"sign_count" db:"sign_count"`
+	CreatedAt       int64  `json:"created_at" db:"created_at"`
+}
+
+func (s *SQLStore) DeleteUserWebAuthnCredential(c *UserWebAuthnCredential) error {
+	_, err := s.db.Exec(`DELETE FROM user_webauthn_credentials WHERE id=?`, c.Id)
+	return err
+}
+
+func (s *SQLStore) UpdateUserWebAuthnCredentialSignCount(c *UserWebAuthnCredential, signCount uint32) error {
+	_, err := s.db.Exec(`UPDATE user_webauthn_credentials SET sign_count=? WHERE id=?`, signCount, c.Id)
+	if err != nil {
+		return err
+	}
+
+	c.SignCount = signCount
+	return nil
+}
+
+func (s *SQLStore) CreateUserWebAuthnCredential(userId int64, name string, credentialId, publicKey []byte, attestationType string, aaguid []byte, signCount uint32) (*UserWebAuthnCredential, error) {
+	ts := time.Now().Unix()
+
+	id, err := s.db.Insert(`
+		INSERT INTO user_webauthn_credentials (user_id, name, credential_id, public_key, attestation_type, aaguid, sign_count, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+	`, userId, name, credentialId, publicKey, attestationType, aaguid, signCount, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserWebAuthnCredential{
+		Id:              id,
+		UserId:          userId,
+		Name:            name,
+		CredentialId:    credentialId,
+		PublicKey:       publicKey,
+		AttestationType: attestationType,
+		AAGUID:          aaguid,
+		SignCount:       signCount,
+		CreatedAt:       ts,
+	}, nil
+}
+
+func (s *SQLStore) GetUserWebAuthnCredentialById(id int64) (*UserWebAuthnCredential, error) {
+	var credential UserWebAuthnCredential
+	err := s.db.Get(&credential, `SELECT * FROM user_webauthn_credentials WHERE id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+func (s *SQLStore) GetUserWebAuthnCredentialsByUserId(id int64) ([]UserWebAuthnCredential, error) {
+	var credentials []UserWebAuthnCredential
+	err := s.db.Select(&credentials, `SELECT * FROM user_webauthn_credentials WHERE user_id=?`, id)
+	if credentials == nil {
+		return make([]UserWebAuthnCredential, 0), err
+	}
+	return credentials, err
+}
@@ -2,7 +2,6 @@ package heracles
 
 import (
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -12,7 +11,6 @@ import (
 
 	"github.com/alioygur/gores"
 	"github.com/b1naryth1ef/heracles/db"
-	"github.com/spf13/viper"
 	"golang.org/x/oauth2"
 )
 
@@ -22,8 +20,6 @@ const (
 	userEndpoint string = "https://discordapp.com/api/v7/users/@me"
 )
 
-var cachedConfig *oauth2.Config
-
 type DiscordUser struct {
 	ID            string `json:"id"`
 	Username      string `json:"username"`
@@ -33,11 +29,11 @@ type DiscordUser struct {
 	Verified      bool   `json:"verified"`
 }
 
-func InitializeDiscordAuth() {
-	cachedConfig = &oauth2.Config{
-		ClientID:     viper.GetString("discord.client_id"),
-		ClientSecret: viper.GetString("discord.client_secret"),
-		RedirectURL:  viper.GetString("discord.redirect_uri"),
+func (s *Server) initializeDiscordAuth() {
+	s.discordConfig = &oauth2.Config{
+		ClientID:     s.config.Discord.ClientID,
+		ClientSecret: s.config.Discord.ClientSecret,
+		RedirectURL:  s.config.Discord.RedirectURI,
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  authURL,
 			TokenURL: tokenURL,
@@ -46,8 +42,8 @@ func InitializeDiscordAuth() {
 	}
 }
 
-func GetLoginDiscordRoute(w http.ResponseWriter, r *http.Request) {
-	session := getSession(w, r)
+func (s *Server) GetLoginDiscordRoute(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
 	if session == nil {
 		return
 	}
@@ -74,12 +70,12 @@ func GetLoginDiscordRoute(w http.ResponseWriter, r *http.Request) {
 	session.Values["state"] = randSeq(32)
 	session.Save(r, w)
 
-	url := cachedConfig.AuthCodeURL(session.Values["state"].(string), oauth2.AccessTypeOnline)
+	url := s.discordConfig.AuthCodeURL(session.Values["state"].(string), oauth2.AccessTypeOnline)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
-func GetLoginDiscordCallbackRoute(w http.ResponseWriter, r *http.Request) {
-	session := getSession(w, r)
+func (s *Server) GetLoginDiscordCallbackRoute(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
 	if session == nil {
 		return
 	}
@@ -96,7 +92,7 @@ func GetLoginDiscordCallbackRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := cachedConfig.Exchange(oauth2.NoContext, r.FormValue("code"))
+	token, err := s.discordConfig.Exchange(oauth2.NoContext, r.FormValue("code"))
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -132,10 +128,10 @@ func GetLoginDiscordCallbackRoute(w http.ResponseWriter, r *http.Request) {
 
 	var user *db.User
 
-	user, err = db.GetUserByDiscordId(id)
+	user, err = s.store.GetUserByDiscordId(id)
 	if err == sql.ErrNoRows {
-		if viper.GetBool("discord.create") {
-			user, err = db.CreateUser(discordUser.Username, "", 0, &id)
+		if s.config.Discord.Create {
+			user, err = s.store.CreateUser(discordUser.Username, "", 0, &id)
 			if err != nil {
 				reportInternalError(w, err)
 				return
@@ -149,26 +145,21 @@ func GetLoginDiscordCallbackRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authSecret := user.GetAuthSecret()
-	authSecretEncoded := base64.RawURLEncoding.EncodeToString(authSecret)
-
-	_, err = db.CreateAuditLogEntry("user.self_login", user, map[string]interface{}{
+	auditData := map[string]interface{}{
 		"discord": id,
-	})
+	}
+	redirectURL := session.Values["r"].(string)
+
+	factors, err := s.getUserSecondFactors(user)
 	if err != nil {
 		reportInternalError(w, err)
 		return
 	}
 
-	cookie := http.Cookie{
-		Name:   "heracles-auth",
-		Domain: viper.GetString("web.domain"),
-		Value:  authSecretEncoded,
-		Path:   "/",
-		MaxAge: 60 * 60 * 24 * 14,
+	if factors.Required() {
+		s.beginSecondFactorLogin(w, r, user, redirectURL, auditData)
+		return
 	}
-	http.SetCookie(w, &cookie)
 
-	redirectURL := session.Values["r"].(string)
-	http.Redirect(w, r, redirectURL, http.StatusFound)
+	s.completeLogin(w, r, user, redirectURL, auditData)
 }
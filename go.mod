@@ -4,14 +4,17 @@ go 1.13
 
 require (
 	github.com/alioygur/gores v1.2.1
-	github.com/bwmarrin/go-alone v0.0.0-20190806015146-742bb55d1631
+	github.com/duo-labs/webauthn v0.0.0-20220815211337-00c9fb5711f5
+	github.com/go-asn1-ber/asn1-ber v1.5.1
 	github.com/go-chi/chi v4.0.2+incompatible
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/gorilla/schema v1.1.0
 	github.com/gorilla/sessions v1.2.0
-	github.com/jmoiron/sqlx v1.2.0
+	github.com/jmoiron/sqlx v1.3.3
+	github.com/lib/pq v1.10.1
 	github.com/mattn/go-sqlite3 v2.0.1+incompatible
-	github.com/spf13/viper v1.6.1
-	golang.org/x/crypto v0.0.0-20191206172530-e9b2fee46413
-	golang.org/x/oauth2 v0.0.0-20191202225959-858c2ad4c8b6
+	github.com/spf13/viper v1.7.0
+	golang.org/x/crypto v0.0.0-20210506145944-38f3c27a63bf
+	golang.org/x/oauth2 v0.0.0-20210427180440-81ed05c6b58c
 	layeh.com/radius v0.0.0-20190322222518-890bc1058917
 )
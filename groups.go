@@ -0,0 +1,338 @@
+package heracles
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/alioygur/gores"
+	"github.com/go-chi/chi"
+)
+
+type GroupPayload struct {
+	Name string `json:"name" schema:"name"`
+}
+
+func (s *Server) GetGroupsRoute(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.store.GetGroups()
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"groups": groups,
+	})
+}
+
+func (s *Server) PostGroupsRoute(w http.ResponseWriter, r *http.Request) {
+	var payload GroupPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	if payload.Name == "" {
+		gores.Error(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	_, err := s.store.GetGroupByName(payload.Name)
+	if err == nil {
+		gores.Error(w, http.StatusConflict, "name is already taken")
+		return
+	} else if err != sql.ErrNoRows {
+		reportInternalError(w, err)
+		return
+	}
+
+	group, err := s.store.CreateGroup(payload.Name)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.group_create", getCurrentUser(r), map[string]interface{}{
+		"group": group.Id,
+		"name":  group.Name,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, group)
+}
+
+func (s *Server) GetGroupRoute(w http.ResponseWriter, r *http.Request) {
+	gores.JSON(w, http.StatusOK, getCurrentGroup(r))
+}
+
+func (s *Server) PatchGroupRoute(w http.ResponseWriter, r *http.Request) {
+	var payload GroupPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	group := getCurrentGroup(r)
+
+	if payload.Name == "" {
+		gores.Error(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	if payload.Name != group.Name {
+		_, err := s.store.GetGroupByName(payload.Name)
+		if err == nil {
+			gores.Error(w, http.StatusConflict, "name is already taken")
+			return
+		} else if err != sql.ErrNoRows {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
+	oldName := group.Name
+	err := s.store.UpdateGroupName(group, payload.Name)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.group_update", getCurrentUser(r), map[string]interface{}{
+		"group":    group.Id,
+		"old_name": oldName,
+		"name":     group.Name,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, group)
+}
+
+func (s *Server) DeleteGroupRoute(w http.ResponseWriter, r *http.Request) {
+	group := getCurrentGroup(r)
+
+	err := s.store.DeleteGroup(group)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.group_delete", getCurrentUser(r), map[string]interface{}{
+		"group": group.Id,
+		"name":  group.Name,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+func (s *Server) GetGroupMembersRoute(w http.ResponseWriter, r *http.Request) {
+	members, err := s.store.GetGroupMembersByGroupId(getCurrentGroup(r).Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"members": members,
+	})
+}
+
+type CreateGroupMemberPayload struct {
+	UserId int64 `json:"user_id" schema:"user_id"`
+}
+
+func (s *Server) PostGroupMembersRoute(w http.ResponseWriter, r *http.Request) {
+	var payload CreateGroupMemberPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	group := getCurrentGroup(r)
+
+	user, err := s.store.GetUserById(payload.UserId)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusBadRequest, "Unknown User")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.GetGroupMember(group.Id, user.Id)
+	if err == nil {
+		gores.Error(w, http.StatusConflict, "User is already a member")
+		return
+	} else if err != sql.ErrNoRows {
+		reportInternalError(w, err)
+		return
+	}
+
+	member, err := s.store.CreateGroupMember(group.Id, user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.group_member_add", getCurrentUser(r), map[string]interface{}{
+		"group": group.Id,
+		"user":  user.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, member)
+}
+
+func (s *Server) DeleteGroupMemberRoute(w http.ResponseWriter, r *http.Request) {
+	group := getCurrentGroup(r)
+
+	userId, err := strconv.ParseInt(chi.URLParam(r, "userId"), 10, 64)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	member, err := s.store.GetGroupMember(group.Id, userId)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.DeleteGroupMember(member)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.group_member_remove", getCurrentUser(r), map[string]interface{}{
+		"group": group.Id,
+		"user":  userId,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+func (s *Server) GetGroupGrantsRoute(w http.ResponseWriter, r *http.Request) {
+	grants, err := s.store.GetGroupRealmGrantsByGroupId(getCurrentGroup(r).Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"grants": grants,
+	})
+}
+
+type CreateGroupRealmGrantPayload struct {
+	RealmId int64    `json:"realm_id" schema:"realm_id"`
+	Roles   []string `json:"roles" schema:"roles"`
+}
+
+func (s *Server) PostGroupGrantsRoute(w http.ResponseWriter, r *http.Request) {
+	var payload CreateGroupRealmGrantPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	group := getCurrentGroup(r)
+
+	realm, err := s.store.GetRealmById(payload.RealmId)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusBadRequest, "Unknown realm")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.GetGroupRealmGrant(group.Id, realm.Id)
+	if err == nil {
+		gores.Error(w, http.StatusConflict, "Group already has access to this realm")
+		return
+	} else if err != sql.ErrNoRows {
+		reportInternalError(w, err)
+		return
+	}
+
+	roleIds, ok := s.resolveRealmRoleIds(w, realm, payload.Roles)
+	if !ok {
+		return
+	}
+
+	grant, err := s.store.CreateGroupRealmGrant(group.Id, realm.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.SetGroupRealmGrantRoles(group.Id, realm.Id, roleIds)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.group_grant", getCurrentUser(r), map[string]interface{}{
+		"group": group.Id,
+		"realm": realm.Id,
+		"roles": payload.Roles,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, grant)
+}
+
+func (s *Server) DeleteGroupGrantRoute(w http.ResponseWriter, r *http.Request) {
+	group := getCurrentGroup(r)
+
+	realmId, err := strconv.ParseInt(chi.URLParam(r, "realmId"), 10, 64)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid realm ID")
+		return
+	}
+
+	grant, err := s.store.GetGroupRealmGrant(group.Id, realmId)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.DeleteGroupRealmGrant(grant)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.group_revoke", getCurrentUser(r), map[string]interface{}{
+		"group": group.Id,
+		"realm": realmId,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
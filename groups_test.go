@@ -0,0 +1,102 @@
+package heracles
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+func TestGroupGrantGivesAccessAndRoles(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	user, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newLoggedInClient(t, ts, "admin", "admin")
+	c := newLoggedInClient(t, ts, "user", "password")
+
+	var realm db.Realm
+	admin.expect(admin.send("POST", "/api/realms", map[string]string{"name": "test"}), http.StatusOK, &realm)
+	admin.expect(admin.send("POST", fmt.Sprintf("/api/realms/%v/roles", realm.Id), map[string]interface{}{
+		"name":  "editor",
+		"level": 10,
+	}), http.StatusOK)
+
+	var group db.Group
+	admin.expect(admin.send("POST", "/api/groups", map[string]string{"name": "staff"}), http.StatusOK, &group)
+	admin.expect(admin.send("POST", "/api/groups", map[string]string{"name": "staff"}), http.StatusConflict)
+	admin.expect(admin.send("POST", fmt.Sprintf("/api/groups/%v/members", group.Id), map[string]int64{"user_id": user.Id}), http.StatusOK)
+	admin.expect(admin.send("POST", fmt.Sprintf("/api/groups/%v/grants", group.Id), map[string]interface{}{
+		"realm_id": realm.Id,
+		"roles":    []string{"editor"},
+	}), http.StatusOK)
+
+	validate := map[string]string{"X-Heracles-Realm": "test", "X-Heracles-Required-Role": "editor"}
+
+	res := c.get("/api/validate", validate)
+	c.expect(res, http.StatusNoContent)
+	if res.Header.Get("X-Heracles-User") != "user" || res.Header.Get("X-Heracles-Roles") != "editor" {
+		t.Fatalf("unexpected validate headers %v", res.Header)
+	}
+
+	var grants struct {
+		Grants      []db.UserRealmGrant  `json:"grants"`
+		GroupGrants []db.GroupRealmGrant `json:"group_grants"`
+	}
+	admin.expect(admin.get(fmt.Sprintf("/api/realms/%v/grants", realm.Id), nil), http.StatusOK, &grants)
+	if len(grants.Grants) != 0 || len(grants.GroupGrants) != 1 {
+		t.Fatalf("unexpected grants %+v", grants)
+	}
+
+	admin.expect(admin.send("DELETE", fmt.Sprintf("/api/groups/%v/members/%v", group.Id, user.Id), nil), http.StatusNoContent)
+	c.expect(c.get("/api/validate", validate), http.StatusUnauthorized)
+
+	// Deleting the group takes its grants with it
+	admin.expect(admin.send("DELETE", fmt.Sprintf("/api/groups/%v", group.Id), nil), http.StatusNoContent)
+	admin.expect(admin.get(fmt.Sprintf("/api/realms/%v/grants", realm.Id), nil), http.StatusOK, &grants)
+	if len(grants.GroupGrants) != 0 {
+		t.Fatalf("group grants outlived the group %+v", grants.GroupGrants)
+	}
+}
+
+func TestDirectGrantRoles(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	user, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newLoggedInClient(t, ts, "admin", "admin")
+	c := newLoggedInClient(t, ts, "user", "password")
+
+	var realm db.Realm
+	admin.expect(admin.send("POST", "/api/realms", map[string]string{"name": "test"}), http.StatusOK, &realm)
+	for name, level := range map[string]int{"viewer": 1, "admin": 100} {
+		admin.expect(admin.send("POST", fmt.Sprintf("/api/realms/%v/roles", realm.Id), map[string]interface{}{
+			"name":  name,
+			"level": level,
+		}), http.StatusOK)
+	}
+
+	admin.expect(admin.send("POST", fmt.Sprintf("/api/realms/%v/grants", realm.Id), map[string]interface{}{
+		"user_id": user.Id,
+		"roles":   []string{"unknown"},
+	}), http.StatusBadRequest)
+	admin.expect(admin.send("POST", fmt.Sprintf("/api/realms/%v/grants", realm.Id), map[string]interface{}{
+		"user_id": user.Id,
+		"roles":   []string{"viewer"},
+	}), http.StatusOK)
+
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "test", "X-Heracles-Required-Role": "viewer"}), http.StatusNoContent)
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "test", "X-Heracles-Required-Role": "admin"}), http.StatusForbidden)
+
+	admin.expect(admin.send("PUT", fmt.Sprintf("/api/realms/%v/grants/%v/roles", realm.Id, user.Id), map[string]interface{}{
+		"roles": []string{"admin"},
+	}), http.StatusNoContent)
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "test", "X-Heracles-Required-Role": "admin"}), http.StatusNoContent)
+}
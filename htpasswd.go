@@ -0,0 +1,107 @@
+package heracles
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/b1naryth1ef/heracles/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticates users against an Apache style htpasswd file. Only bcrypt hashes
+// (as generated by `htpasswd -B`) are supported. The file is re-read on every
+// attempt so changes take effect without a restart.
+type htpasswdAuthenticator struct {
+	store  db.Store
+	path   string
+	create bool
+	link   bool
+}
+
+var ErrHtpasswdUserConflict = errors.New("User exists locally and is not linked to the htpasswd file")
+
+func (a *htpasswdAuthenticator) Name() string {
+	return "htpasswd"
+}
+
+func (a *htpasswdAuthenticator) findHash(username string) (string, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && parts[0] == username {
+			return parts[1], nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", ErrNoUser
+}
+
+func (a *htpasswdAuthenticator) Authenticate(username, password string) (*db.User, error) {
+	hash, err := a.findHash(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrNoUser
+	}
+
+	return a.getOrCreateUser(username)
+}
+
+func (a *htpasswdAuthenticator) getOrCreateUser(username string) (*db.User, error) {
+	user, err := a.store.GetUserByUsername(username)
+	if err == sql.ErrNoRows {
+		if !a.create {
+			return nil, ErrNoUser
+		}
+
+		var flags db.Bits
+		flags = flags.Set(db.USER_FLAG_HTPASSWD)
+
+		user, err = a.store.CreateUser(username, "", flags, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = a.store.CreateAuditLogEntry("user.htpasswd_create", user, nil)
+		return user, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user.Flags.Has(db.USER_FLAG_HTPASSWD) {
+		return user, nil
+	}
+
+	// As with LDAP, linking an existing local user must be explicitly enabled
+	if !a.link {
+		return nil, ErrHtpasswdUserConflict
+	}
+
+	err = a.store.UpdateUserFlags(user, user.Flags.Set(db.USER_FLAG_HTPASSWD))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = a.store.CreateAuditLogEntry("user.htpasswd_link", user, nil)
+	return user, err
+}
@@ -0,0 +1,144 @@
+package heracles
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/b1naryth1ef/heracles/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Writes an htpasswd file holding the given usernames and passwords, returning
+// its path.
+func writeTestHtpasswd(t *testing.T, passwords map[string]string) string {
+	t.Helper()
+
+	var lines []string
+	for username, password := range passwords {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("%s:%s", username, hash))
+	}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Returns the backend recorded for the most recent login
+func getTestLoginBackend(t *testing.T, store db.Store) interface{} {
+	t.Helper()
+
+	entries, err := store.GetRecentAuditLogEntries(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if entry.Action == "user.self_login" {
+			return entry.Data["backend"]
+		}
+	}
+
+	t.Fatal("no login was recorded")
+	return nil
+}
+
+func TestHtpasswdCreatesUsers(t *testing.T) {
+	path := writeTestHtpasswd(t, map[string]string{"user": "password"})
+	_, store, ts := newTestServer(t, func(config *Config) {
+		config.Auth.Backends = []string{"htpasswd"}
+		config.Auth.Htpasswd = HtpasswdConfig{Path: path, Create: true}
+	})
+
+	newLoggedInClient(t, ts, "user", "password")
+
+	user, err := store.GetUserByUsername("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Flags.Has(db.USER_FLAG_HTPASSWD) {
+		t.Fatalf("created user is not flagged as from htpasswd: %v", user.Flags)
+	}
+	if backend := getTestLoginBackend(t, store); backend != "htpasswd" {
+		t.Fatalf("login recorded backend %v", backend)
+	}
+
+	c := newTestClient(t, ts)
+	c.expect(c.postForm("/login", url.Values{"username": {"user"}, "password": {"wrong"}}), http.StatusBadRequest)
+}
+
+func TestHtpasswdLinksOnlyWhenEnabled(t *testing.T) {
+	for _, link := range []bool{false, true} {
+		path := writeTestHtpasswd(t, map[string]string{"admin": "htpasswd"})
+		_, store, ts := newTestServer(t, func(config *Config) {
+			config.Auth.Backends = []string{"htpasswd"}
+			config.Auth.Htpasswd = HtpasswdConfig{Path: path, Create: true, Link: link}
+		})
+
+		c := newTestClient(t, ts)
+		res := c.postForm("/login", url.Values{"username": {"admin"}, "password": {"htpasswd"}})
+
+		admin, err := store.GetUserByUsername("admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if link {
+			c.expect(res, http.StatusNoContent)
+			if !admin.Flags.Has(db.USER_FLAG_HTPASSWD) {
+				t.Fatalf("linked user is not flagged as from htpasswd: %v", admin.Flags)
+			}
+		} else {
+			// The local user isn't taken over by the htpasswd entry sharing its name
+			c.expect(res, http.StatusBadRequest)
+			if admin.Flags.Has(db.USER_FLAG_HTPASSWD) {
+				t.Fatalf("user was linked without auth.htpasswd.link: %v", admin.Flags)
+			}
+		}
+	}
+}
+
+func TestAuthenticatorChainOrder(t *testing.T) {
+	for _, backends := range [][]string{{"local", "htpasswd"}, {"htpasswd", "local"}} {
+		path := writeTestHtpasswd(t, map[string]string{"user": "file", "both": "shared"})
+		_, store, ts := newTestServer(t, func(config *Config) {
+			config.Auth.Backends = backends
+			config.Auth.Htpasswd = HtpasswdConfig{Path: path, Link: true}
+		})
+
+		for username, password := range map[string]string{"user": "local", "both": "shared"} {
+			_, err := store.CreateUser(username, password, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Each password is only accepted by its own backend
+		newLoggedInClient(t, ts, "user", "local")
+		if backend := getTestLoginBackend(t, store); backend != "local" {
+			t.Fatalf("%v: login with the local password recorded backend %v", backends, backend)
+		}
+
+		newLoggedInClient(t, ts, "user", "file")
+		if backend := getTestLoginBackend(t, store); backend != "htpasswd" {
+			t.Fatalf("%v: login with the htpasswd password recorded backend %v", backends, backend)
+		}
+
+		// A password both accept goes to whichever comes first
+		newLoggedInClient(t, ts, "both", "shared")
+		if backend := getTestLoginBackend(t, store); backend != backends[0] {
+			t.Fatalf("%v: login accepted by both recorded backend %v", backends, backend)
+		}
+	}
+}
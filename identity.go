@@ -6,7 +6,7 @@ import (
 	"github.com/alioygur/gores"
 )
 
-func GetIdentityRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetIdentityRoute(w http.ResponseWriter, r *http.Request) {
 	user := getCurrentUser(r)
 
 	gores.JSON(w, http.StatusOK, user)
@@ -16,7 +16,7 @@ type PatchIdentityPayload struct {
 	Password string `json:"password" schema:"password"`
 }
 
-func PatchIdentityRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PatchIdentityRoute(w http.ResponseWriter, r *http.Request) {
 	var payload PatchIdentityPayload
 	if !readRequestData(w, r, &payload) {
 		return
@@ -24,7 +24,14 @@ func PatchIdentityRoute(w http.ResponseWriter, r *http.Request) {
 
 	user := getCurrentUser(r)
 
-	err := user.UpdatePassword(payload.Password)
+	err := s.store.UpdateUserPassword(user, payload.Password)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	// Changing the password logs out every other session
+	err = s.store.DeleteSessionsByUserId(user.Id, s.getRequestSessionId(r))
 	if err != nil {
 		reportInternalError(w, err)
 		return
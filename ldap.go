@@ -0,0 +1,260 @@
+package heracles
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	ErrLDAPUnknownUser  = errors.New("User not found in LDAP directory")
+	ErrLDAPUserConflict = errors.New("User exists locally and is not linked to the LDAP directory")
+)
+
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	rawURL := a.config.URL
+
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         parsedURL.Hostname(),
+		InsecureSkipVerify: a.config.InsecureSkipVerify,
+	}
+
+	conn, err := ldap.DialURL(rawURL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.StartTLS {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// Finds the directory entry for the given username, binding as the configured
+// service account (if any) to perform the search.
+func (a *ldapAuthenticator) findEntry(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	bindDN := a.config.BindDN
+	if bindDN != "" {
+		err := conn.Bind(bindDN, a.config.BindPassword)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	request := ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		0,
+		false,
+		fmt.Sprintf(a.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", a.config.GroupAttribute},
+		nil,
+	)
+
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Entries) != 1 {
+		return nil, ErrLDAPUnknownUser
+	}
+
+	return result.Entries[0], nil
+}
+
+// Authenticates users by binding as them against an LDAP directory, creating
+// or linking the local user on their first login.
+type ldapAuthenticator struct {
+	store  db.Store
+	config LDAPConfig
+}
+
+func (a *ldapAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (a *ldapAuthenticator) Authenticate(username, password string) (*db.User, error) {
+	// An empty password results in an unauthenticated bind which most servers
+	//  will happily accept.
+	if username == "" || password == "" {
+		return nil, ErrNoUser
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := a.findEntry(conn, username)
+	if err == ErrLDAPUnknownUser {
+		return nil, ErrNoUser
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrNoUser
+	} else if err != nil {
+		return nil, err
+	}
+
+	user, err := a.getOrCreateUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.syncRealmGrants(user, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (a *ldapAuthenticator) getOrCreateUser(username string) (*db.User, error) {
+	user, err := a.store.GetUserByUsername(username)
+	if err == sql.ErrNoRows {
+		if !a.config.Create {
+			return nil, ErrNoUser
+		}
+
+		var flags db.Bits
+		flags = flags.Set(db.USER_FLAG_LDAP)
+
+		user, err = a.store.CreateUser(username, "", flags, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = a.store.CreateAuditLogEntry("user.ldap_create", user, nil)
+		return user, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user.Flags.Has(db.USER_FLAG_LDAP) {
+		return user, nil
+	}
+
+	// Linking an existing local user must be explicitly enabled, otherwise a
+	//  directory entry could take over any local account sharing its name.
+	if !a.config.Link {
+		return nil, ErrLDAPUserConflict
+	}
+
+	err = a.store.UpdateUserFlags(user, user.Flags.Set(db.USER_FLAG_LDAP))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = a.store.CreateAuditLogEntry("user.ldap_link", user, nil)
+	return user, err
+}
+
+// Syncs the user's grants with the realms mapped from their LDAP groups via the
+// `ldap.groups` setting, removing synced grants for groups they have left.
+// Grants made by hand are left untouched.
+func (a *ldapAuthenticator) syncRealmGrants(user *db.User, entry *ldap.Entry) error {
+	var realmIds []int64
+	realmGroups := make(map[int64]string)
+	for _, group := range entry.GetEqualFoldAttributeValues(a.config.GroupAttribute) {
+		// Viper lower-cases map keys, DNs (like attribute names) are
+		//  case-insensitive anyway
+		realmNames, ok := a.config.Groups[strings.ToLower(group)]
+		if !ok {
+			continue
+		}
+
+		for _, realmName := range realmNames {
+			realm, err := a.store.GetRealmByName(realmName)
+			if err == sql.ErrNoRows {
+				log.Printf("[LDAP] group %v maps to unknown realm %v", group, realmName)
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			if _, ok := realmGroups[realm.Id]; !ok {
+				realmIds = append(realmIds, realm.Id)
+				realmGroups[realm.Id] = group
+			}
+		}
+	}
+
+	grants, err := a.store.GetUserRealmGrantsByUserId(user.Id)
+	if err != nil {
+		return err
+	}
+
+	hasGrant := make(map[int64]bool)
+	for _, grant := range grants {
+		hasGrant[grant.RealmId] = true
+
+		_, mapped := realmGroups[grant.RealmId]
+		if grant.LDAPGroup == nil || mapped {
+			continue
+		}
+
+		err = a.store.DeleteUserRealmGrant(&grant)
+		if err != nil {
+			return err
+		}
+
+		_, err = a.store.CreateAuditLogEntry("user.ldap_revoke", user, map[string]interface{}{
+			"group": *grant.LDAPGroup,
+			"realm": grant.RealmId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, realmId := range realmIds {
+		if hasGrant[realmId] {
+			continue
+		}
+
+		group := realmGroups[realmId]
+		grant, err := a.store.CreateUserRealmGrant(user.Id, realmId, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		err = a.store.UpdateUserRealmGrantLDAPGroup(grant, &group)
+		if err != nil {
+			return err
+		}
+
+		_, err = a.store.CreateAuditLogEntry("user.ldap_grant", user, map[string]interface{}{
+			"group": group,
+			"realm": realmId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,411 @@
+package heracles
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/b1naryth1ef/heracles/db"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const testLDAPServiceDN = "cn=heracles,dc=test"
+
+type testLDAPEntry struct {
+	password   string
+	attributes map[string][]string
+}
+
+// A minimal in-process LDAP directory, supporting just the simple binds and
+// searches heracles makes.
+type testLDAPServer struct {
+	t        *testing.T
+	listener net.Listener
+
+	sync.Mutex
+	entries map[string]*testLDAPEntry
+	filters []string
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testLDAPServer{
+		t:        t,
+		listener: listener,
+		entries: map[string]*testLDAPEntry{
+			testLDAPServiceDN: {password: "service"},
+		},
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (l *testLDAPServer) url() string {
+	return "ldap://" + l.listener.Addr().String()
+}
+
+// Adds (or replaces) a person who can bind with the given password
+func (l *testLDAPServer) addUser(uid, password string, groups ...string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.entries["uid="+uid+",ou=people,dc=test"] = &testLDAPEntry{
+		password: password,
+		attributes: map[string][]string{
+			"objectclass": {"person"},
+			"uid":         {uid},
+			"memberof":    groups,
+		},
+	}
+}
+
+// Returns the filters searched for so far
+func (l *testLDAPServer) searchedFilters() []string {
+	l.Lock()
+	defer l.Unlock()
+	return append([]string{}, l.filters...)
+}
+
+func (l *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		messageId := packet.Children[0].Value
+		request := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = []*ber.Packet{l.bind(request)}
+		case ldap.ApplicationSearchRequest:
+			responses = l.search(request)
+		default:
+			return
+		}
+
+		for _, response := range responses {
+			message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "Message ID"))
+			message.AppendChild(response)
+
+			_, err = conn.Write(message.Bytes())
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func newTestLDAPResult(tag ber.Tag, code uint16) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return result
+}
+
+func (l *testLDAPServer) bind(request *ber.Packet) *ber.Packet {
+	dn := request.Children[1].Value.(string)
+	password := request.Children[2].Data.String()
+
+	l.Lock()
+	entry, ok := l.entries[dn]
+	l.Unlock()
+
+	if !ok || entry.password != password {
+		return newTestLDAPResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+	}
+	return newTestLDAPResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+}
+
+func (l *testLDAPServer) search(request *ber.Packet) []*ber.Packet {
+	filter := request.Children[6]
+	compiled, err := ldap.DecompileFilter(filter)
+	if err != nil {
+		l.t.Error(err)
+		return []*ber.Packet{newTestLDAPResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.filters = append(l.filters, compiled)
+
+	var responses []*ber.Packet
+	for dn, entry := range l.entries {
+		if !matchTestLDAPFilter(filter, entry) {
+			continue
+		}
+
+		response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+
+		attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for name, values := range entry.attributes {
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, value := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		response.AppendChild(attributes)
+
+		responses = append(responses, response)
+	}
+
+	return append(responses, newTestLDAPResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+// Evaluates the and, or, equality and presence filters heracles may send
+func matchTestLDAPFilter(filter *ber.Packet, entry *testLDAPEntry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchTestLDAPFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchTestLDAPFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(entry.attributes[strings.ToLower(filter.Data.String())]) > 0
+	case ldap.FilterEqualityMatch:
+		name := strings.ToLower(filter.Children[0].Data.String())
+		for _, value := range entry.attributes[name] {
+			if strings.EqualFold(value, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func newTestLDAPHeraclesServer(t *testing.T, directory *testLDAPServer, configure func(*LDAPConfig)) (*db.MemoryStore, *testClient) {
+	_, store, ts := newTestServer(t, func(config *Config) {
+		config.Auth.Backends = []string{"local", "ldap"}
+		config.LDAP = LDAPConfig{
+			URL:            directory.url(),
+			BindDN:         testLDAPServiceDN,
+			BindPassword:   "service",
+			BaseDN:         "dc=test",
+			UserFilter:     "(&(objectClass=person)(uid=%s))",
+			GroupAttribute: "memberOf",
+			Create:         true,
+		}
+		if configure != nil {
+			configure(&config.LDAP)
+		}
+	})
+
+	return store, newTestClient(t, ts)
+}
+
+func postTestLogin(c *testClient, username, password string) *http.Response {
+	return c.postForm("/login", url.Values{"username": {username}, "password": {password}})
+}
+
+func TestLDAPBind(t *testing.T) {
+	directory := newTestLDAPServer(t)
+	directory.addUser("alice", "hunter2")
+	store, c := newTestLDAPHeraclesServer(t, directory, nil)
+
+	c.expect(postTestLogin(c, "alice", "wrong"), http.StatusBadRequest)
+	c.expect(postTestLogin(c, "alice", ""), http.StatusBadRequest)
+	c.expect(postTestLogin(c, "nobody", "hunter2"), http.StatusBadRequest)
+	if _, err := store.GetUserByUsername("alice"); err == nil {
+		t.Fatal("user was created by a failed bind")
+	}
+
+	c.expect(postTestLogin(c, "alice", "hunter2"), http.StatusNoContent)
+
+	user, err := store.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Flags.Has(db.USER_FLAG_LDAP) {
+		t.Fatalf("created user is not flagged as from LDAP: %v", user.Flags)
+	}
+	if backend := getTestLoginBackend(t, store); backend != "ldap" {
+		t.Fatalf("login recorded backend %v", backend)
+	}
+}
+
+func TestLDAPOnlyCreatesWhenEnabled(t *testing.T) {
+	directory := newTestLDAPServer(t)
+	directory.addUser("alice", "hunter2")
+	store, c := newTestLDAPHeraclesServer(t, directory, func(config *LDAPConfig) {
+		config.Create = false
+	})
+
+	c.expect(postTestLogin(c, "alice", "hunter2"), http.StatusBadRequest)
+	if _, err := store.GetUserByUsername("alice"); err == nil {
+		t.Fatal("user was created with ldap.create off")
+	}
+}
+
+func TestLDAPLinksOnlyWhenEnabled(t *testing.T) {
+	for _, link := range []bool{false, true} {
+		directory := newTestLDAPServer(t)
+		directory.addUser("bob", "directory")
+		store, c := newTestLDAPHeraclesServer(t, directory, func(config *LDAPConfig) {
+			config.Link = link
+		})
+
+		_, err := store.CreateUser("bob", "local", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !link {
+			c.expect(postTestLogin(c, "bob", "directory"), http.StatusBadRequest)
+
+			user, _ := store.GetUserByUsername("bob")
+			if user.Flags.Has(db.USER_FLAG_LDAP) {
+				t.Fatal("user was linked with ldap.link off")
+			}
+
+			// The local password keeps working
+			c.expect(postTestLogin(c, "bob", "local"), http.StatusNoContent)
+			continue
+		}
+
+		c.expect(postTestLogin(c, "bob", "directory"), http.StatusNoContent)
+
+		user, _ := store.GetUserByUsername("bob")
+		if !user.Flags.Has(db.USER_FLAG_LDAP) {
+			t.Fatal("user was not linked with ldap.link on")
+		}
+	}
+}
+
+func TestLDAPUserFilterIsEscaped(t *testing.T) {
+	directory := newTestLDAPServer(t)
+	directory.addUser("alice", "hunter2")
+	_, c := newTestLDAPHeraclesServer(t, directory, nil)
+
+	c.expect(postTestLogin(c, "*", "hunter2"), http.StatusBadRequest)
+	c.expect(postTestLogin(c, "nobody)(uid=*", "hunter2"), http.StatusBadRequest)
+
+	filters := directory.searchedFilters()
+	expected := []string{
+		`(&(objectClass=person)(uid=\2a))`,
+		`(&(objectClass=person)(uid=nobody\29\28uid=\2a))`,
+	}
+	if strings.Join(filters, " ") != strings.Join(expected, " ") {
+		t.Fatalf("searched with filters %v", filters)
+	}
+}
+
+func TestLDAPSyncsRealmGrants(t *testing.T) {
+	const (
+		opsGroup = "cn=ops,ou=groups,dc=test"
+		devGroup = "cn=dev,ou=groups,dc=test"
+	)
+
+	directory := newTestLDAPServer(t)
+	directory.addUser("alice", "hunter2", "CN=Ops,ou=groups,dc=test", devGroup)
+	store, c := newTestLDAPHeraclesServer(t, directory, func(config *LDAPConfig) {
+		config.Groups = map[string][]string{
+			opsGroup: {"ops", "unknown"},
+			devGroup: {"dev", "shared"},
+		}
+	})
+
+	realms := make(map[string]*db.Realm)
+	for _, name := range []string{"ops", "dev", "shared", "manual"} {
+		realm, err := store.CreateRealm(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		realms[name] = realm
+	}
+
+	getRealmGrants := func(user *db.User) map[string]*string {
+		grants, err := store.GetUserRealmGrantsByUserId(user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := make(map[string]*string)
+		for _, grant := range grants {
+			realm, _ := store.GetRealmById(grant.RealmId)
+			result[realm.Name] = grant.LDAPGroup
+		}
+		return result
+	}
+
+	c.expect(postTestLogin(c, "alice", "hunter2"), http.StatusNoContent)
+	user, _ := store.GetUserByUsername("alice")
+
+	grants := getRealmGrants(user)
+	if len(grants) != 3 || grants["ops"] == nil || grants["dev"] == nil || *grants["dev"] != devGroup || grants["shared"] == nil {
+		t.Fatalf("unexpected grants after first login %v", grants)
+	}
+
+	// Grants made by hand are never removed, even for realms a group maps to
+	err := store.DeleteUserRealmGrant(&db.UserRealmGrant{UserId: user.Id, RealmId: realms["shared"].Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"shared", "manual"} {
+		_, err = store.CreateUserRealmGrant(user.Id, realms[name].Id, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Leaving the dev group removes the grants it gave
+	directory.addUser("alice", "hunter2", opsGroup)
+	c.expect(c.get("/logout", nil), http.StatusFound)
+	c.expect(postTestLogin(c, "alice", "hunter2"), http.StatusNoContent)
+
+	grants = getRealmGrants(user)
+	if len(grants) != 3 || grants["ops"] == nil || grants["shared"] != nil || grants["manual"] != nil {
+		t.Fatalf("unexpected grants after leaving a group %v", grants)
+	}
+
+	entries, _ := store.GetRecentAuditLogEntries(100)
+	revoked := false
+	for _, entry := range entries {
+		if entry.Action == "user.ldap_revoke" && entry.Data["group"] == devGroup {
+			revoked = true
+		}
+	}
+	if !revoked {
+		t.Fatal("removing the grant was not audited")
+	}
+}
@@ -0,0 +1,163 @@
+package heracles
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/alioygur/gores"
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+// The second factors a user must complete one of after a password login
+type secondFactors struct {
+	TOTP     *db.UserTOTP
+	WebAuthn bool
+}
+
+func (f *secondFactors) Required() bool {
+	return f.TOTP != nil || f.WebAuthn
+}
+
+func (s *Server) getUserSecondFactors(user *db.User) (*secondFactors, error) {
+	userTOTP, err := s.getUserTOTP(user)
+	if err != nil {
+		return nil, err
+	}
+
+	factors := &secondFactors{
+		TOTP: userTOTP,
+	}
+
+	// Security keys are only required as a second factor when configured to be
+	if s.webAuthn != nil && s.config.WebAuthn.RequireSecondFactor {
+		credentials, err := s.store.GetUserWebAuthnCredentialsByUserId(user.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		factors.WebAuthn = len(credentials) > 0
+	}
+
+	return factors, nil
+}
+
+func (s *Server) PostIdentityTOTPRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	existing, err := s.getUserTOTP(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	} else if existing != nil {
+		gores.Error(w, http.StatusConflict, "TOTP is already enabled")
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateUserTOTP(user.Id, secret)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"secret": secret,
+		"uri":    s.getTOTPProvisioningURI(secret, user.Username),
+	})
+}
+
+type TOTPCodePayload struct {
+	Code string `json:"code" schema:"code"`
+}
+
+func (s *Server) PostIdentityTOTPConfirmRoute(w http.ResponseWriter, r *http.Request) {
+	var payload TOTPCodePayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	user := getCurrentUser(r)
+
+	userTOTP, err := s.store.GetUserTOTPByUserId(user.Id)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusBadRequest, "TOTP enrollment has not been started")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	if userTOTP.Confirmed {
+		gores.Error(w, http.StatusConflict, "TOTP is already enabled")
+		return
+	}
+
+	ok, err := s.acceptTOTPCode(userTOTP, payload.Code)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	} else if !ok {
+		gores.Error(w, http.StatusBadRequest, "Bad code")
+		return
+	}
+
+	err = s.store.ConfirmUserTOTP(userTOTP)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.totp_enable", user, nil)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+func (s *Server) DeleteIdentityTOTPRoute(w http.ResponseWriter, r *http.Request) {
+	var payload TOTPCodePayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	user := getCurrentUser(r)
+
+	userTOTP, err := s.getUserTOTP(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	} else if userTOTP == nil {
+		gores.Error(w, http.StatusNotFound, "TOTP is not enabled")
+		return
+	}
+
+	ok, err := s.acceptTOTPCode(userTOTP, payload.Code)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	} else if !ok {
+		gores.Error(w, http.StatusBadRequest, "Bad code")
+		return
+	}
+
+	err = s.store.DeleteUserTOTP(userTOTP)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.totp_disable", user, nil)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
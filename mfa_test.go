@@ -0,0 +1,144 @@
+package heracles
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the code for the given secret at the period offset from now
+func getTestTOTPCode(t *testing.T, secret string, offset int64) string {
+	secretRaw, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return generateTOTPCode(secretRaw, uint64(time.Now().Unix()/totpPeriod+offset))
+}
+
+// Enrolls the logged in user in TOTP, returning their secret
+func enrollTestTOTP(t *testing.T, c *testClient) string {
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	c.expect(c.send("POST", "/api/identity/mfa/totp", nil), http.StatusOK, &enrollment)
+	c.expect(c.send("POST", "/api/identity/mfa/totp/confirm", map[string]string{"code": "000000"}), http.StatusBadRequest)
+	c.expect(c.send("POST", "/api/identity/mfa/totp/confirm", map[string]string{
+		"code": getTestTOTPCode(t, enrollment.Secret, -1),
+	}), http.StatusNoContent)
+	return enrollment.Secret
+}
+
+func TestTOTPLogin(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	_, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := enrollTestTOTP(t, newLoggedInClient(t, ts, "user", "password"))
+
+	c := newTestClient(t, ts)
+	res := c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}})
+	c.expect(res, http.StatusFound)
+	if res.Header.Get("Location") != "/login/mfa" {
+		t.Fatalf("redirected to %v", res.Header.Get("Location"))
+	}
+
+	c.expect(c.get("/api/identity", nil), http.StatusUnauthorized)
+	c.expect(c.postForm("/login/totp", url.Values{"code": {"000000"}}), http.StatusBadRequest)
+	c.expect(c.postForm("/login/totp", url.Values{"code": {getTestTOTPCode(t, secret, 0)}}), http.StatusNoContent)
+	c.expect(c.get("/api/identity", nil), http.StatusOK)
+}
+
+func TestTOTPCodesCannotBeReused(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	_, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := enrollTestTOTP(t, newLoggedInClient(t, ts, "user", "password"))
+
+	// The code enrollment was confirmed with is spent
+	c := newTestClient(t, ts)
+	c.expect(c.postForm("/login", url.Values{
+		"username": {"user"},
+		"password": {"password"},
+		"code":     {getTestTOTPCode(t, secret, -1)},
+	}), http.StatusBadRequest)
+
+	code := getTestTOTPCode(t, secret, 0)
+	c.expect(c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}, "code": {code}}), http.StatusNoContent)
+
+	// As is any code used to log in, whichever step of the login it is given to
+	c = newTestClient(t, ts)
+	c.expect(c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}, "code": {code}}), http.StatusBadRequest)
+	c.expect(c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}}), http.StatusFound)
+	c.expect(c.postForm("/login/totp", url.Values{"code": {code}}), http.StatusBadRequest)
+	c.expect(c.get("/api/identity", nil), http.StatusUnauthorized)
+}
+
+func TestTOTPLoginAbandonedAfterFailures(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	_, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := enrollTestTOTP(t, newLoggedInClient(t, ts, "user", "password"))
+
+	c := newTestClient(t, ts)
+	c.expect(c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}}), http.StatusFound)
+	for i := 0; i < secondFactorMaxFailures; i++ {
+		c.expect(c.postForm("/login/totp", url.Values{"code": {"000000"}}), http.StatusBadRequest)
+	}
+
+	// The pending login is gone, even with the right code
+	res := c.postForm("/login/totp", url.Values{"code": {getTestTOTPCode(t, secret, 0)}})
+	c.expect(res, http.StatusFound)
+	if res.Header.Get("Location") != "/login" {
+		t.Fatalf("redirected to %v", res.Header.Get("Location"))
+	}
+	c.expect(c.get("/api/identity", nil), http.StatusUnauthorized)
+}
+
+func TestTOTPLoginAcrossReplicas(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+	_, replica := newTestReplica(t, store, nil)
+
+	_, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := enrollTestTOTP(t, newLoggedInClient(t, ts, "user", "password"))
+
+	// Cookies aren't scoped by port, so the client carries its session over
+	//  as it switches server.
+	c := newTestClient(t, ts)
+	c.expect(c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}}), http.StatusFound)
+
+	c.base = replica.URL
+	c.expect(c.postForm("/login/totp", url.Values{"code": {"000000"}}), http.StatusBadRequest)
+
+	// Failures count towards the same limit wherever they land
+	for i := 1; i < secondFactorMaxFailures; i++ {
+		if i%2 == 0 {
+			c.base = ts.URL
+		} else {
+			c.base = replica.URL
+		}
+		c.expect(c.postForm("/login/totp", url.Values{"code": {"000000"}}), http.StatusBadRequest)
+	}
+	c.expect(c.postForm("/login/totp", url.Values{"code": {getTestTOTPCode(t, secret, 0)}}), http.StatusFound)
+
+	c.expect(c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}}), http.StatusFound)
+	c.base = ts.URL
+	c.expect(c.postForm("/login/totp", url.Values{"code": {getTestTOTPCode(t, secret, 0)}}), http.StatusNoContent)
+	c.expect(c.get("/api/identity", nil), http.StatusOK)
+}
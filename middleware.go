@@ -3,7 +3,7 @@ package heracles
 import (
 	"context"
 	"database/sql"
-	"encoding/base64"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -16,102 +16,153 @@ func getCurrentRealm(r *http.Request) *db.Realm {
 	return r.Context().Value("realm").(*db.Realm)
 }
 
+func getCurrentGroup(r *http.Request) *db.Group {
+	return r.Context().Value("group").(*db.Group)
+}
+
+func getCurrentRealmGrant(r *http.Request) *db.UserRealmGrant {
+	return r.Context().Value("realmGrant").(*db.UserRealmGrant)
+}
+
 func getCurrentUserToken(r *http.Request) *db.UserToken {
 	return r.Context().Value("userToken").(*db.UserToken)
 }
 
+// Returns the user targeted by an admin route, see RequireUserMiddleware
+func getTargetUser(r *http.Request) *db.User {
+	return r.Context().Value("user").(*db.User)
+}
+
 func getCurrentUser(r *http.Request) *db.User {
 	return r.Context().Value("authuser").(*db.User)
 }
 
-func findRequestUserViaCookie(r *http.Request) (*db.User, error) {
+// Returns the token the current request was authenticated with, or nil if it
+// was made with a session or password.
+func getCurrentAuthToken(r *http.Request) *db.UserToken {
+	token, _ := r.Context().Value("authtoken").(*db.UserToken)
+	return token
+}
+
+func (s *Server) findRequestUserViaCookie(r *http.Request) (*db.User, error) {
 	authCookie, err := r.Cookie("heracles-auth")
 	if err != nil {
 		return nil, err
 	}
 
-	decodedAuthSecret, err := base64.RawURLEncoding.DecodeString(authCookie.Value)
+	user, err := s.findUserBySessionToken(r, authCookie.Value)
 	if err != nil {
 		return nil, err
+	} else if user.IsDisabled() {
+		return nil, ErrUserDisabled
 	}
 
-	return db.GetUserByAuthSecret(decodedAuthSecret)
+	return user, nil
 }
 
-func findRequestUserViaBasicAuth(r *http.Request, isAPI bool) (*db.User, error) {
+func (s *Server) findRequestUserViaBasicAuth(r *http.Request, isAPI bool) (*db.User, *db.UserToken, error) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		return nil, ErrNoUser
+		return nil, nil, ErrNoUser
+	}
+
+	// Check token first because its actually cheaper than a password check
+	user, err := s.store.GetUserByUsername(username)
+	if err == nil {
+		tokenUser, token, err := s.findUserByToken(r, password, isAPI)
+		if err == nil && tokenUser.Id == user.Id {
+			return user, token, nil
+		}
 	}
 
-	user, err := db.GetUserByUsername(username)
+	user, _, err = s.authenticate(username, password)
 	if err != nil {
-		return nil, err
+		return nil, nil, ErrNoUser
 	}
 
-	// Check token first because its actually cheaper than a bcrypt check
-	tokenUser, err := db.GetUserByToken(password, isAPI)
-	if err == nil && tokenUser.Id == user.Id {
-		return user, nil
-	} else if user.CheckPassword(password) == nil {
-		return user, nil
+	// Users with a second factor enabled must authenticate with a token, a
+	//  raw password on its own is not enough.
+	factors, err := s.getUserSecondFactors(user)
+	if err != nil || factors.Required() {
+		return nil, nil, ErrNoUser
 	}
 
-	return nil, ErrNoUser
+	return user, nil, nil
 }
 
-func findRequestUserViaAuthHeader(r *http.Request, isAPI bool) (*db.User, error) {
+func (s *Server) findRequestUserViaAuthHeader(r *http.Request, isAPI bool) (*db.User, *db.UserToken, error) {
 	token := r.Header.Get("Authorization")
 	if token == "" {
-		return nil, ErrNoUser
+		return nil, nil, ErrNoUser
 	}
 
-	user, err := db.GetUserByToken(token, isAPI)
+	user, userToken, err := s.findUserByToken(r, token, isAPI)
 	if err == nil {
-		return user, nil
-	}
-
-	decodedAuthSecret, err := base64.RawURLEncoding.DecodeString(token)
-	if err != nil {
-		return nil, err
+		return user, userToken, nil
 	}
 
 	// TODO: eventually this should be tokens
-	return db.GetUserByAuthSecret(decodedAuthSecret)
+	user, err = s.findUserBySessionToken(r, token)
+	return user, nil, err
 }
 
-func findRequestUser(r *http.Request, isAPI bool) (*db.User, error) {
-	user, err := findRequestUserViaCookie(r)
+// Returns the user making the request, along with the token they
+// authenticated with if any.
+func (s *Server) findRequestUser(r *http.Request, isAPI bool) (*db.User, *db.UserToken, error) {
+	user, err := s.findRequestUserViaCookie(r)
 	if err == nil {
-		return user, nil
+		return user, nil, nil
 	}
 
-	user, err = findRequestUserViaBasicAuth(r, isAPI)
-	if err == nil {
-		return user, nil
+	user, token, err := s.findRequestUserViaBasicAuth(r, isAPI)
+	if err == nil && !user.IsDisabled() {
+		return user, token, nil
+	}
+
+	user, token, err = s.findRequestUserViaAuthHeader(r, isAPI)
+	if err == nil && !user.IsDisabled() {
+		return user, token, nil
 	}
 
-	user, err = findRequestUserViaAuthHeader(r, isAPI)
+	user, err = s.findRequestUserViaClientCert(r)
 	if err == nil {
-		return user, nil
+		return user, nil, nil
 	}
 
-	return nil, ErrNoUser
+	return nil, nil, ErrNoUser
 }
 
-func RequireAuthMiddleware(next http.Handler) http.Handler {
+func (s *Server) RequireAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, err := findRequestUser(r, true)
+		user, token, err := s.findRequestUser(r, true)
 		if err != nil {
 			gores.Error(w, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
 
-		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "authuser", user)))
+		ctx := context.WithValue(r.Context(), "authuser", user)
+		ctx = context.WithValue(ctx, "authtoken", token)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func RequireAdminMiddleware(next http.Handler) http.Handler {
+// Rejects requests made with a token which lacks the given scope
+func (s *Server) RequireTokenScopeMiddleware(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := getCurrentAuthToken(r)
+			readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+			if token != nil && !token.HasScope(scope, readOnly) {
+				gores.Error(w, http.StatusForbidden, fmt.Sprintf("Token is missing the %v scope", scope))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) RequireAdminMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := getCurrentUser(r)
 		if !user.IsAdmin() {
@@ -123,7 +174,7 @@ func RequireAdminMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func RequireUserTokenMiddleware(next http.Handler) http.Handler {
+func (s *Server) RequireUserTokenMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tokenIdRaw := chi.URLParam(r, "tokenId")
 
@@ -133,8 +184,15 @@ func RequireUserTokenMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		userToken, err := db.GetUserTokenById(int64(tokenId))
-		if err == sql.ErrNoRows {
+		// Tokens belonging to other users are hidden from everyone but admins,
+		//  who when using a token also need it to have the admin scope.
+		user := getCurrentUser(r)
+		authToken := getCurrentAuthToken(r)
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+		canAccessOthers := user.IsAdmin() && (authToken == nil || authToken.HasScope(db.USER_TOKEN_SCOPE_ADMIN, readOnly))
+
+		userToken, err := s.store.GetUserTokenById(int64(tokenId))
+		if err == sql.ErrNoRows || (err == nil && userToken.UserId != user.Id && !canAccessOthers) {
 			gores.Error(w, http.StatusNotFound, "Not Found")
 			return
 		} else if err != nil {
@@ -142,11 +200,17 @@ func RequireUserTokenMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// A restricted token can't be used to take over (e.g. by resetting) a
+		//  token with more access than it has.
+		if !s.checkTokenCovers(w, authToken, userToken.Realms, userToken.Scopes) {
+			return
+		}
+
 		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "userToken", userToken)))
 	})
 }
 
-func RequireRealmMiddleware(next http.Handler) http.Handler {
+func (s *Server) RequireRealmMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		realmIdRaw := chi.URLParam(r, "realmId")
 
@@ -156,7 +220,7 @@ func RequireRealmMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		realm, err := db.GetRealmById(int64(realmId))
+		realm, err := s.store.GetRealmById(int64(realmId))
 		if err == sql.ErrNoRows {
 			gores.Error(w, http.StatusNotFound, "Not Found")
 			return
@@ -168,3 +232,72 @@ func RequireRealmMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "realm", realm)))
 	})
 }
+
+func (s *Server) RequireUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userIdRaw := chi.URLParam(r, "userId")
+
+		userId, err := strconv.Atoi(userIdRaw)
+		if err != nil {
+			gores.Error(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+
+		user, err := s.store.GetUserById(int64(userId))
+		if err == sql.ErrNoRows {
+			gores.Error(w, http.StatusNotFound, "Not Found")
+			return
+		} else if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
+	})
+}
+
+func (s *Server) RequireRealmGrantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userIdRaw := chi.URLParam(r, "userId")
+
+		userId, err := strconv.Atoi(userIdRaw)
+		if err != nil {
+			gores.Error(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+
+		realmGrant, err := s.store.GetUserRealmGrant(int64(userId), getCurrentRealm(r).Id)
+		if err == sql.ErrNoRows {
+			gores.Error(w, http.StatusNotFound, "Not Found")
+			return
+		} else if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "realmGrant", realmGrant)))
+	})
+}
+
+func (s *Server) RequireGroupMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		groupIdRaw := chi.URLParam(r, "groupId")
+
+		groupId, err := strconv.Atoi(groupIdRaw)
+		if err != nil {
+			gores.Error(w, http.StatusBadRequest, "Invalid group ID")
+			return
+		}
+
+		group, err := s.store.GetGroupById(int64(groupId))
+		if err == sql.ErrNoRows {
+			gores.Error(w, http.StatusNotFound, "Not Found")
+			return
+		} else if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "group", group)))
+	})
+}
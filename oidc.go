@@ -0,0 +1,678 @@
+package heracles
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/go-chi/chi"
+)
+
+var (
+	ErrInvalidJWT = errors.New("Invalid or expired JWT")
+)
+
+// How long an authorization code may be exchanged for tokens
+const oidcCodeTimeout = time.Minute
+
+// How long issued ID and access tokens are valid for
+const oidcTokenTimeout = time.Hour
+
+// Values of the `token_use` claim, which tells our ID and access tokens apart
+const (
+	oidcTokenUseID     = "id"
+	oidcTokenUseAccess = "access"
+)
+
+// Loads (or generates) the key used to sign tokens. The key is required, as a
+// key generated on start would invalidate all issued tokens on restart and
+// differ between replicas.
+func (s *Server) initializeOIDC() error {
+	s.oidcIssuer = strings.TrimSuffix(s.config.OIDC.Issuer, "/")
+	if s.oidcIssuer == "" {
+		return errors.New("oidc.issuer is required when OpenID Connect is enabled")
+	}
+
+	if s.config.OIDC.SigningKey == "" {
+		return errors.New("oidc.signing_key is required when OpenID Connect is enabled")
+	}
+
+	var err error
+	s.oidcSigningKey, err = loadOrCreateSigningKey(s.config.OIDC.SigningKey)
+	if err != nil {
+		return err
+	}
+
+	keyHash := sha256.Sum256(s.oidcSigningKey.PublicKey.N.Bytes())
+	s.oidcKeyId = base64.RawURLEncoding.EncodeToString(keyHash[:8])
+	return nil
+}
+
+func loadOrCreateSigningKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("[OIDC] generating new signing key at %v", path)
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+
+		data = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		return key, ioutil.WriteFile(path, data, 0600)
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %v", path)
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Signing key in %v is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// Signs the given claims as an RS256 JWT
+func (s *Server) signJWT(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": s.oidcKeyId,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.oidcSigningKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verifies a JWT issued by us, returning its claims if it has not expired
+func (s *Server) verifyJWT(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWT
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(&s.oidcSigningKey.PublicKey, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Now().Unix() > int64(exp) {
+		return nil, ErrInvalidJWT
+	}
+
+	if claims["iss"] != s.oidcIssuer {
+		return nil, ErrInvalidJWT
+	}
+
+	return claims, nil
+}
+
+// Stores the authorization under a newly generated code, which is returned
+func (s *Server) createOIDCAuthorization(authorization *db.OIDCAuthorization) (string, error) {
+	codeRaw := make([]byte, 32)
+	_, err := rand.Read(codeRaw)
+	if err != nil {
+		return "", err
+	}
+
+	// Drop any codes which were never exchanged
+	err = s.store.DeleteExpiredOIDCAuthorizations()
+	if err != nil {
+		return "", err
+	}
+
+	authorization.Code = base64.RawURLEncoding.EncodeToString(codeRaw)
+	authorization.ExpiresAt = time.Now().Add(oidcCodeTimeout).Unix()
+	return authorization.Code, s.store.CreateOIDCAuthorization(authorization)
+}
+
+func verifyPKCE(authorization *db.OIDCAuthorization, verifier string) bool {
+	if authorization.CodeChallenge == "" {
+		return verifier == ""
+	}
+
+	expected := verifier
+	if authorization.CodeChallengeMethod == "S256" {
+		hash := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(hash[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(authorization.CodeChallenge)) == 1
+}
+
+// Returns the grant giving the user access to the clients realm, including
+// grants inherited from parent realms.
+func (s *Server) getOIDCClientGrant(userId int64, client *db.OIDCClient) (*db.UserRealmGrant, error) {
+	realm, err := s.store.GetRealmById(client.RealmId)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.store.GetUserRealmGrantByRealmName(userId, realm.Name)
+}
+
+// Returns the username presented to the client, preferring the alias on the
+// users grant for the clients realm.
+func getOIDCUsername(user *db.User, grant *db.UserRealmGrant) string {
+	if grant.Alias != nil {
+		return *grant.Alias
+	}
+	return user.Username
+}
+
+func hasScope(scope, name string) bool {
+	for _, part := range strings.Fields(scope) {
+		if part == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) GetOIDCDiscoveryRoute(w http.ResponseWriter, r *http.Request) {
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.oidcIssuer,
+		"authorization_endpoint":                s.oidcIssuer + "/oidc/authorize",
+		"token_endpoint":                        s.oidcIssuer + "/oidc/token",
+		"userinfo_endpoint":                     s.oidcIssuer + "/oidc/userinfo",
+		"jwks_uri":                              s.oidcIssuer + "/oidc/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "token_use"},
+	})
+}
+
+func (s *Server) GetOIDCJWKSRoute(w http.ResponseWriter, r *http.Request) {
+	publicKey := s.oidcSigningKey.PublicKey
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": s.oidcKeyId,
+				"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			},
+		},
+	})
+}
+
+// Redirects back to the client with the given OAuth2 error
+func redirectOIDCError(w http.ResponseWriter, r *http.Request, redirectURI, state, code string) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Bad Redirect URL")
+		return
+	}
+
+	query := target.Query()
+	query.Set("error", code)
+	if state != "" {
+		query.Set("state", state)
+	}
+	target.RawQuery = query.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (s *Server) GetOIDCAuthorizeRoute(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	client, err := s.store.GetOIDCClientById(query.Get("client_id"))
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusBadRequest, "Unknown client")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	// Until the redirect URI is verified errors must not be sent back to it
+	redirectURI := query.Get("redirect_uri")
+	if !client.HasRedirectURI(redirectURI) {
+		gores.Error(w, http.StatusBadRequest, "Invalid redirect_uri")
+		return
+	}
+
+	state := query.Get("state")
+	if query.Get("response_type") != "code" {
+		redirectOIDCError(w, r, redirectURI, state, "unsupported_response_type")
+		return
+	}
+
+	scope := query.Get("scope")
+	if !hasScope(scope, "openid") {
+		redirectOIDCError(w, r, redirectURI, state, "invalid_scope")
+		return
+	}
+
+	codeChallenge := query.Get("code_challenge")
+	codeChallengeMethod := query.Get("code_challenge_method")
+	if codeChallengeMethod == "" {
+		codeChallengeMethod = "plain"
+	}
+
+	if codeChallengeMethod != "S256" && codeChallengeMethod != "plain" {
+		redirectOIDCError(w, r, redirectURI, state, "invalid_request")
+		return
+	} else if codeChallenge == "" && client.IsPublic() {
+		redirectOIDCError(w, r, redirectURI, state, "invalid_request")
+		return
+	}
+
+	user, err := s.findRequestUserViaCookie(r)
+	var session *db.Session
+	if err == nil {
+		session, err = s.findRequestSession(r)
+	}
+	if err != nil {
+		http.Redirect(w, r, "/login?"+url.Values{"r": {r.URL.String()}}.Encode(), http.StatusFound)
+		return
+	}
+
+	grant, err := s.getOIDCClientGrant(user.Id, client)
+	if err == sql.ErrNoRows {
+		redirectOIDCError(w, r, redirectURI, state, "access_denied")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	code, err := s.createOIDCAuthorization(&db.OIDCAuthorization{
+		ClientId:            client.Id,
+		UserId:              grant.UserId,
+		RedirectURI:         redirectURI,
+		Scope:               scope,
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: codeChallengeMethod,
+		AuthTime:            session.CreatedAt,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.oidc_authorize", user, map[string]interface{}{
+		"client": client.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	target, _ := url.Parse(redirectURI)
+	targetQuery := target.Query()
+	targetQuery.Set("code", code)
+	if state != "" {
+		targetQuery.Set("state", state)
+	}
+	target.RawQuery = targetQuery.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func reportOIDCTokenError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Cache-Control", "no-store")
+	gores.JSON(w, status, map[string]string{
+		"error": code,
+	})
+}
+
+func (s *Server) PostOIDCTokenRoute(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		reportOIDCTokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		reportOIDCTokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	clientId, clientSecret, ok := r.BasicAuth()
+	if ok {
+		// Credentials in the Authorization header are form encoded
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := s.store.GetOIDCClientById(clientId)
+	if err == sql.ErrNoRows {
+		reportOIDCTokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	if !client.IsPublic() && !client.CheckSecret(clientSecret) {
+		reportOIDCTokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	authorization, err := s.store.TakeOIDCAuthorization(r.PostForm.Get("code"))
+	if err != nil && err != sql.ErrNoRows {
+		reportInternalError(w, err)
+		return
+	} else if err != nil || authorization.ClientId != client.Id || authorization.RedirectURI != r.PostForm.Get("redirect_uri") {
+		reportOIDCTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	if !verifyPKCE(authorization, r.PostForm.Get("code_verifier")) {
+		reportOIDCTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	user, err := s.store.GetUserById(authorization.UserId)
+	if err == sql.ErrNoRows || (err == nil && user.IsDisabled()) {
+		reportOIDCTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	// The grant may have been revoked since the code was issued
+	grant, err := s.getOIDCClientGrant(user.Id, client)
+	if err == sql.ErrNoRows {
+		reportOIDCTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":       s.oidcIssuer,
+		"sub":       strconv.FormatInt(user.Id, 10),
+		"aud":       client.Id,
+		"iat":       now.Unix(),
+		"exp":       now.Add(oidcTokenTimeout).Unix(),
+		"auth_time": authorization.AuthTime,
+		"token_use": oidcTokenUseID,
+	}
+
+	if hasScope(authorization.Scope, "profile") {
+		claims["preferred_username"] = getOIDCUsername(user, grant)
+	}
+
+	// Access tokens are meant for us (the userinfo endpoint) rather than the
+	//  client, which an ID token is.
+	accessToken, err := s.signJWT(map[string]interface{}{
+		"iss":       claims["iss"],
+		"sub":       claims["sub"],
+		"aud":       s.oidcIssuer,
+		"client_id": client.Id,
+		"iat":       claims["iat"],
+		"exp":       claims["exp"],
+		"scope":     authorization.Scope,
+		"token_use": oidcTokenUseAccess,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	if authorization.Nonce != "" {
+		claims["nonce"] = authorization.Nonce
+	}
+
+	idToken, err := s.signJWT(claims)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(oidcTokenTimeout.Seconds()),
+		"id_token":     idToken,
+		"scope":        authorization.Scope,
+	})
+}
+
+func (s *Server) GetOIDCUserInfoRoute(w http.ResponseWriter, r *http.Request) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		gores.Error(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// ID tokens are signed by the same key, but must not be accepted here
+	claims, err := s.verifyJWT(strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil || claims["token_use"] != oidcTokenUseAccess || claims["aud"] != s.oidcIssuer {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		gores.Error(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	clientId, _ := claims["client_id"].(string)
+	subject, _ := claims["sub"].(string)
+	scope, _ := claims["scope"].(string)
+
+	client, err := s.store.GetOIDCClientById(clientId)
+	if err != nil {
+		gores.Error(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	userId, err := strconv.ParseInt(subject, 10, 64)
+	if err != nil {
+		gores.Error(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	user, err := s.store.GetUserById(userId)
+	if err != nil || user.IsDisabled() {
+		gores.Error(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	grant, err := s.getOIDCClientGrant(user.Id, client)
+	if err != nil {
+		gores.Error(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	info := map[string]interface{}{
+		"sub": subject,
+	}
+	if hasScope(scope, "profile") {
+		info["preferred_username"] = getOIDCUsername(user, grant)
+	}
+
+	gores.JSON(w, http.StatusOK, info)
+}
+
+type CreateOIDCClientPayload struct {
+	Name         string   `json:"name" schema:"name"`
+	RealmId      int64    `json:"realm_id" schema:"realm_id"`
+	RedirectURIs []string `json:"redirect_uris" schema:"redirect_uris"`
+	Public       bool     `json:"public" schema:"public"`
+}
+
+func (s *Server) GetOIDCClientsRoute(w http.ResponseWriter, r *http.Request) {
+	clients, err := s.store.GetOIDCClients()
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"clients": clients,
+	})
+}
+
+func (s *Server) PostOIDCClientsRoute(w http.ResponseWriter, r *http.Request) {
+	var payload CreateOIDCClientPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	if payload.Name == "" {
+		gores.Error(w, http.StatusBadRequest, "name is required")
+		return
+	} else if len(payload.RedirectURIs) == 0 {
+		gores.Error(w, http.StatusBadRequest, "redirect_uris is required")
+		return
+	}
+
+	realm, err := s.store.GetRealmById(payload.RealmId)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusBadRequest, "Unknown realm")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	clientId, err := db.GenerateUserTokenContents()
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+	clientId = clientId[:32]
+
+	var clientSecret string
+	if !payload.Public {
+		clientSecret, err = db.GenerateUserTokenContents()
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
+	client, err := s.store.CreateOIDCClient(clientId, payload.Name, clientSecret, realm.Id, payload.RedirectURIs)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("oidc.client_create", getCurrentUser(r), map[string]interface{}{
+		"client": client.Id,
+		"realm":  realm.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	// The secret is only ever returned here, we just keep a hash of it
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"client": client,
+		"secret": clientSecret,
+	})
+}
+
+func (s *Server) DeleteOIDCClientRoute(w http.ResponseWriter, r *http.Request) {
+	client, err := s.store.GetOIDCClientById(chi.URLParam(r, "clientId"))
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.DeleteOIDCClient(client)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("oidc.client_delete", getCurrentUser(r), map[string]interface{}{
+		"client": client.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
@@ -0,0 +1,188 @@
+package heracles
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+const testOIDCRedirectURI = "https://client.test/callback"
+
+// Builds a server with OpenID Connect enabled and a public client for a realm
+// the user "user" has been granted.
+func newTestOIDCServer(t *testing.T) (*Server, *db.MemoryStore, *httptest.Server, *db.OIDCClient) {
+	t.Helper()
+
+	s, store, ts := newTestServer(t, func(config *Config) {
+		config.OIDC.Enabled = true
+		config.OIDC.Issuer = "https://heracles.test"
+		config.OIDC.SigningKey = filepath.Join(t.TempDir(), "oidc.pem")
+	})
+
+	user, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realm, _ := store.CreateRealm("test", nil)
+	_, err = store.CreateUserRealmGrant(user.Id, realm.Id, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := store.CreateOIDCClient("client", "Client", "", realm.Id, []string{testOIDCRedirectURI})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, store, ts, client
+}
+
+func getTestPKCEChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// Authorizes the client for the logged in user, returning the issued code
+func authorizeTestOIDCClient(t *testing.T, c *testClient, client *db.OIDCClient, verifier string) string {
+	t.Helper()
+
+	res := c.get("/oidc/authorize?"+url.Values{
+		"client_id":             {client.Id},
+		"redirect_uri":          {testOIDCRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid profile"},
+		"state":                 {"state"},
+		"nonce":                 {"nonce"},
+		"code_challenge":        {getTestPKCEChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}.Encode(), nil)
+	c.expect(res, http.StatusFound)
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("state") != "state" || location.Query().Get("code") == "" {
+		t.Fatalf("unexpected redirect %v", location)
+	}
+	return location.Query().Get("code")
+}
+
+func exchangeTestOIDCCode(c *testClient, client *db.OIDCClient, code, verifier string) *http.Response {
+	return c.postForm("/oidc/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.Id},
+		"redirect_uri":  {testOIDCRedirectURI},
+		"code":          {code},
+		"code_verifier": {verifier},
+	})
+}
+
+type testOIDCTokens struct {
+	AccessToken string `json:"access_token"`
+	IdToken     string `json:"id_token"`
+}
+
+func TestOIDCCodeFlow(t *testing.T) {
+	s, store, ts, client := newTestOIDCServer(t)
+
+	c := newLoggedInClient(t, ts, "user", "password")
+	user, _ := store.GetUserByUsername("user")
+	sessions, err := store.GetSessionsByUserId(user.Id)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("unexpected sessions %v: %v", sessions, err)
+	}
+
+	// The login happened some time before the client asked for it
+	time.Sleep(time.Second)
+
+	code := authorizeTestOIDCClient(t, c, client, "verifier")
+
+	var tokens testOIDCTokens
+	c.expect(exchangeTestOIDCCode(c, client, code, "verifier"), http.StatusOK, &tokens)
+
+	claims, err := s.verifyJWT(tokens.IdToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["aud"] != client.Id || claims["nonce"] != "nonce" || claims["token_use"] != oidcTokenUseID {
+		t.Fatalf("unexpected ID token claims %v", claims)
+	}
+	if int64(claims["auth_time"].(float64)) != sessions[0].CreatedAt {
+		t.Fatalf("auth_time %v is not the login time %v", claims["auth_time"], sessions[0].CreatedAt)
+	}
+
+	var info map[string]interface{}
+	anonymous := newTestClient(t, ts)
+	anonymous.expect(anonymous.get("/oidc/userinfo", map[string]string{"Authorization": "Bearer " + tokens.AccessToken}), http.StatusOK, &info)
+	if info["preferred_username"] != "user" {
+		t.Fatalf("unexpected userinfo %v", info)
+	}
+
+	// ID tokens are for the client, not for getting at the userinfo
+	anonymous.expect(anonymous.get("/oidc/userinfo", map[string]string{"Authorization": "Bearer " + tokens.IdToken}), http.StatusUnauthorized)
+
+	// Codes can only be exchanged once
+	c.expect(exchangeTestOIDCCode(c, client, code, "verifier"), http.StatusBadRequest)
+}
+
+func TestOIDCCodeRequiresVerifier(t *testing.T) {
+	_, _, ts, client := newTestOIDCServer(t)
+
+	c := newLoggedInClient(t, ts, "user", "password")
+	code := authorizeTestOIDCClient(t, c, client, "verifier")
+
+	c.expect(exchangeTestOIDCCode(c, client, code, "wrong"), http.StatusBadRequest)
+
+	// A failed exchange uses up the code
+	c.expect(exchangeTestOIDCCode(c, client, code, "verifier"), http.StatusBadRequest)
+}
+
+func TestOIDCCodeExpires(t *testing.T) {
+	_, store, ts, client := newTestOIDCServer(t)
+
+	c := newLoggedInClient(t, ts, "user", "password")
+	code := authorizeTestOIDCClient(t, c, client, "verifier")
+
+	authorization, err := store.TakeOIDCAuthorization(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorization.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	err = store.CreateOIDCAuthorization(authorization)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.expect(exchangeTestOIDCCode(c, client, code, "verifier"), http.StatusBadRequest)
+}
+
+func TestOIDCCodeFlowAcrossReplicas(t *testing.T) {
+	s, store, ts, client := newTestOIDCServer(t)
+	replica, replicaTs := newTestReplica(t, store, func(config *Config) {
+		config.OIDC = s.config.OIDC
+	})
+
+	c := newLoggedInClient(t, ts, "user", "password")
+	code := authorizeTestOIDCClient(t, c, client, "verifier")
+
+	// The code is exchanged with, and the token used at, another replica
+	var tokens testOIDCTokens
+	r := newTestClient(t, replicaTs)
+	r.expect(exchangeTestOIDCCode(r, client, code, "verifier"), http.StatusOK, &tokens)
+	r.expect(r.get("/oidc/userinfo", map[string]string{"Authorization": "Bearer " + tokens.AccessToken}), http.StatusOK)
+
+	if replica.oidcKeyId != s.oidcKeyId {
+		t.Fatalf("replicas sign with different keys")
+	}
+
+	// Codes are still only good once across replicas
+	c.expect(exchangeTestOIDCCode(c, client, code, "verifier"), http.StatusBadRequest)
+}
@@ -0,0 +1,557 @@
+package heracles
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/go-chi/chi"
+	"golang.org/x/oauth2"
+)
+
+var ErrUnknownProviderType = errors.New("Unknown login provider type")
+
+// Configuration for a single entry within `auth.providers`
+type LoginProviderConfig struct {
+	// Unique name for the provider, used within URLs and to link identities
+	Name        string `mapstructure:"name"`
+	DisplayName string `mapstructure:"display_name"`
+
+	// One of github, gitlab, google, discord, oidc or oauth2
+	Type string `mapstructure:"type"`
+
+	ClientId     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	RedirectURI  string   `mapstructure:"redirect_uri"`
+	Scopes       []string `mapstructure:"scopes"`
+
+	// The issuer used for OpenID Connect discovery
+	Issuer string `mapstructure:"issuer"`
+
+	// Endpoints for generic OAuth2 providers, these override any discovered ones
+	AuthURL     string `mapstructure:"auth_url"`
+	TokenURL    string `mapstructure:"token_url"`
+	UserInfoURL string `mapstructure:"userinfo_url"`
+
+	// Fields within the user info response identifying the user
+	SubjectField  string `mapstructure:"subject_field"`
+	UsernameField string `mapstructure:"username_field"`
+
+	// Whether users are created on their first login
+	Create bool `mapstructure:"create"`
+}
+
+type loginProvider struct {
+	Name        string
+	DisplayName string
+	create      bool
+
+	settings LoginProviderConfig
+
+	// OpenID Connect discovery happens on first use, and is retried until it
+	//  succeeds, so an unreachable issuer doesn't stop the server starting.
+	endpointsLock sync.Mutex
+	endpoints     *loginProviderEndpoints
+}
+
+// Where and how to authenticate users with a provider
+type loginProviderEndpoints struct {
+	config        *oauth2.Config
+	userInfoURL   string
+	subjectField  string
+	usernameField string
+}
+
+// Presets for well known providers, keyed by type
+var loginProviderPresets = map[string]LoginProviderConfig{
+	"github": {
+		DisplayName:   "GitHub",
+		AuthURL:       "https://github.com/login/oauth/authorize",
+		TokenURL:      "https://github.com/login/oauth/access_token",
+		UserInfoURL:   "https://api.github.com/user",
+		Scopes:        []string{"read:user"},
+		SubjectField:  "id",
+		UsernameField: "login",
+	},
+	"gitlab": {
+		DisplayName: "GitLab",
+		Issuer:      "https://gitlab.com",
+	},
+	"google": {
+		DisplayName:   "Google",
+		Issuer:        "https://accounts.google.com",
+		UsernameField: "email",
+	},
+	"discord": {
+		DisplayName:   "Discord",
+		AuthURL:       authURL,
+		TokenURL:      tokenURL,
+		UserInfoURL:   userEndpoint,
+		Scopes:        []string{"identify"},
+		SubjectField:  "id",
+		UsernameField: "username",
+	},
+	"oidc":   {},
+	"oauth2": {},
+}
+
+type oidcDiscoveryDocument struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+func discoverOIDCEndpoints(issuer string) (*oidcDiscoveryDocument, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	res, err := client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OpenID discovery for %v failed with status %v", issuer, res.StatusCode)
+	}
+
+	var document oidcDiscoveryDocument
+	err = json.NewDecoder(res.Body).Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+
+	return &document, nil
+}
+
+func newLoginProvider(config LoginProviderConfig) (*loginProvider, error) {
+	preset, ok := loginProviderPresets[config.Type]
+	if !ok {
+		return nil, ErrUnknownProviderType
+	}
+
+	// Anything not explicitly configured falls back to the preset
+	if config.DisplayName == "" {
+		config.DisplayName = preset.DisplayName
+	}
+	if config.DisplayName == "" {
+		config.DisplayName = config.Name
+	}
+	if config.Issuer == "" {
+		config.Issuer = preset.Issuer
+	}
+	if config.AuthURL == "" {
+		config.AuthURL = preset.AuthURL
+	}
+	if config.TokenURL == "" {
+		config.TokenURL = preset.TokenURL
+	}
+	if config.UserInfoURL == "" {
+		config.UserInfoURL = preset.UserInfoURL
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = preset.Scopes
+	}
+	if config.SubjectField == "" {
+		config.SubjectField = preset.SubjectField
+	}
+	if config.UsernameField == "" {
+		config.UsernameField = preset.UsernameField
+	}
+
+	if config.Name == "" {
+		return nil, errors.New("Login provider is missing a name")
+	}
+
+	provider := &loginProvider{
+		Name:        config.Name,
+		DisplayName: config.DisplayName,
+		create:      config.Create,
+		settings:    config,
+	}
+
+	// Without discovery any missing endpoints are a configuration error
+	if config.Issuer == "" {
+		endpoints, err := newLoginProviderEndpoints(config, nil)
+		if err != nil {
+			return nil, err
+		}
+		provider.endpoints = endpoints
+	}
+
+	return provider, nil
+}
+
+// Fills in anything not configured for the provider from its discovery
+// document (if any) and the defaults.
+func newLoginProviderEndpoints(config LoginProviderConfig, document *oidcDiscoveryDocument) (*loginProviderEndpoints, error) {
+	if document != nil {
+		if config.AuthURL == "" {
+			config.AuthURL = document.AuthorizationEndpoint
+		}
+		if config.TokenURL == "" {
+			config.TokenURL = document.TokenEndpoint
+		}
+		if config.UserInfoURL == "" {
+			config.UserInfoURL = document.UserInfoEndpoint
+		}
+
+		// Standard OpenID Connect claims
+		if len(config.Scopes) == 0 {
+			config.Scopes = []string{"openid", "profile", "email"}
+		}
+		if config.SubjectField == "" {
+			config.SubjectField = "sub"
+		}
+		if config.UsernameField == "" {
+			config.UsernameField = "preferred_username"
+		}
+	}
+
+	if config.AuthURL == "" || config.TokenURL == "" || config.UserInfoURL == "" {
+		return nil, fmt.Errorf("Login provider %v is missing endpoints", config.Name)
+	}
+
+	if config.SubjectField == "" {
+		config.SubjectField = "id"
+	}
+	if config.UsernameField == "" {
+		config.UsernameField = "username"
+	}
+
+	return &loginProviderEndpoints{
+		config: &oauth2.Config{
+			ClientID:     config.ClientId,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURI,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  config.AuthURL,
+				TokenURL: config.TokenURL,
+			},
+			Scopes: config.Scopes,
+		},
+		userInfoURL:   config.UserInfoURL,
+		subjectField:  config.SubjectField,
+		usernameField: config.UsernameField,
+	}, nil
+}
+
+// Returns the provider's endpoints, running discovery if it hasn't yet succeeded
+func (p *loginProvider) getEndpoints() (*loginProviderEndpoints, error) {
+	p.endpointsLock.Lock()
+	defer p.endpointsLock.Unlock()
+
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+
+	document, err := discoverOIDCEndpoints(p.settings.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := newLoginProviderEndpoints(p.settings, document)
+	if err != nil {
+		return nil, err
+	}
+
+	p.endpoints = endpoints
+	return endpoints, nil
+}
+
+func (s *Server) initializeLoginProviders() error {
+	s.loginProviders = make([]*loginProvider, 0, len(s.config.Auth.Providers))
+	s.loginProvidersByName = make(map[string]*loginProvider)
+	for _, config := range s.config.Auth.Providers {
+		provider, err := newLoginProvider(config)
+		if err != nil {
+			return fmt.Errorf("Failed to configure login provider %v: %v", config.Name, err)
+		}
+
+		s.loginProviders = append(s.loginProviders, provider)
+		s.loginProvidersByName[provider.Name] = provider
+	}
+	return nil
+}
+
+// Fetches the subject and username of the user who authorized the given token
+func (e *loginProviderEndpoints) fetchUserInfo(ctx context.Context, token *oauth2.Token) (string, string, error) {
+	client := e.config.Client(ctx, token)
+	client.Timeout = 10 * time.Second
+
+	req, err := http.NewRequest("GET", e.userInfoURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("User info request failed with status %v", res.StatusCode)
+	}
+
+	var userInfo map[string]interface{}
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber()
+	err = decoder.Decode(&userInfo)
+	if err != nil {
+		return "", "", err
+	}
+
+	subject, ok := userInfo[e.subjectField]
+	if !ok || subject == nil {
+		return "", "", fmt.Errorf("User info is missing the %v field", e.subjectField)
+	}
+
+	username, _ := userInfo[e.usernameField].(string)
+
+	return fmt.Sprintf("%v", subject), username, nil
+}
+
+// Looks up the provider in the URL along with its endpoints, reporting an error
+// to the client if either is unavailable.
+func (s *Server) getRequestLoginProvider(w http.ResponseWriter, r *http.Request) (*loginProvider, *loginProviderEndpoints) {
+	provider, ok := s.loginProvidersByName[chi.URLParam(r, "provider")]
+	if !ok {
+		gores.Error(w, http.StatusNotFound, "Unknown login provider")
+		return nil, nil
+	}
+
+	endpoints, err := provider.getEndpoints()
+	if err != nil {
+		log.Printf("[Providers] failed to discover endpoints for %v: %v", provider.Name, err)
+		gores.Error(w, http.StatusBadGateway, "Login provider is unavailable")
+		return nil, nil
+	}
+
+	return provider, endpoints
+}
+
+func (s *Server) GetLoginProviderRoute(w http.ResponseWriter, r *http.Request) {
+	provider, endpoints := s.getRequestLoginProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Bad Form Data")
+		return
+	}
+
+	redirectURLRaw := r.Form.Get("r")
+	if redirectURLRaw == "" {
+		redirectURLRaw = "/"
+	}
+
+	redirectURL, err := url.Parse(redirectURLRaw)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Bad Redirect URL")
+		return
+	}
+
+	session.Values["r"] = redirectURL.String()
+	session.Values["state"] = randSeq(32)
+	session.Values["provider"] = provider.Name
+	session.Save(r, w)
+
+	url := endpoints.config.AuthCodeURL(session.Values["state"].(string), oauth2.AccessTypeOnline)
+	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+}
+
+func (s *Server) GetLoginProviderCallbackRoute(w http.ResponseWriter, r *http.Request) {
+	provider, endpoints := s.getRequestLoginProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	state := r.FormValue("state")
+	if state == "" || state != session.Values["state"] || provider.Name != session.Values["provider"] {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	// Each state is only good for a single callback
+	delete(session.Values, "state")
+	delete(session.Values, "provider")
+	session.Save(r, w)
+
+	errorMessage := r.FormValue("error")
+	if errorMessage != "" {
+		gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Error: %v", errorMessage))
+		return
+	}
+
+	token, err := endpoints.config.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	subject, username, err := endpoints.fetchUserInfo(r.Context(), token)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	var user *db.User
+
+	identity, err := s.store.GetUserIdentity(provider.Name, subject)
+	if err == sql.ErrNoRows {
+		user, err = s.linkProviderIdentity(r, provider, subject, username)
+		if err == ErrNoUser {
+			gores.Error(w, http.StatusForbidden, "No account is linked to this login")
+			return
+		} else if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	} else {
+		user, err = s.store.GetUserById(identity.UserId)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
+	auditData := map[string]interface{}{
+		"provider": provider.Name,
+		"subject":  subject,
+	}
+	redirectURL, _ := session.Values["r"].(string)
+
+	factors, err := s.getUserSecondFactors(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	if factors.Required() {
+		s.beginSecondFactorLogin(w, r, user, redirectURL, auditData)
+		return
+	}
+
+	s.completeLogin(w, r, user, redirectURL, auditData)
+}
+
+// Links a previously unseen identity to either the currently logged in user or
+// (if enabled for the provider) a newly created user.
+func (s *Server) linkProviderIdentity(r *http.Request, provider *loginProvider, subject, username string) (*db.User, error) {
+	user, err := s.findRequestUserViaCookie(r)
+	if err != nil {
+		if !provider.create || username == "" {
+			return nil, ErrNoUser
+		}
+
+		// Never hand out an existing local account based on a matching name
+		_, err = s.store.GetUserByUsername(username)
+		if err == nil {
+			return nil, ErrNoUser
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		user, err = s.store.CreateUser(username, "", 0, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = s.store.CreateUserIdentity(user.Id, provider.Name, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.identity_link", user, map[string]interface{}{
+		"provider": provider.Name,
+		"subject":  subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *Server) GetIdentityProvidersRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	identities, err := s.store.GetUserIdentitiesByUserId(user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"identities": identities,
+	})
+}
+
+func (s *Server) DeleteIdentityProviderRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+	providerName := chi.URLParam(r, "provider")
+
+	identities, err := s.store.GetUserIdentitiesByUserId(user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	found := false
+	for _, identity := range identities {
+		if identity.Provider != providerName {
+			continue
+		}
+
+		err = s.store.DeleteUserIdentity(&identity)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+
+		_, err = s.store.CreateAuditLogEntry("user.identity_unlink", user, map[string]interface{}{
+			"provider": identity.Provider,
+			"subject":  identity.Subject,
+		})
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+
+		found = true
+	}
+
+	if !found {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	gores.NoContent(w)
+}
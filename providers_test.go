@@ -0,0 +1,181 @@
+package heracles
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+// A minimal OpenID Connect issuer. Codes are the subject of the user logging
+// in, which is handed back as their access token.
+type testIssuer struct {
+	*httptest.Server
+
+	lock        sync.Mutex
+	unavailable bool
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	issuer := &testIssuer{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer.lock.Lock()
+		defer issuer.lock.Unlock()
+
+		if issuer.unavailable {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"userinfo_endpoint":      issuer.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": r.FormValue("code"),
+			"token_type":   "Bearer",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		subject := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		json.NewEncoder(w).Encode(map[string]string{
+			"sub":                subject,
+			"preferred_username": "remote-" + subject,
+		})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (i *testIssuer) setUnavailable(unavailable bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.unavailable = unavailable
+}
+
+func newTestProviderServer(t *testing.T, issuer *testIssuer) (*db.MemoryStore, *httptest.Server) {
+	_, store, ts := newTestServer(t, func(config *Config) {
+		config.Auth.Providers = []LoginProviderConfig{
+			{
+				Name:        "test",
+				Type:        "oidc",
+				ClientId:    "client",
+				RedirectURI: "http://heracles.test/login/oauth/test/callback",
+				Issuer:      issuer.URL,
+				Create:      true,
+			},
+		}
+	})
+	return store, ts
+}
+
+// Starts a login with the test provider, returning the state it was sent with
+func beginTestProviderLogin(t *testing.T, c *testClient) string {
+	t.Helper()
+
+	res := c.get("/login/oauth/test", nil)
+	c.expect(res, http.StatusTemporaryRedirect)
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("state")
+}
+
+func finishTestProviderLogin(c *testClient, state, subject string) *http.Response {
+	return c.get("/login/oauth/test/callback?"+url.Values{"state": {state}, "code": {subject}}.Encode(), nil)
+}
+
+func TestProviderLoginCreatesUser(t *testing.T) {
+	store, ts := newTestProviderServer(t, newTestIssuer(t))
+
+	c := newTestClient(t, ts)
+	state := beginTestProviderLogin(t, c)
+	c.expect(finishTestProviderLogin(c, state, "1234"), http.StatusFound)
+
+	var identity db.User
+	c.expect(c.get("/api/identity", nil), http.StatusOK, &identity)
+	if identity.Username != "remote-1234" {
+		t.Fatalf("logged in as %v", identity.Username)
+	}
+
+	linked, err := store.GetUserIdentity("test", "1234")
+	if err != nil || linked.UserId != identity.Id {
+		t.Fatalf("identity was not linked %+v: %v", linked, err)
+	}
+}
+
+func TestProviderLoginLinksCurrentUser(t *testing.T) {
+	store, ts := newTestProviderServer(t, newTestIssuer(t))
+
+	admin := newLoggedInClient(t, ts, "admin", "admin")
+	state := beginTestProviderLogin(t, admin)
+	admin.expect(finishTestProviderLogin(admin, state, "5678"), http.StatusFound)
+
+	user, _ := store.GetUserByUsername("admin")
+	linked, err := store.GetUserIdentity("test", "5678")
+	if err != nil || linked.UserId != user.Id {
+		t.Fatalf("identity was not linked to the current user %+v: %v", linked, err)
+	}
+
+	// Later logins with the identity are as the linked user
+	c := newTestClient(t, ts)
+	state = beginTestProviderLogin(t, c)
+	c.expect(finishTestProviderLogin(c, state, "5678"), http.StatusFound)
+
+	var identity db.User
+	c.expect(c.get("/api/identity", nil), http.StatusOK, &identity)
+	if identity.Id != user.Id {
+		t.Fatalf("logged in as %v", identity.Username)
+	}
+}
+
+func TestProviderLoginRejectsBadState(t *testing.T) {
+	_, ts := newTestProviderServer(t, newTestIssuer(t))
+
+	c := newTestClient(t, ts)
+	state := beginTestProviderLogin(t, c)
+
+	res := finishTestProviderLogin(c, "wrong", "1234")
+	c.expect(res, http.StatusTemporaryRedirect)
+	if res.Header.Get("Location") != "/" {
+		t.Fatalf("redirected to %v", res.Header.Get("Location"))
+	}
+	c.expect(c.get("/api/identity", nil), http.StatusUnauthorized)
+
+	// States are removed from the session once used
+	c.expect(finishTestProviderLogin(c, state, "1234"), http.StatusFound)
+	c.expect(c.get("/logout", nil), http.StatusFound)
+	c.expect(finishTestProviderLogin(c, state, "1234"), http.StatusTemporaryRedirect)
+	c.expect(c.get("/api/identity", nil), http.StatusUnauthorized)
+}
+
+func TestProviderDiscoveryIsRetried(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.setUnavailable(true)
+
+	// The server starts regardless of the issuer being down
+	_, ts := newTestProviderServer(t, issuer)
+
+	c := newTestClient(t, ts)
+	c.expect(c.get("/login/oauth/test", nil), http.StatusBadGateway)
+
+	issuer.setUnavailable(false)
+	state := beginTestProviderLogin(t, c)
+	c.expect(finishTestProviderLogin(c, state, "1234"), http.StatusFound)
+}
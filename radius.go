@@ -1,25 +1,137 @@
 package heracles
 
 import (
+	"log"
+	"time"
+
 	"github.com/b1naryth1ef/heracles/db"
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
 )
 
-func handleRadiusRequest(w radius.ResponseWriter, r *radius.Request) {
+// How long a RADIUS client has to answer an Access-Challenge
+const radiusChallengeTimeout = 2 * time.Minute
+
+// Stores a challenge for the user, returning the state identifying it
+func (s *Server) createRadiusChallenge(user *db.User, backend string) (string, error) {
+	// Drop any challenges which have gone unanswered
+	err := s.store.DeleteExpiredRadiusChallenges()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := db.RadiusChallenge{
+		State:     randSeq(32),
+		UserId:    user.Id,
+		Backend:   backend,
+		ExpiresAt: time.Now().Add(radiusChallengeTimeout).Unix(),
+	}
+	return challenge.State, s.store.CreateRadiusChallenge(&challenge)
+}
+
+// Handles a RADIUS Access-Request, making the server a radius.Handler. Users
+// with TOTP enabled can either provide their code appended to their password
+// (e.g. `hunter2123456`) or provide their password alone and answer the
+// resulting Access-Challenge with their code.
+func (s *Server) ServeRADIUS(w radius.ResponseWriter, r *radius.Request) {
 	username := rfc2865.UserName_GetString(r.Packet)
 	password := rfc2865.UserPassword_GetString(r.Packet)
 
-	user, err := db.GetUserByUsername(username)
+	// This is a response to a previously issued Access-Challenge
+	state := rfc2865.State_GetString(r.Packet)
+	if state != "" {
+		s.handleRadiusChallengeResponse(w, r, username, state, password)
+		return
+	}
+
+	user, backend, err := s.authenticate(username, password)
+	if err == nil {
+		factors, err := s.getUserSecondFactors(user)
+		if err != nil {
+			w.Write(r.Response(radius.CodeAccessReject))
+			return
+		}
+
+		if factors.TOTP != nil {
+			state, err := s.createRadiusChallenge(user, backend)
+			if err != nil {
+				log.Printf("[RADIUS] failed to create challenge for %v: %v", user.Username, err)
+				w.Write(r.Response(radius.CodeAccessReject))
+				return
+			}
+
+			response := r.Response(radius.CodeAccessChallenge)
+			rfc2865.State_SetString(response, state)
+			rfc2865.ReplyMessage_SetString(response, "Enter your authentication code")
+			w.Write(response)
+			return
+		}
+
+		// RADIUS clients have no way to complete a security key login
+		if factors.Required() {
+			w.Write(r.Response(radius.CodeAccessReject))
+			return
+		}
+
+		s.acceptRadiusRequest(w, r, user, backend)
+		return
+	}
+
+	// The password may have a TOTP code appended to it
+	if len(password) > totpDigits {
+		split := len(password) - totpDigits
+
+		user, backend, err := s.authenticate(username, password[:split])
+		if err == nil {
+			userTOTP, err := s.getUserTOTP(user)
+			if err == nil && userTOTP != nil {
+				ok, err := s.acceptTOTPCode(userTOTP, password[split:])
+				if err == nil && ok {
+					s.acceptRadiusRequest(w, r, user, backend)
+					return
+				}
+			}
+		}
+	}
+
+	w.Write(r.Response(radius.CodeAccessReject))
+}
+
+func (s *Server) handleRadiusChallengeResponse(w radius.ResponseWriter, r *radius.Request, username, state, code string) {
+	challenge, err := s.store.TakeRadiusChallenge(state)
 	if err != nil {
 		w.Write(r.Response(radius.CodeAccessReject))
 		return
 	}
 
-	if user.CheckPassword(password) != nil {
+	user, err := s.store.GetUserById(challenge.UserId)
+	if err != nil || user.Username != username || user.IsDisabled() {
+		w.Write(r.Response(radius.CodeAccessReject))
+		return
+	}
+
+	userTOTP, err := s.getUserTOTP(user)
+	if err != nil || userTOTP == nil {
 		w.Write(r.Response(radius.CodeAccessReject))
 		return
 	}
 
+	ok, err := s.acceptTOTPCode(userTOTP, code)
+	if err != nil || !ok {
+		w.Write(r.Response(radius.CodeAccessReject))
+		return
+	}
+
+	s.acceptRadiusRequest(w, r, user, challenge.Backend)
+}
+
+func (s *Server) acceptRadiusRequest(w radius.ResponseWriter, r *radius.Request, user *db.User, backend string) {
+	_, err := s.store.CreateAuditLogEntry("user.radius_login", user, map[string]interface{}{
+		"backend": backend,
+	})
+	if err != nil {
+		log.Printf("[RADIUS] failed to record audit log entry for %v: %v", user.Username, err)
+	}
+
 	w.Write(r.Response(radius.CodeAccessAccept))
 }
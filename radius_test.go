@@ -0,0 +1,97 @@
+package heracles
+
+import (
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+type testRadiusResponseWriter struct {
+	packet *radius.Packet
+}
+
+func (w *testRadiusResponseWriter) Write(packet *radius.Packet) error {
+	w.packet = packet
+	return nil
+}
+
+// Sends an Access-Request straight to the server's handler, returning the reply
+func sendTestRadiusRequest(t *testing.T, s *Server, username, password, state string) *radius.Packet {
+	t.Helper()
+
+	packet := radius.New(radius.CodeAccessRequest, []byte(s.config.Radius.Secret))
+	rfc2865.UserName_SetString(packet, username)
+	// The encoder reads past the end of short passwords, so give it the room
+	passwordRaw := make([]byte, len(password), 128)
+	copy(passwordRaw, password)
+	rfc2865.UserPassword_Set(packet, passwordRaw)
+	if state != "" {
+		rfc2865.State_SetString(packet, state)
+	}
+
+	var w testRadiusResponseWriter
+	s.ServeRADIUS(&w, &radius.Request{Packet: packet})
+	if w.packet == nil {
+		t.Fatal("no RADIUS response written")
+	}
+	return w.packet
+}
+
+func TestRadiusTOTPCodesCannotBeReused(t *testing.T) {
+	s, store, ts := newTestServer(t, func(config *Config) {
+		config.Radius.Secret = "radius"
+	})
+
+	_, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := enrollTestTOTP(t, newLoggedInClient(t, ts, "user", "password"))
+	code := getTestTOTPCode(t, secret, 0)
+
+	challenge := sendTestRadiusRequest(t, s, "user", "password", "")
+	if challenge.Code != radius.CodeAccessChallenge {
+		t.Fatalf("expected a challenge but got %v", challenge.Code)
+	}
+
+	state := rfc2865.State_GetString(challenge)
+	if response := sendTestRadiusRequest(t, s, "user", code, state); response.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected the code to be accepted but got %v", response.Code)
+	}
+
+	// Neither the challenge nor the code can be used again
+	if response := sendTestRadiusRequest(t, s, "user", code, state); response.Code != radius.CodeAccessReject {
+		t.Fatalf("expected a replayed challenge to be rejected but got %v", response.Code)
+	}
+	if response := sendTestRadiusRequest(t, s, "user", "password"+code, ""); response.Code != radius.CodeAccessReject {
+		t.Fatalf("expected a replayed code to be rejected but got %v", response.Code)
+	}
+}
+
+func TestRadiusChallengeAnsweredByReplica(t *testing.T) {
+	configure := func(config *Config) {
+		config.Radius.Secret = "radius"
+	}
+	s, store, ts := newTestServer(t, configure)
+	replica, _ := newTestReplica(t, store, configure)
+
+	_, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := enrollTestTOTP(t, newLoggedInClient(t, ts, "user", "password"))
+
+	challenge := sendTestRadiusRequest(t, s, "user", "password", "")
+	if challenge.Code != radius.CodeAccessChallenge {
+		t.Fatalf("expected a challenge but got %v", challenge.Code)
+	}
+
+	state := rfc2865.State_GetString(challenge)
+	response := sendTestRadiusRequest(t, replica, "user", getTestTOTPCode(t, secret, 0), state)
+	if response.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected the replica to accept the code but got %v", response.Code)
+	}
+}
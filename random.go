@@ -1,16 +1,24 @@
 package heracles
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"math/big"
 )
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
-// Return a random character sequence of n length
+// Return a random character sequence of n length. This is drawn from
+// crypto/rand as it is used for state which must not be guessable.
 func randSeq(n int) string {
+	max := big.NewInt(int64(len(letters)))
+
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		index, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = letters[index.Int64()]
 	}
 	return string(b)
 }
@@ -1,18 +1,23 @@
 package heracles
 
 import (
+	"context"
+	"database/sql"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/alioygur/gores"
 	"github.com/b1naryth1ef/heracles/db"
 )
 
 type CreateRealmPayload struct {
-	Name string `json:"name" schema:"name"`
+	Name     string `json:"name" schema:"name"`
+	ParentId *int64 `json:"parent_id" schema:"parent_id"`
 }
 
-func GetRealmsRoute(w http.ResponseWriter, r *http.Request) {
-	realms, err := db.GetRealms()
+func (s *Server) GetRealmsRoute(w http.ResponseWriter, r *http.Request) {
+	realms, err := s.store.GetRealms()
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -23,7 +28,7 @@ func GetRealmsRoute(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func PostRealmsRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PostRealmsRoute(w http.ResponseWriter, r *http.Request) {
 	var payload CreateRealmPayload
 	if !readRequestData(w, r, &payload) {
 		return
@@ -34,7 +39,28 @@ func PostRealmsRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	realm, err := db.CreateRealm(payload.Name)
+	if payload.ParentId != nil {
+		_, err := s.store.GetRealmById(*payload.ParentId)
+		if err == sql.ErrNoRows {
+			gores.Error(w, http.StatusBadRequest, "Unknown parent realm")
+			return
+		} else if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
+	realm, err := s.store.CreateRealm(payload.Name, payload.ParentId)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_create", getCurrentUser(r), map[string]interface{}{
+		"realm":  realm.Id,
+		"name":   realm.Name,
+		"parent": realm.ParentId,
+	})
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -43,12 +69,183 @@ func PostRealmsRoute(w http.ResponseWriter, r *http.Request) {
 	gores.JSON(w, http.StatusOK, realm)
 }
 
+func (s *Server) GetRealmRoute(w http.ResponseWriter, r *http.Request) {
+	gores.JSON(w, http.StatusOK, getCurrentRealm(r))
+}
+
+type PatchRealmPayload struct {
+	Name string `json:"name" schema:"name"`
+}
+
+func (s *Server) PatchRealmRoute(w http.ResponseWriter, r *http.Request) {
+	var payload PatchRealmPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	realm := getCurrentRealm(r)
+
+	if payload.Name == "" {
+		gores.Error(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	if payload.Name != realm.Name {
+		_, err := s.store.GetRealmByName(payload.Name)
+		if err == nil {
+			gores.Error(w, http.StatusConflict, "name is already taken")
+			return
+		} else if err != sql.ErrNoRows {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
+	oldName := realm.Name
+	err := s.store.UpdateRealmName(realm, payload.Name)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_update", getCurrentUser(r), map[string]interface{}{
+		"realm":    realm.Id,
+		"old_name": oldName,
+		"name":     realm.Name,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, realm)
+}
+
+type PutRealmParentPayload struct {
+	ParentId *int64 `json:"parent_id" schema:"parent_id"`
+}
+
+// Sets (or with a null parent_id, clears) the realm whose grants also give
+// access to this one.
+func (s *Server) PutRealmParentRoute(w http.ResponseWriter, r *http.Request) {
+	var payload PutRealmParentPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	realm := getCurrentRealm(r)
+
+	if payload.ParentId != nil {
+		parent, err := s.store.GetRealmById(*payload.ParentId)
+		if err == sql.ErrNoRows {
+			gores.Error(w, http.StatusBadRequest, "Unknown parent realm")
+			return
+		} else if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+
+		lineage, err := s.store.GetRealmLineage(parent.Name)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+
+		for _, ancestor := range lineage {
+			if ancestor.Id == realm.Id {
+				gores.Error(w, http.StatusBadRequest, "A realm cannot be its own ancestor")
+				return
+			}
+		}
+	}
+
+	oldParentId := realm.ParentId
+	err := s.store.UpdateRealmParent(realm, payload.ParentId)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_parent_update", getCurrentUser(r), map[string]interface{}{
+		"realm":      realm.Id,
+		"old_parent": oldParentId,
+		"parent":     realm.ParentId,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, realm)
+}
+
+// Returns whether the token may be used with the named realm, which it may be
+// through any of the realm's parents.
+func (s *Server) tokenAllowsRealm(token *db.UserToken, name string) bool {
+	lineage, err := s.store.GetRealmLineage(name)
+	if err == sql.ErrNoRows {
+		lineage = []db.Realm{{Name: name}}
+	} else if err != nil {
+		log.Printf("[Realms] failed to load lineage of realm %v: %v", name, err)
+		return false
+	}
+
+	return token.AllowsRealm(lineage)
+}
+
+func (s *Server) DeleteRealmRoute(w http.ResponseWriter, r *http.Request) {
+	realm := getCurrentRealm(r)
+
+	err := s.store.DeleteRealm(realm)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_delete", getCurrentUser(r), map[string]interface{}{
+		"realm": realm.Id,
+		"name":  realm.Name,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+func (s *Server) GetRealmsGrantsRoute(w http.ResponseWriter, r *http.Request) {
+	realm := getCurrentRealm(r)
+
+	grants, err := s.store.GetUserRealmGrantsByRealmId(realm.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	groupGrants, err := s.store.GetGroupRealmGrantsByRealmId(realm.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"grants":       grants,
+		"group_grants": groupGrants,
+	})
+}
+
 type CreateUserRealmGrantPayload struct {
-	UserId int64   `json:"user_id" schema:"user_id"`
-	Alias  *string `json:"alias" schema:"alias"`
+	UserId int64    `json:"user_id" schema:"user_id"`
+	Alias  *string  `json:"alias" schema:"alias"`
+	Roles  []string `json:"roles" schema:"roles"`
+
+	// Optional unix timestamps limiting when the grant gives access
+	NotBefore *int64 `json:"not_before" schema:"not_before"`
+	ExpiresAt *int64 `json:"expires_at" schema:"expires_at"`
 }
 
-func PostRealmsGrantsRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PostRealmsGrantsRoute(w http.ResponseWriter, r *http.Request) {
 	var payload CreateUserRealmGrantPayload
 	if !readRequestData(w, r, &payload) {
 		return
@@ -56,13 +253,45 @@ func PostRealmsGrantsRoute(w http.ResponseWriter, r *http.Request) {
 
 	realm := getCurrentRealm(r)
 
-	user, err := db.GetUserById(payload.UserId)
+	user, err := s.store.GetUserById(payload.UserId)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	if payload.ExpiresAt != nil && *payload.ExpiresAt <= time.Now().Unix() {
+		gores.Error(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	} else if payload.ExpiresAt != nil && payload.NotBefore != nil && *payload.NotBefore >= *payload.ExpiresAt {
+		gores.Error(w, http.StatusBadRequest, "not_before must be before expires_at")
+		return
+	}
+
+	roleIds, ok := s.resolveRealmRoleIds(w, realm, payload.Roles)
+	if !ok {
+		return
+	}
+
+	realmGrant, err := s.store.CreateUserRealmGrant(user.Id, realm.Id, payload.Alias, payload.NotBefore, payload.ExpiresAt)
 	if err != nil {
 		reportInternalError(w, err)
 		return
 	}
 
-	realmGrant, err := db.CreateUserRealmGrant(user.Id, realm.Id, payload.Alias)
+	err = s.store.SetUserRealmGrantRoles(user.Id, realm.Id, roleIds)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_grant", getCurrentUser(r), map[string]interface{}{
+		"realm":      realm.Id,
+		"user":       user.Id,
+		"alias":      payload.Alias,
+		"roles":      payload.Roles,
+		"not_before": payload.NotBefore,
+		"expires_at": payload.ExpiresAt,
+	})
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -70,3 +299,145 @@ func PostRealmsGrantsRoute(w http.ResponseWriter, r *http.Request) {
 
 	gores.JSON(w, http.StatusOK, realmGrant)
 }
+
+type PatchUserRealmGrantPayload struct {
+	Alias *string `json:"alias" schema:"alias"`
+}
+
+func (s *Server) PatchRealmsGrantRoute(w http.ResponseWriter, r *http.Request) {
+	var payload PatchUserRealmGrantPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	realmGrant := getCurrentRealmGrant(r)
+
+	// An empty alias removes it
+	alias := payload.Alias
+	if alias != nil && *alias == "" {
+		alias = nil
+	}
+
+	err := s.store.UpdateUserRealmGrantAlias(realmGrant, alias)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_grant_update", getCurrentUser(r), map[string]interface{}{
+		"realm": realmGrant.RealmId,
+		"user":  realmGrant.UserId,
+		"alias": alias,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, realmGrant)
+}
+
+func (s *Server) DeleteRealmsGrantRoute(w http.ResponseWriter, r *http.Request) {
+	realmGrant := getCurrentRealmGrant(r)
+
+	err := s.store.DeleteUserRealmGrant(realmGrant)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_revoke", getCurrentUser(r), map[string]interface{}{
+		"realm": realmGrant.RealmId,
+		"user":  realmGrant.UserId,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+// Returns every realm the user can access along with the realm whose grant
+// gives them access, which may be a parent of it.
+func (s *Server) GetUserRealmsRoute(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(r)
+
+	realms, err := s.store.GetRealms()
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	effective := make([]map[string]interface{}, 0)
+	for _, realm := range realms {
+		grant, err := s.store.GetUserRealmGrantByRealmName(user.Id, realm.Name)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+
+		effective = append(effective, map[string]interface{}{
+			"realm": realm,
+			"grant": grant,
+		})
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"realms": effective,
+	})
+}
+
+// How often expired realm grants are removed
+const realmGrantSweepInterval = time.Minute
+
+// Periodically removes expired realm grants, recording each removal against
+// the user who held the grant.
+func (s *Server) runRealmGrantSweeper(ctx context.Context) {
+	ticker := time.NewTicker(realmGrantSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		err := s.sweepExpiredRealmGrants()
+		if err != nil {
+			log.Printf("[Realms] failed to sweep expired grants: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) sweepExpiredRealmGrants() error {
+	grants, err := s.store.GetExpiredUserRealmGrants()
+	if err != nil {
+		return err
+	}
+
+	for _, grant := range grants {
+		user, err := s.store.GetUserById(grant.UserId)
+		if err != nil {
+			return err
+		}
+
+		err = s.store.DeleteUserRealmGrant(&grant)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.store.CreateAuditLogEntry("user.realm_grant_expire", user, map[string]interface{}{
+			"realm":      grant.RealmId,
+			"expires_at": grant.ExpiresAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
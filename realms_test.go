@@ -0,0 +1,53 @@
+package heracles
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+func TestRealmHierarchyIsExplicit(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	user, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As realms were before they had parents, related only by their names
+	infra, _ := store.CreateRealm("infra", nil)
+	grafana, _ := store.CreateRealm("infra.grafana", nil)
+	_, err = store.CreateUserRealmGrant(user.Id, infra.Id, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newLoggedInClient(t, ts, "admin", "admin")
+	c := newLoggedInClient(t, ts, "user", "password")
+
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra"}), http.StatusNoContent)
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra.grafana"}), http.StatusUnauthorized)
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra.unknown"}), http.StatusUnauthorized)
+
+	admin.expect(admin.send("PUT", fmt.Sprintf("/api/realms/%v/parent", grafana.Id), map[string]int64{"parent_id": infra.Id}), http.StatusOK)
+	res := c.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra.grafana"})
+	c.expect(res, http.StatusNoContent)
+	if res.Header.Get("X-Heracles-User") != "user" {
+		t.Fatalf("unexpected validate headers %v", res.Header)
+	}
+
+	// Tokens restricted to the parent may be used with the child, not the reverse
+	anonymous := newTestClient(t, ts)
+	var token db.UserToken
+	c.expect(c.send("POST", "/api/tokens", map[string]interface{}{"name": "infra", "realms": []string{"infra"}}), http.StatusOK, &token)
+	anonymous.expect(anonymous.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra.grafana", "Authorization": token.Token}), http.StatusNoContent)
+	c.expect(c.send("POST", "/api/tokens", map[string]interface{}{"name": "grafana", "realms": []string{"infra.grafana"}}), http.StatusOK, &token)
+	anonymous.expect(anonymous.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra.grafana", "Authorization": token.Token}), http.StatusNoContent)
+	anonymous.expect(anonymous.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra", "Authorization": token.Token}), http.StatusUnauthorized)
+
+	admin.expect(admin.send("PUT", fmt.Sprintf("/api/realms/%v/parent", infra.Id), map[string]int64{"parent_id": grafana.Id}), http.StatusBadRequest)
+	admin.expect(admin.send("PUT", fmt.Sprintf("/api/realms/%v/parent", grafana.Id), map[string]interface{}{"parent_id": nil}), http.StatusOK)
+	c.expect(c.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra.grafana"}), http.StatusUnauthorized)
+}
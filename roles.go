@@ -0,0 +1,296 @@
+package heracles
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alioygur/gores"
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/go-chi/chi"
+)
+
+// Resolves role names into ids within the given realm, reporting an error to
+// the client if any of them are unknown.
+func (s *Server) resolveRealmRoleIds(w http.ResponseWriter, realm *db.Realm, names []string) ([]int64, bool) {
+	roleIds := make([]int64, 0, len(names))
+	for _, name := range names {
+		role, err := s.store.GetRealmRoleByName(realm.Id, name)
+		if err == sql.ErrNoRows {
+			gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Unknown role: %v", name))
+			return nil, false
+		} else if err != nil {
+			reportInternalError(w, err)
+			return nil, false
+		}
+
+		roleIds = append(roleIds, role.Id)
+	}
+	return roleIds, true
+}
+
+func getRoleNames(roles []db.RealmRole) []string {
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = role.Name
+	}
+	return names
+}
+
+// Sets the X-Heracles-Roles header and checks the user holds at least the role
+// requested via X-Heracles-Required-Role. Returns the status to respond with.
+func (s *Server) validateRealmRoles(w http.ResponseWriter, r *http.Request, user *db.User, realmId int64) int {
+	roles, err := s.store.GetEffectiveUserRealmRoles(user.Id, realmId)
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+
+	if len(roles) > 0 {
+		w.Header().Set("X-Heracles-Roles", strings.Join(getRoleNames(roles), ","))
+	}
+
+	requiredRoleName := r.Header.Get("X-Heracles-Required-Role")
+	if requiredRoleName == "" {
+		return http.StatusNoContent
+	}
+
+	requiredRole, err := s.store.GetRealmRoleByName(realmId, requiredRoleName)
+	if err == sql.ErrNoRows {
+		return http.StatusBadRequest
+	} else if err != nil {
+		return http.StatusInternalServerError
+	}
+
+	for _, role := range roles {
+		if role.Level >= requiredRole.Level {
+			return http.StatusNoContent
+		}
+	}
+
+	return http.StatusForbidden
+}
+
+func (s *Server) GetRealmRolesRoute(w http.ResponseWriter, r *http.Request) {
+	roles, err := s.store.GetRealmRolesByRealmId(getCurrentRealm(r).Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"roles": roles,
+	})
+}
+
+type CreateRealmRolePayload struct {
+	Name  string `json:"name" schema:"name"`
+	Level int64  `json:"level" schema:"level"`
+}
+
+func (s *Server) PostRealmRolesRoute(w http.ResponseWriter, r *http.Request) {
+	var payload CreateRealmRolePayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	realm := getCurrentRealm(r)
+
+	if payload.Name == "" || strings.Contains(payload.Name, ",") {
+		gores.Error(w, http.StatusBadRequest, "A name without commas is required")
+		return
+	}
+
+	_, err := s.store.GetRealmRoleByName(realm.Id, payload.Name)
+	if err == nil {
+		gores.Error(w, http.StatusConflict, "name is already taken")
+		return
+	} else if err != sql.ErrNoRows {
+		reportInternalError(w, err)
+		return
+	}
+
+	role, err := s.store.CreateRealmRole(realm.Id, payload.Name, payload.Level)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_role_create", getCurrentUser(r), map[string]interface{}{
+		"realm": realm.Id,
+		"role":  role.Name,
+		"level": role.Level,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, role)
+}
+
+func (s *Server) DeleteRealmRoleRoute(w http.ResponseWriter, r *http.Request) {
+	realm := getCurrentRealm(r)
+
+	roleId, err := strconv.ParseInt(chi.URLParam(r, "roleId"), 10, 64)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid role ID")
+		return
+	}
+
+	role, err := s.store.GetRealmRoleById(roleId)
+	if err == sql.ErrNoRows || (err == nil && role.RealmId != realm.Id) {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.DeleteRealmRole(role)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_role_delete", getCurrentUser(r), map[string]interface{}{
+		"realm": realm.Id,
+		"role":  role.Name,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+type GrantRolesPayload struct {
+	Roles []string `json:"roles" schema:"roles"`
+}
+
+func (s *Server) GetRealmsGrantRolesRoute(w http.ResponseWriter, r *http.Request) {
+	realmGrant := getCurrentRealmGrant(r)
+
+	roles, err := s.store.GetUserRealmGrantRoles(realmGrant.UserId, realmGrant.RealmId)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"roles": getRoleNames(roles),
+	})
+}
+
+func (s *Server) PutRealmsGrantRolesRoute(w http.ResponseWriter, r *http.Request) {
+	var payload GrantRolesPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	realmGrant := getCurrentRealmGrant(r)
+
+	roleIds, ok := s.resolveRealmRoleIds(w, getCurrentRealm(r), payload.Roles)
+	if !ok {
+		return
+	}
+
+	err := s.store.SetUserRealmGrantRoles(realmGrant.UserId, realmGrant.RealmId, roleIds)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.realm_grant_roles", getCurrentUser(r), map[string]interface{}{
+		"realm": realmGrant.RealmId,
+		"user":  realmGrant.UserId,
+		"roles": payload.Roles,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+// Looks up the group grant for the realm in the URL, reporting an error to the
+// client if it does not exist.
+func (s *Server) findGroupRealmGrant(w http.ResponseWriter, r *http.Request) (*db.GroupRealmGrant, bool) {
+	realmId, err := strconv.ParseInt(chi.URLParam(r, "realmId"), 10, 64)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid realm ID")
+		return nil, false
+	}
+
+	grant, err := s.store.GetGroupRealmGrant(getCurrentGroup(r).Id, realmId)
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return nil, false
+	} else if err != nil {
+		reportInternalError(w, err)
+		return nil, false
+	}
+
+	return grant, true
+}
+
+func (s *Server) GetGroupGrantRolesRoute(w http.ResponseWriter, r *http.Request) {
+	grant, ok := s.findGroupRealmGrant(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := s.store.GetGroupRealmGrantRoles(grant.GroupId, grant.RealmId)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"roles": getRoleNames(roles),
+	})
+}
+
+func (s *Server) PutGroupGrantRolesRoute(w http.ResponseWriter, r *http.Request) {
+	var payload GrantRolesPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	grant, ok := s.findGroupRealmGrant(w, r)
+	if !ok {
+		return
+	}
+
+	realm, err := s.store.GetRealmById(grant.RealmId)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	roleIds, ok := s.resolveRealmRoleIds(w, realm, payload.Roles)
+	if !ok {
+		return
+	}
+
+	err = s.store.SetGroupRealmGrantRoles(grant.GroupId, grant.RealmId, roleIds)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.group_grant_roles", getCurrentUser(r), map[string]interface{}{
+		"group": grant.GroupId,
+		"realm": grant.RealmId,
+		"roles": payload.Roles,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
@@ -3,20 +3,32 @@ package heracles
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/alioygur/gores"
+	"github.com/b1naryth1ef/heracles/db"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/gorilla/schema"
-	"github.com/spf13/viper"
 )
 
 const timeout = 15 * time.Second
 
+// The largest form body accepted, matching http.Request.ParseForm
+const maxFormSize = 10 << 20
+
 func readRequestData(w http.ResponseWriter, r *http.Request, target interface{}) bool {
-	contentType := r.Header.Get("Content-Type")
+	// Browsers add parameters (e.g. `; charset=UTF-8`) to the content type
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		contentType = r.Header.Get("Content-Type")
+	}
+
 	if contentType == "application/json" {
 		decoder := json.NewDecoder(r.Body)
 		err := decoder.Decode(target)
@@ -27,13 +39,21 @@ func readRequestData(w http.ResponseWriter, r *http.Request, target interface{})
 
 		return true
 	} else if contentType == "application/x-www-form-urlencoded" {
-		err := r.ParseForm()
+		// ParseForm ignores the body of DELETE requests, which some routes take
+		//  (e.g. the code confirming TOTP removal), so it is read directly.
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFormSize))
+		if err != nil {
+			gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Invalid Request Form: %v", err))
+			return false
+		}
+
+		form, err := url.ParseQuery(string(body))
 		if err != nil {
 			gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Invalid Request Form: %v", err))
 			return false
 		}
 
-		err = schema.NewDecoder().Decode(target, r.PostForm)
+		err = schema.NewDecoder().Decode(target, form)
 		if err != nil {
 			gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Invalid Form Data: %v", err))
 			return false
@@ -50,73 +70,206 @@ func reportInternalError(w http.ResponseWriter, err error) {
 	gores.Error(w, http.StatusInternalServerError, fmt.Sprintf("Internal Error: %v", err))
 }
 
-func NewRouter() http.Handler {
+func (s *Server) newRouter() http.Handler {
 	router := chi.NewRouter()
 	router.Use(middleware.Recoverer)
 	router.Use(middleware.Timeout(timeout))
 
-	if viper.GetBool("log_requests") {
+	if s.config.LogRequests {
 		router.Use(middleware.Logger)
 	}
 
-	authRouter := router.With(RequireAuthMiddleware)
+	authRouter := router.With(s.RequireAuthMiddleware)
 
 	// Static/User-Friendly Routes
-	router.Get("/login", GetLoginRoute)
-	router.Post("/login", PostLoginRoute)
-	router.Get("/login/discord", GetLoginDiscordRoute)
-	router.Get("/login/discord/callback", GetLoginDiscordCallbackRoute)
-	router.Handle("/logout", http.HandlerFunc(GetLogoutRoute))
-	authRouter.Get("/", GetIndexRoute)
+	router.Get("/login", s.GetLoginRoute)
+	router.Post("/login", s.PostLoginRoute)
+	router.Get("/login/mfa", s.GetLoginMFARoute)
+	router.Post("/login/totp", s.PostLoginTOTPRoute)
+	router.Get("/login/discord", s.GetLoginDiscordRoute)
+	router.Get("/login/discord/callback", s.GetLoginDiscordCallbackRoute)
+	router.Get("/login/oauth/{provider}", s.GetLoginProviderRoute)
+	router.Get("/login/oauth/{provider}/callback", s.GetLoginProviderCallbackRoute)
+	if s.config.WebAuthn.Enabled {
+		router.Post("/login/webauthn/begin", s.PostLoginWebAuthnBeginRoute)
+		router.Post("/login/webauthn/finish", s.PostLoginWebAuthnFinishRoute)
+	}
+	router.Handle("/logout", http.HandlerFunc(s.GetLogoutRoute))
+	authRouter.Get("/", s.GetIndexRoute)
+	router.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
 	// Validate route used for linking up nginx auth_request
-	router.Handle("/api/validate", http.HandlerFunc(ValidateRoute))
+	router.Handle("/api/validate", http.HandlerFunc(s.ValidateRoute))
+
+	// OpenID Connect provider for applications which can't use auth_request
+	if s.config.OIDC.Enabled {
+		router.Get("/.well-known/openid-configuration", s.GetOIDCDiscoveryRoute)
+		router.Get("/oidc/jwks", s.GetOIDCJWKSRoute)
+		router.Get("/oidc/authorize", s.GetOIDCAuthorizeRoute)
+		router.Post("/oidc/token", s.PostOIDCTokenRoute)
+		router.Get("/oidc/userinfo", s.GetOIDCUserInfoRoute)
+		router.Post("/oidc/userinfo", s.GetOIDCUserInfoRoute)
+	}
 
 	authRouter.Route("/api", func(apiRouter chi.Router) {
+		// Requests made with a token are limited to the scopes it was given
+		identityRouter := apiRouter.With(s.RequireTokenScopeMiddleware(db.USER_TOKEN_SCOPE_IDENTITY))
+		tokensRouter := apiRouter.With(s.RequireTokenScopeMiddleware(db.USER_TOKEN_SCOPE_TOKENS))
+
 		// Returns information about the current users identity
-		apiRouter.Get("/identity", GetIdentityRoute)
+		identityRouter.Get("/identity", s.GetIdentityRoute)
 
 		// Updates the users identity
-		apiRouter.Patch("/identity", PatchIdentityRoute)
+		identityRouter.Patch("/identity", s.PatchIdentityRoute)
+
+		// Logged in sessions for the current user
+		identityRouter.Route("/identity/sessions", func(r chi.Router) {
+			r.Get("/", s.GetIdentitySessionsRoute)
+			r.Delete("/", s.DeleteIdentitySessionsRoute)
+			r.Delete("/{sessionId}", s.DeleteIdentitySessionRoute)
+		})
+
+		// Requests from the current user for access to realms
+		identityRouter.Route("/identity/access-requests", func(r chi.Router) {
+			r.Get("/", s.GetIdentityAccessRequestsRoute)
+			r.Post("/", s.PostIdentityAccessRequestsRoute)
+			r.Delete("/{requestId}", s.DeleteIdentityAccessRequestRoute)
+		})
+
+		// Pending access requests for realms owned by the current user
+		identityRouter.Route("/access-requests", func(r chi.Router) {
+			r.Get("/", s.GetAccessRequestsRoute)
+			r.Post("/{requestId}/approve", s.PostAccessRequestApproveRoute)
+			r.Post("/{requestId}/deny", s.PostAccessRequestDenyRoute)
+		})
+
+		// Accounts on external login providers linked to the current user
+		identityRouter.Route("/identity/providers", func(r chi.Router) {
+			r.Get("/", s.GetIdentityProvidersRoute)
+			r.Delete("/{provider}", s.DeleteIdentityProviderRoute)
+		})
+
+		// Second factor enrollment for the current user
+		identityRouter.Route("/identity/mfa/totp", func(r chi.Router) {
+			r.Post("/", s.PostIdentityTOTPRoute)
+			r.Delete("/", s.DeleteIdentityTOTPRoute)
+			r.Post("/confirm", s.PostIdentityTOTPConfirmRoute)
+		})
+
+		if s.config.WebAuthn.Enabled {
+			identityRouter.Route("/identity/mfa/webauthn", func(r chi.Router) {
+				r.Get("/", s.GetIdentityWebAuthnRoute)
+				r.Post("/register/begin", s.PostIdentityWebAuthnRegisterBeginRoute)
+				r.Post("/register/finish", s.PostIdentityWebAuthnRegisterFinishRoute)
+				r.Delete("/{credentialId}", s.DeleteIdentityWebAuthnCredentialRoute)
+			})
+		}
 
 		// Tokens can be managed by users and give third party services / clients
 		//  access on behalf of a registered user.
-		apiRouter.Route("/tokens", func(r chi.Router) {
-			r.Get("/", GetTokensRoute)
-			r.Post("/", PostTokensRoute)
+		tokensRouter.Route("/tokens", func(r chi.Router) {
+			r.Get("/", s.GetTokensRoute)
+			r.Post("/", s.PostTokensRoute)
 
-			r.With(RequireUserTokenMiddleware).Route("/{tokenId}", func(r chi.Router) {
-				r.Delete("/", DeleteTokenRoute)
-				r.Patch("/", PatchTokenRoute)
+			r.With(s.RequireUserTokenMiddleware).Route("/{tokenId}", func(r chi.Router) {
+				r.Delete("/", s.DeleteTokenRoute)
+				r.Patch("/", s.PatchTokenRoute)
 			})
 		})
 
-		adminRouter := apiRouter.With(RequireAdminMiddleware)
+		adminRouter := apiRouter.With(s.RequireAdminMiddleware, s.RequireTokenScopeMiddleware(db.USER_TOKEN_SCOPE_ADMIN))
 
 		adminRouter.Route("/users", func(r chi.Router) {
-			r.Get("/", GetUsersRoute)
-			r.Post("/", PostUsersRoute)
+			r.Get("/", s.GetUsersRoute)
+			r.Post("/", s.PostUsersRoute)
+
+			// Every active session across all users
+			r.Get("/sessions", s.GetSessionsRoute)
+
+			// Tokens across all users, filtered by name and prefix
+			r.Get("/tokens", s.GetAllTokensRoute)
+
+			r.With(s.RequireUserMiddleware).Route("/{userId}", func(r chi.Router) {
+				r.Get("/", s.GetUserRoute)
+				r.Patch("/", s.PatchUserRoute)
+				r.Delete("/", s.DeleteUserRoute)
+
+				// Realms the user can access, directly or through groups and parent realms
+				r.Get("/realms", s.GetUserRealmsRoute)
+
+				r.Get("/sessions", s.GetUserSessionsRoute)
+				r.Delete("/sessions", s.DeleteUserSessionsRoute)
+				r.Delete("/sessions/{sessionId}", s.DeleteUserSessionRoute)
+
+				r.Get("/tokens", s.GetUserTokensRoute)
+				r.Delete("/tokens", s.DeleteUserTokensRoute)
+				r.With(s.RequireUserTokenMiddleware).Delete("/tokens/{tokenId}", s.DeleteUserTokenRoute)
+			})
+		})
+
+		adminRouter.Route("/groups", func(r chi.Router) {
+			r.Get("/", s.GetGroupsRoute)
+			r.Post("/", s.PostGroupsRoute)
+
+			r.With(s.RequireGroupMiddleware).Route("/{groupId}", func(r chi.Router) {
+				r.Get("/", s.GetGroupRoute)
+				r.Patch("/", s.PatchGroupRoute)
+				r.Delete("/", s.DeleteGroupRoute)
+
+				r.Get("/members", s.GetGroupMembersRoute)
+				r.Post("/members", s.PostGroupMembersRoute)
+				r.Delete("/members/{userId}", s.DeleteGroupMemberRoute)
+
+				r.Get("/grants", s.GetGroupGrantsRoute)
+				r.Post("/grants", s.PostGroupGrantsRoute)
+				r.Delete("/grants/{realmId}", s.DeleteGroupGrantRoute)
+				r.Get("/grants/{realmId}/roles", s.GetGroupGrantRolesRoute)
+				r.Put("/grants/{realmId}/roles", s.PutGroupGrantRolesRoute)
+			})
 		})
 
 		adminRouter.Route("/realms", func(r chi.Router) {
-			r.Get("/", GetRealmsRoute)
-			r.Post("/", PostRealmsRoute)
+			r.Get("/", s.GetRealmsRoute)
+			r.Post("/", s.PostRealmsRoute)
+
+			r.With(s.RequireRealmMiddleware).Route("/{realmId}", func(r chi.Router) {
+				r.Get("/", s.GetRealmRoute)
+				r.Patch("/", s.PatchRealmRoute)
+				r.Delete("/", s.DeleteRealmRoute)
+				r.Put("/parent", s.PutRealmParentRoute)
+
+				r.Get("/grants", s.GetRealmsGrantsRoute)
+				r.Post("/grants", s.PostRealmsGrantsRoute)
+
+				r.With(s.RequireRealmGrantMiddleware).Route("/grants/{userId}", func(r chi.Router) {
+					r.Patch("/", s.PatchRealmsGrantRoute)
+					r.Delete("/", s.DeleteRealmsGrantRoute)
+					r.Get("/roles", s.GetRealmsGrantRolesRoute)
+					r.Put("/roles", s.PutRealmsGrantRolesRoute)
+				})
 
-			r.With(RequireRealmMiddleware).Route("/{realmId}", func(r chi.Router) {
-				r.Post("/grants", PostRealmsGrantsRoute)
+				r.Get("/owners", s.GetRealmOwnersRoute)
+				r.Post("/owners", s.PostRealmOwnersRoute)
+				r.Delete("/owners/{userId}", s.DeleteRealmOwnerRoute)
+
+				r.Get("/roles", s.GetRealmRolesRoute)
+				r.Post("/roles", s.PostRealmRolesRoute)
+				r.Delete("/roles/{roleId}", s.DeleteRealmRoleRoute)
 			})
 		})
 
+		if s.config.OIDC.Enabled {
+			adminRouter.Route("/oidc/clients", func(r chi.Router) {
+				r.Get("/", s.GetOIDCClientsRoute)
+				r.Post("/", s.PostOIDCClientsRoute)
+				r.Delete("/{clientId}", s.DeleteOIDCClientRoute)
+			})
+		}
+
 		adminRouter.Route("/log", func(r chi.Router) {
-			r.Get("/recent", GetRecentAuditLogRoute)
+			r.Get("/recent", s.GetRecentAuditLogRoute)
 		})
 	})
 
-	// router.With(RequireUserMiddleware).Route("/users/{user_id}", func(r chi.Router) {
-	// 	r.Get("/", GetUser)
-	// 	r.Patch("/", PatchUser)
-	// 	r.Delete("/", DeleteUser)
-	// })
-
 	return router
 }
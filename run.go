@@ -1,74 +1,98 @@
 package heracles
 
 import (
+	"context"
 	"log"
 	"math/rand"
-	"net"
-	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/b1naryth1ef/heracles/db"
-	"github.com/gorilla/sessions"
-	"github.com/spf13/viper"
-	"layeh.com/radius"
 )
 
-var (
-	sessionStore *sessions.CookieStore
-)
+func Run() {
+	rand.Seed(time.Now().UTC().UnixNano())
 
-func getSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
-	session, err := sessionStore.Get(r, "session")
+	config, err := ConfigFromViper()
 	if err != nil {
-		http.Error(w, "Invalid or corrupted session", http.StatusInternalServerError)
+		log.Fatalf("Failed to load config: %v", err)
 	}
-	return session
-}
 
-func Run() {
-	rand.Seed(time.Now().UTC().UnixNano())
+	server, err := NewServer(config)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
 
-	sessionStore = sessions.NewCookieStore([]byte(viper.GetString("security.secret")))
+	ctx, cancel := context.WithCancel(context.Background())
+	go handleSignals(server, cancel)
 
-	db.InitDB(viper.GetString("db.path"), viper.GetString("security.secret"), viper.GetInt("security.bcrypt.difficulty"))
+	err = server.Start(ctx)
+	if err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
 
-	if viper.GetBool("discord.enabled") {
-		InitializeDiscordAuth()
+	err = server.Wait()
+	if err != nil {
+		log.Fatalf("Server stopped: %v", err)
 	}
+	log.Printf("Shut down cleanly")
+}
 
-	if viper.GetBool("radius.enabled") {
-		server := radius.PacketServer{
-			Handler:      radius.HandlerFunc(handleRadiusRequest),
-			SecretSource: radius.StaticSecretSource([]byte(viper.GetString("radius.secret"))),
-		}
+// Reloads the TLS certificate on SIGHUP and begins a graceful shutdown on
+// SIGINT or SIGTERM (as sent by systemd), a second of which exits immediately.
+func handleSignals(server *Server, shutdown func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
-		go func() {
-			log.Printf("RADIUS listening on :1812")
-			if err := server.ListenAndServe(); err != nil {
-				log.Fatal(err)
+	shuttingDown := false
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			log.Printf("Received %v, reloading TLS certificate", sig)
+			err := server.ReloadCertificate()
+			if err != nil {
+				log.Printf("Failed to reload TLS certificate: %v", err)
 			}
-		}()
+		} else if shuttingDown {
+			log.Fatalf("Received %v again, exiting immediately", sig)
+		} else {
+			log.Printf("Received %v, shutting down", sig)
+			shuttingDown = true
+			shutdown()
+		}
 	}
+}
 
-	router := NewRouter()
+// Applies any pending database migrations without starting the server, so
+// deploys can migrate ahead of time.
+func Migrate() {
+	config, err := ConfigFromViper()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	config.setDefaults()
 
-	bind := viper.GetString("web.bind")
-	if strings.HasPrefix(bind, "unix://") {
-		listener, err := net.Listen("unix", strings.TrimPrefix(bind, "unix://"))
-		if err != nil {
-			panic(err)
-		}
-		defer listener.Close()
+	store, err := db.ConnectDB(config.DB.Driver, config.DB.Path)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer store.Close()
 
-		server := http.Server{
-			Handler: router,
-		}
+	count, err := store.Migrate()
+	if err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	applied, err := store.GetSchemaMigrations()
+	if err != nil {
+		log.Fatalf("Failed to load applied migrations: %v", err)
+	}
 
-		log.Printf("Listening on %v", bind)
-		server.Serve(listener)
-	} else {
-		log.Printf("Listening on %v", bind)
-		log.Fatalln(http.ListenAndServe(bind, router))
+	version := 0
+	if len(applied) > 0 {
+		version = applied[len(applied)-1].Version
 	}
+
+	log.Printf("Applied %v migrations, database is at version %v", count, version)
 }
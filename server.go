@@ -0,0 +1,386 @@
+package heracles
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+	"layeh.com/radius"
+)
+
+// Server is a single instance of heracles. Everything it keeps lives either in
+// its db.Store or on the Server itself, so several can run side by side within
+// the same process.
+type Server struct {
+	config Config
+	store  db.Store
+
+	authenticators       []Authenticator
+	sessions             *sessions.CookieStore
+	discordConfig        *oauth2.Config
+	webAuthn             *webauthn.WebAuthn
+	loginProviders       []*loginProvider
+	loginProvidersByName map[string]*loginProvider
+
+	oidcIssuer     string
+	oidcSigningKey *rsa.PrivateKey
+	oidcKeyId      string
+
+	// Closes the database when the server opened it itself
+	closer io.Closer
+
+	certificates *certificateReloader
+	tlsConfig    *tls.Config
+
+	handler        http.Handler
+	httpServer     *http.Server
+	redirectServer *http.Server
+	radiusServer   *radius.PacketServer
+	cancel         context.CancelFunc
+
+	// Tracks the listeners and sweepers which must finish before the database
+	// can be closed
+	running sync.WaitGroup
+
+	shutdownOnce sync.Once
+	stopped      chan struct{}
+	err          error
+	errLock      sync.Mutex
+}
+
+// Opens the database described by the config, bringing its schema up to date,
+// and builds a server on top of it.
+func NewServer(config Config) (*Server, error) {
+	config.setDefaults()
+
+	store, err := db.OpenDB(config.DB.Driver, config.DB.Path, config.Security.BcryptDifficulty)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewServerWithStore(config, store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	s.closer = store
+	return s, nil
+}
+
+// Builds a server on top of an existing store, such as a db.MemoryStore in
+// tests. The store is left open when the server shuts down.
+func NewServerWithStore(config Config, store db.Store) (*Server, error) {
+	config.setDefaults()
+
+	if config.Security.Secret == "" {
+		return nil, errors.New("security.secret is required")
+	}
+
+	s := &Server{
+		config:   config,
+		store:    store,
+		sessions: sessions.NewCookieStore([]byte(config.Security.Secret)),
+		stopped:  make(chan struct{}),
+	}
+
+	err := s.initializeAuthenticators()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Web.TLS.Cert != "" || config.Web.TLS.Key != "" {
+		err = s.initializeTLS()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Cookies are only sent back over HTTPS when it is being served
+	s.sessions.Options.Secure = s.tlsConfig != nil
+	s.sessions.Options.SameSite = http.SameSiteLaxMode
+
+	err = s.initializeLoginProviders()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Discord.Enabled {
+		s.initializeDiscordAuth()
+	}
+
+	if config.WebAuthn.Enabled {
+		err = s.initializeWebAuthn()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.OIDC.Enabled {
+		err = s.initializeOIDC()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.handler = s.newRouter()
+	return s, nil
+}
+
+// Returns the handler serving the web interface and API, for mounting within
+// another HTTP server or calling directly in tests.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Starts listening on the configured web (and if enabled RADIUS) addresses
+// along with the background sweepers, returning once the listeners are open.
+// Everything runs until ctx is cancelled or Shutdown is called, a listener
+// failing also shuts the server down.
+func (s *Server) Start(ctx context.Context) error {
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	// Every listener is opened before anything is started, so failing to open
+	//  one has nothing to stop but the listeners before it.
+	listener, err := listenWeb(s.config.Web.Bind)
+	if err != nil {
+		s.cancel()
+		return err
+	}
+
+	var radiusConn net.PacketConn
+	if s.config.Radius.Enabled {
+		radiusConn, err = net.ListenPacket("udp", s.config.Radius.Bind)
+		if err != nil {
+			listener.Close()
+			s.cancel()
+			return err
+		}
+	}
+
+	var redirectListener net.Listener
+	if s.tlsConfig != nil && s.config.Web.TLS.RedirectBind != "" {
+		redirectListener, err = net.Listen("tcp", s.config.Web.TLS.RedirectBind)
+		if err != nil {
+			if radiusConn != nil {
+				radiusConn.Close()
+			}
+			listener.Close()
+			s.cancel()
+			return err
+		}
+	}
+
+	if radiusConn != nil {
+		s.radiusServer = &radius.PacketServer{
+			Handler:      s,
+			SecretSource: radius.StaticSecretSource([]byte(s.config.Radius.Secret)),
+		}
+
+		log.Printf("RADIUS listening on %v", radiusConn.LocalAddr())
+		s.goRunning(func() {
+			defer radiusConn.Close()
+			err := s.radiusServer.Serve(radiusConn)
+			if err != nil && err != radius.ErrServerShutdown {
+				s.fail(fmt.Errorf("RADIUS server failed: %v", err))
+			}
+		})
+	}
+
+	if redirectListener != nil {
+		s.redirectServer = &http.Server{
+			Handler: http.HandlerFunc(s.redirectToHTTPS),
+		}
+
+		log.Printf("Redirecting HTTP to HTTPS on %v", s.config.Web.TLS.RedirectBind)
+		s.goRunning(func() {
+			err := s.redirectServer.Serve(redirectListener)
+			if err != nil && err != http.ErrServerClosed {
+				s.fail(fmt.Errorf("HTTP redirect server failed: %v", err))
+			}
+		})
+	}
+
+	s.httpServer = &http.Server{
+		Handler:   s.handler,
+		TLSConfig: s.tlsConfig,
+	}
+
+	log.Printf("Listening on %v", s.config.Web.Bind)
+	s.goRunning(func() {
+		var err error
+		if s.tlsConfig != nil {
+			err = s.httpServer.ServeTLS(listener, "", "")
+		} else {
+			err = s.httpServer.Serve(listener)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			s.fail(fmt.Errorf("HTTP server failed: %v", err))
+		}
+	})
+
+	s.goRunning(func() { s.runRealmGrantSweeper(ctx) })
+	s.goRunning(func() { s.runTokenSweeper(ctx) })
+
+	if s.certificates != nil {
+		s.goRunning(func() { s.runCertificateReloader(ctx) })
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.Web.ShutdownTimeout)
+		defer cancel()
+		s.Shutdown(shutdownCtx)
+	}()
+
+	return nil
+}
+
+func (s *Server) goRunning(fn func()) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		fn()
+	}()
+}
+
+// Records why the server stopped unexpectedly and begins shutting it down
+func (s *Server) fail(err error) {
+	log.Print(err)
+
+	s.errLock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.errLock.Unlock()
+
+	s.cancel()
+}
+
+// Stops accepting new requests, waits for in-flight HTTP requests and RADIUS
+// packets to finish (or ctx to be done) and closes the database if the server
+// opened it. Unix sockets are removed when their listener closes. Calling it
+// more than once waits for the first call and returns its result.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		if s.cancel != nil {
+			s.cancel()
+		}
+
+		var errs []error
+		if s.httpServer != nil {
+			errs = append(errs, s.httpServer.Shutdown(ctx))
+		}
+
+		if s.redirectServer != nil {
+			errs = append(errs, s.redirectServer.Shutdown(ctx))
+		}
+
+		if s.radiusServer != nil {
+			errs = append(errs, s.radiusServer.Shutdown(ctx))
+		}
+
+		// Requests which outlived ctx are abandoned, but the sweepers are
+		// waited on as they only stop between runs.
+		if ctx.Err() == nil {
+			s.running.Wait()
+		}
+
+		if s.closer != nil {
+			errs = append(errs, s.closer.Close())
+		}
+
+		for _, err := range errs {
+			if err != nil {
+				s.errLock.Lock()
+				if s.err == nil {
+					s.err = err
+				}
+				s.errLock.Unlock()
+				break
+			}
+		}
+
+		close(s.stopped)
+	})
+
+	<-s.stopped
+	return s.Err()
+}
+
+// Blocks until the server has been shut down
+func (s *Server) Wait() error {
+	<-s.stopped
+	return s.Err()
+}
+
+// Returns the error which stopped the server, if any
+func (s *Server) Err() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.err
+}
+
+// Listens on either a TCP address or, when prefixed with `unix://`, a socket
+func listenWeb(bind string) (net.Listener, error) {
+	if !strings.HasPrefix(bind, "unix://") {
+		return net.Listen("tcp", bind)
+	}
+
+	path := strings.TrimPrefix(bind, "unix://")
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.Listen("unix", path)
+}
+
+// Removes a socket left behind by a previous process which did not exit
+// cleanly. Sockets which are still accepting connections are left alone so
+// two instances can't steal each other's socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%v is in use by another process", path)
+	}
+
+	log.Printf("Removing stale socket %v", path)
+	return os.Remove(path)
+}
+
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
+	session, err := s.sessions.Get(r, "session")
+	if err != nil {
+		http.Error(w, "Invalid or corrupted session", http.StatusInternalServerError)
+	}
+	return session
+}
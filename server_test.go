@@ -0,0 +1,326 @@
+package heracles
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+// Builds a server on an empty memory store holding just an admin/admin user,
+// configure (if given) may adjust the config first.
+func newTestServer(t *testing.T, configure func(*Config)) (*Server, *db.MemoryStore, *httptest.Server) {
+	t.Helper()
+
+	store := db.NewMemoryStore()
+	_, err := store.CreateUser("admin", "admin", db.Bits(0).Set(db.USER_FLAG_ADMIN), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, ts := newTestReplica(t, store, configure)
+	return s, store, ts
+}
+
+// Starts another server on an existing store, as if it were a replica running
+// behind the same load balancer.
+func newTestReplica(t *testing.T, store db.Store, configure func(*Config)) (*Server, *httptest.Server) {
+	t.Helper()
+
+	config := Config{
+		Security: SecurityConfig{
+			Secret: "testing",
+		},
+	}
+	if configure != nil {
+		configure(&config)
+	}
+
+	s, err := NewServerWithStore(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// A client for a test server which keeps cookies between requests and leaves
+// redirects for the test to check.
+type testClient struct {
+	t      *testing.T
+	base   string
+	client *http.Client
+}
+
+func newTestClient(t *testing.T, ts *httptest.Server) *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testClient{
+		t:    t,
+		base: ts.URL,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Logs in as the given user, failing the test unless that succeeds outright
+func newLoggedInClient(t *testing.T, ts *httptest.Server, username, password string) *testClient {
+	c := newTestClient(t, ts)
+	res := c.postForm("/login", url.Values{"username": {username}, "password": {password}})
+	c.expect(res, http.StatusNoContent)
+	return c
+}
+
+func (c *testClient) url() *url.URL {
+	c.t.Helper()
+
+	parsed, err := url.Parse(c.base)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return parsed
+}
+
+func (c *testClient) do(req *http.Request) *http.Response {
+	c.t.Helper()
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func (c *testClient) newRequest(method, path string, body *bytes.Reader) *http.Request {
+	c.t.Helper()
+
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return req
+}
+
+func (c *testClient) get(path string, headers map[string]string) *http.Response {
+	c.t.Helper()
+
+	req := c.newRequest("GET", path, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return c.do(req)
+}
+
+func (c *testClient) postForm(path string, form url.Values) *http.Response {
+	c.t.Helper()
+
+	req := c.newRequest("POST", path, bytes.NewReader([]byte(form.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+// Sends the payload (if any) encoded as JSON
+func (c *testClient) send(method, path string, payload interface{}) *http.Response {
+	c.t.Helper()
+
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	req := c.newRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req)
+}
+
+// Fails the test unless the response has the given status, decoding its body
+// into target (if given).
+func (c *testClient) expect(res *http.Response, status int, target ...interface{}) {
+	c.t.Helper()
+
+	if res.StatusCode != status {
+		var body bytes.Buffer
+		body.ReadFrom(res.Body)
+		c.t.Fatalf("%v %v: expected status %v but got %v: %v", res.Request.Method, res.Request.URL.Path, status, res.StatusCode, strings.TrimSpace(body.String()))
+	}
+
+	for _, value := range target {
+		err := json.NewDecoder(res.Body).Decode(value)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+func TestLoginOnMemoryStore(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	_, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	anonymous := newTestClient(t, ts)
+	anonymous.expect(anonymous.postForm("/login", url.Values{"username": {"user"}, "password": {"wrong"}}), http.StatusBadRequest)
+	anonymous.expect(anonymous.get("/api/identity", nil), http.StatusUnauthorized)
+
+	c := newLoggedInClient(t, ts, "user", "password")
+
+	var identity db.User
+	c.expect(c.get("/api/identity", nil), http.StatusOK, &identity)
+	if identity.Username != "user" {
+		t.Fatalf("logged in as %v", identity.Username)
+	}
+
+	var sessions struct {
+		Sessions []db.Session `json:"sessions"`
+		Current  int64        `json:"current"`
+	}
+	c.expect(c.get("/api/identity/sessions", nil), http.StatusOK, &sessions)
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0].Id != sessions.Current {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	c.expect(c.get("/logout", nil), http.StatusFound)
+	c.expect(c.get("/api/identity", nil), http.StatusUnauthorized)
+}
+
+func TestPasswordChangeRevokesOtherSessions(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	_, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := newLoggedInClient(t, ts, "user", "password")
+	second := newLoggedInClient(t, ts, "user", "password")
+
+	second.expect(second.send("PATCH", "/api/identity", map[string]string{"password": "changed"}), http.StatusNoContent)
+
+	first.expect(first.get("/api/identity", nil), http.StatusUnauthorized)
+	second.expect(second.get("/api/identity", nil), http.StatusOK)
+	newLoggedInClient(t, ts, "user", "changed")
+}
+
+func TestServersSideBySide(t *testing.T) {
+	_, firstStore, firstTs := newTestServer(t, nil)
+	_, _, secondTs := newTestServer(t, nil)
+
+	_, err := firstStore.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := newLoggedInClient(t, firstTs, "user", "password")
+	first.expect(first.get("/api/identity", nil), http.StatusOK)
+
+	// Users and sessions of one server are unknown to the other
+	second := newTestClient(t, secondTs)
+	second.expect(second.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}}), http.StatusBadRequest)
+
+	for _, cookie := range first.client.Jar.Cookies(first.url()) {
+		second.client.Jar.SetCookies(second.url(), []*http.Cookie{cookie})
+	}
+	second.expect(second.get("/api/identity", nil), http.StatusUnauthorized)
+
+	secondAdmin := newLoggedInClient(t, secondTs, "admin", "admin")
+	secondAdmin.expect(secondAdmin.send("POST", "/api/realms", map[string]string{"name": "test"}), http.StatusOK)
+
+	firstAdmin := newLoggedInClient(t, firstTs, "admin", "admin")
+	var realms struct {
+		Realms []db.Realm `json:"realms"`
+	}
+	firstAdmin.expect(firstAdmin.get("/api/realms", nil), http.StatusOK, &realms)
+	for _, realm := range realms.Realms {
+		if realm.Name == "test" {
+			t.Fatalf("realm created on one server showed up on the other")
+		}
+	}
+}
+
+func TestStartCleansUpWhenAListenerFails(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	s, _, _ := newTestServer(t, func(config *Config) {
+		config.Web.Bind = "127.0.0.1:0"
+		config.Web.TLS.RedirectBind = taken.Addr().String()
+		config.Radius.Enabled = true
+		config.Radius.Bind = "127.0.0.1:0"
+		config.Radius.Secret = "secret"
+	})
+	s.tlsConfig = &tls.Config{}
+
+	err = s.Start(context.Background())
+	if err == nil {
+		t.Fatal("started with the redirect address already taken")
+	}
+
+	// Nothing, including the RADIUS server opened before it, is left running
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("server is still running after failing to start")
+	}
+}
+
+func TestSessionCookieIsSecureOverTLS(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		s, _, ts := newTestServer(t, nil)
+		if secure {
+			s.tlsConfig = &tls.Config{}
+		}
+
+		c := newTestClient(t, ts)
+		res := c.postForm("/login", url.Values{"username": {"admin"}, "password": {"admin"}})
+		c.expect(res, http.StatusNoContent)
+
+		var cookie *http.Cookie
+		for _, candidate := range res.Cookies() {
+			if candidate.Name == "heracles-auth" {
+				cookie = candidate
+			}
+		}
+		if cookie == nil || !cookie.HttpOnly || cookie.Secure != secure || cookie.SameSite != http.SameSiteLaxMode {
+			t.Fatalf("unexpected session cookie %v with TLS %v", cookie, secure)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package heracles
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alioygur/gores"
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/go-chi/chi"
+)
+
+// How often a sessions last seen time is updated while it is in use
+const sessionTouchInterval = time.Minute
+
+// Returns the clients IP, trusting proxy headers only when `web.trust_proxy`
+// is set (e.g. when listening on a unix socket behind nginx).
+func (s *Server) getRequestIP(r *http.Request) string {
+	if s.config.Web.TrustProxy {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+
+		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Returns the session for the auth cookie sent with this request
+func (s *Server) findRequestSession(r *http.Request) (*db.Session, error) {
+	authCookie, err := r.Cookie("heracles-auth")
+	if err != nil {
+		return nil, err
+	}
+
+	return s.store.GetSessionByToken(authCookie.Value)
+}
+
+// Returns the id of the session making this request, or zero if the request
+// was not authenticated with a session cookie.
+func (s *Server) getRequestSessionId(r *http.Request) int64 {
+	session, err := s.findRequestSession(r)
+	if err != nil {
+		return 0
+	}
+	return session.Id
+}
+
+func (s *Server) findUserBySessionToken(r *http.Request, token string) (*db.User, error) {
+	session, err := s.store.GetSessionByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(time.Unix(session.LastSeenAt, 0)) > sessionTouchInterval {
+		err = s.store.TouchSession(session, s.getRequestIP(r))
+		if err != nil {
+			log.Printf("[Session] failed to update last seen for session %v: %v", session.Id, err)
+		}
+	}
+
+	return s.store.GetUserById(session.UserId)
+}
+
+// Creates a new session for the user and hands its token to the client
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user *db.User) error {
+	// Opportunistically clean up after sessions which were never logged out
+	err := s.store.DeleteExpiredSessions()
+	if err != nil {
+		return err
+	}
+
+	lifetime := s.config.Security.SessionLifetime
+	_, token, err := s.store.CreateSession(user.Id, lifetime, s.getRequestIP(r), r.UserAgent())
+	if err != nil {
+		return err
+	}
+
+	cookie := http.Cookie{
+		Name:     "heracles-auth",
+		Domain:   s.config.Web.Domain,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(lifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   s.tlsConfig != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+func (s *Server) GetIdentitySessionsRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	sessions, err := s.store.GetSessionsByUserId(user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+		"current":  s.getRequestSessionId(r),
+	})
+}
+
+// Revokes every session except the one making the request
+func (s *Server) DeleteIdentitySessionsRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	err := s.store.DeleteSessionsByUserId(user.Id, s.getRequestSessionId(r))
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.session_revoke_all", user, nil)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+func (s *Server) DeleteIdentitySessionRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	sessionId, err := strconv.ParseInt(chi.URLParam(r, "sessionId"), 10, 64)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	session, err := s.store.GetSessionById(sessionId)
+	if err == sql.ErrNoRows || (err == nil && session.UserId != user.Id) {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.DeleteSession(session)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.session_revoke", user, map[string]interface{}{
+		"session": session.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+func (s *Server) GetSessionsRoute(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.store.GetSessions()
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+func (s *Server) GetUserSessionsRoute(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(r)
+
+	sessions, err := s.store.GetSessionsByUserId(user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+// Logs the user out everywhere, passing `tokens=1` also deletes all of their
+// tokens.
+func (s *Server) DeleteUserSessionsRoute(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(r)
+	revokeTokens := r.URL.Query().Get("tokens") == "1"
+
+	err := s.store.DeleteSessionsByUserId(user.Id, 0)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	if revokeTokens {
+		err = s.store.DeleteUserTokensByUserId(user.Id)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.session_revoke_all", getCurrentUser(r), map[string]interface{}{
+		"user":   user.Id,
+		"tokens": revokeTokens,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+func (s *Server) DeleteUserSessionRoute(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(r)
+
+	sessionId, err := strconv.ParseInt(chi.URLParam(r, "sessionId"), 10, 64)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	session, err := s.store.GetSessionById(sessionId)
+	if err == sql.ErrNoRows || (err == nil && session.UserId != user.Id) {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.DeleteSession(session)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.session_revoke", getCurrentUser(r), map[string]interface{}{
+		"user":    user.Id,
+		"session": session.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
@@ -0,0 +1,88 @@
+function base64urlToBuffer(value) {
+  value = value.replace(/-/g, '+').replace(/_/g, '/');
+  while (value.length % 4) {
+    value += '=';
+  }
+  return Uint8Array.from(atob(value), c => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64url(buffer) {
+  const bytes = new Uint8Array(buffer);
+  let value = '';
+  for (const b of bytes) {
+    value += String.fromCharCode(b);
+  }
+  return btoa(value).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+async function checkResponse(resp) {
+  if (!resp.ok && resp.type !== 'opaqueredirect') {
+    throw new Error(await resp.text());
+  }
+  return resp;
+}
+
+// Performs a security key login, `username` may be empty when completing the
+// second step of a password login.
+async function heraclesWebAuthnLogin(username, redirect) {
+  const beginResp = await checkResponse(await fetch('/login/webauthn/begin', {
+    method: 'POST',
+    body: new URLSearchParams({username: username}),
+  }));
+
+  const options = (await beginResp.json()).publicKey;
+  options.challenge = base64urlToBuffer(options.challenge);
+  for (const credential of options.allowCredentials || []) {
+    credential.id = base64urlToBuffer(credential.id);
+  }
+
+  const assertion = await navigator.credentials.get({publicKey: options});
+
+  await checkResponse(await fetch('/login/webauthn/finish?r=' + encodeURIComponent(redirect), {
+    method: 'POST',
+    redirect: 'manual',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({
+      id: assertion.id,
+      rawId: bufferToBase64url(assertion.rawId),
+      type: assertion.type,
+      response: {
+        authenticatorData: bufferToBase64url(assertion.response.authenticatorData),
+        clientDataJSON: bufferToBase64url(assertion.response.clientDataJSON),
+        signature: bufferToBase64url(assertion.response.signature),
+        userHandle: assertion.response.userHandle ? bufferToBase64url(assertion.response.userHandle) : null,
+      },
+    }),
+  }));
+
+  window.location = redirect || '/';
+}
+
+async function heraclesWebAuthnRegister(name) {
+  const beginResp = await checkResponse(await fetch('/api/identity/mfa/webauthn/register/begin', {
+    method: 'POST',
+  }));
+
+  const options = (await beginResp.json()).publicKey;
+  options.challenge = base64urlToBuffer(options.challenge);
+  options.user.id = base64urlToBuffer(options.user.id);
+  for (const credential of options.excludeCredentials || []) {
+    credential.id = base64urlToBuffer(credential.id);
+  }
+
+  const credential = await navigator.credentials.create({publicKey: options});
+
+  await checkResponse(await fetch('/api/identity/mfa/webauthn/register/finish?name=' + encodeURIComponent(name), {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({
+      id: credential.id,
+      rawId: bufferToBase64url(credential.rawId),
+      type: credential.type,
+      response: {
+        attestationObject: bufferToBase64url(credential.response.attestationObject),
+        clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+      },
+    }),
+  }));
+}
@@ -8,6 +8,13 @@ import pytest
 import requests_unixsocket
 
 
+# Set TEST_DB_DRIVER=postgres and TEST_DB_PATH to a connection string (e.g.
+#  postgres://heracles@localhost/heracles_test?sslmode=disable) to run the
+#  suite against a local Postgres instead of an in-memory SQLite database.
+DB_DRIVER = os.getenv('TEST_DB_DRIVER', 'sqlite3')
+DB_PATH = os.getenv('TEST_DB_PATH', ':memory:')
+
+
 def get_random_string(size):
     return ''.join([random.choice(string.ascii_letters) for _ in range(size)])
 
@@ -31,7 +38,8 @@ def random_string():
 def heracles(request):
     proc = subprocess.Popen(['./heracles'], env={
         'WEB_BIND': 'unix://testing.sock',
-        'DB_PATH': ':memory:',
+        'DB_DRIVER': DB_DRIVER,
+        'DB_PATH': DB_PATH,
         'SECURITY_SECRET': get_random_string(64),
         'SECURITY_BCRYPT_DIFFICULTY': '1',
     })
@@ -0,0 +1,60 @@
+def test_access_request_approve(admin_session, user_session, random_string):
+    r = admin_session.post('/api/realms', data={
+        'name': random_string(32),
+    })
+    realm = r.json()
+
+    r = user_session.post('/api/identity/access-requests', data={
+        'realm': realm['name'],
+        'reason': 'testing',
+    })
+    assert r.status_code == 200
+    request = r.json()
+    assert request['status'] == 'pending'
+
+    r = user_session.post('/api/identity/access-requests', data={
+        'realm': realm['name'],
+    })
+    assert r.status_code == 409
+
+    r = user_session.post(f"/api/access-requests/{request['id']}/approve")
+    assert r.status_code == 403
+
+    r = admin_session.get('/api/access-requests')
+    assert request in r.json()['requests']
+
+    r = admin_session.post(f"/api/access-requests/{request['id']}/approve")
+    assert r.status_code == 200
+    assert r.json()['status'] == 'approved'
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': realm['name'],
+    })
+    assert r.status_code == 204
+
+
+def test_access_request_owner_deny(admin_session, user_session, random_string):
+    r = admin_session.post('/api/realms', data={
+        'name': random_string(32),
+    })
+    realm = r.json()
+
+    r = admin_session.post(f"/api/realms/{realm['id']}/owners", data={
+        'user_id': user_session.user_id,
+    })
+    assert r.status_code == 200
+
+    r = admin_session.post('/api/identity/access-requests', data={
+        'realm': realm['name'],
+    })
+    request = r.json()
+
+    r = user_session.get('/api/access-requests')
+    assert r.json()['requests'] == [request]
+
+    r = user_session.post(f"/api/access-requests/{request['id']}/deny")
+    assert r.status_code == 200
+    assert r.json()['status'] == 'denied'
+
+    r = user_session.post(f"/api/access-requests/{request['id']}/approve")
+    assert r.status_code == 400
@@ -28,3 +28,43 @@ def test_validate(user_session, user_realm):
         'X-Heracles-Realm': user_realm['name'],
     })
     assert r.status_code == 204
+
+
+def test_logout_revokes_session(user_session_with_password, session):
+    r = session.post('/login', data={
+        'username': user_session_with_password.username,
+        'password': user_session_with_password.password,
+    })
+    assert r.status_code == 204
+    cookie = session.cookies['heracles-auth']
+
+    r = session.post('/logout')
+    assert r.status_code == 204
+
+    r = session.get('/api/identity', cookies={'heracles-auth': cookie})
+    assert r.status_code == 401
+
+
+def test_revoke_session(user_session_with_password, session, heracles):
+    other = type(session)(url_base=heracles)
+    for s in (session, other):
+        r = s.post('/login', data={
+            'username': user_session_with_password.username,
+            'password': user_session_with_password.password,
+        })
+        assert r.status_code == 204
+
+    r = session.get('/api/identity/sessions')
+    assert r.status_code == 200
+    data = r.json()
+    assert len(data['sessions']) == 2
+
+    other_id = [s['id'] for s in data['sessions'] if s['id'] != data['current']][0]
+    r = session.delete(f'/api/identity/sessions/{other_id}')
+    assert r.status_code == 204
+
+    r = other.get('/api/identity')
+    assert r.status_code == 401
+
+    r = session.get('/api/identity')
+    assert r.status_code == 200
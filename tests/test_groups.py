@@ -0,0 +1,58 @@
+def test_create_group(admin_session, random_string):
+    name = random_string(32)
+
+    r = admin_session.post('/api/groups', data={
+        'name': name,
+    })
+    assert r.status_code == 200
+    group = r.json()
+    assert group['name'] == name
+
+    r = admin_session.get('/api/groups')
+    assert group in r.json()['groups']
+
+    r = admin_session.post('/api/groups', data={
+        'name': name,
+    })
+    assert r.status_code == 409
+
+
+def test_group_realm_grant(admin_session, user_session, random_string):
+    r = admin_session.post('/api/realms', data={
+        'name': random_string(32),
+    })
+    realm = r.json()
+
+    r = admin_session.post('/api/groups', data={
+        'name': random_string(32),
+    })
+    group = r.json()
+
+    r = admin_session.post(f"/api/groups/{group['id']}/grants", data={
+        'realm_id': realm['id'],
+    })
+    assert r.status_code == 200
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': realm['name'],
+    })
+    assert r.status_code == 401
+
+    r = admin_session.post(f"/api/groups/{group['id']}/members", data={
+        'user_id': user_session.user_id,
+    })
+    assert r.status_code == 200
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': realm['name'],
+    })
+    assert r.status_code == 204
+    assert r.headers['X-Heracles-User'] == user_session.username
+
+    r = admin_session.delete(f"/api/groups/{group['id']}/members/{user_session.user_id}")
+    assert r.status_code == 204
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': realm['name'],
+    })
+    assert r.status_code == 401
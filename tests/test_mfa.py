@@ -0,0 +1,102 @@
+import time
+import hmac
+import base64
+import struct
+import hashlib
+
+
+def get_totp_code(secret, offset=0):
+    key = base64.b32decode(secret + '=' * (-len(secret) % 8))
+    counter = int(time.time()) // 30 + offset
+    digest = hmac.new(key, struct.pack('>Q', counter), hashlib.sha1).digest()
+    start = digest[-1] & 0xf
+    value = struct.unpack('>I', digest[start:start + 4])[0] & 0x7fffffff
+    return '%06d' % (value % 1000000)
+
+
+def enable_totp(user_session):
+    r = user_session.post('/api/identity/mfa/totp', json={})
+    assert r.status_code == 200
+    secret = r.json()['secret']
+    assert r.json()['uri'].startswith('otpauth://totp/')
+
+    # Confirm with the previous code as codes can't be used twice, leaving the
+    #  current one for the test
+    r = user_session.post('/api/identity/mfa/totp/confirm', data={
+        'code': get_totp_code(secret, -1),
+    })
+    assert r.status_code == 204
+    return secret
+
+
+def test_enable_totp(user_session_with_password):
+    enable_totp(user_session_with_password)
+
+    r = user_session_with_password.post('/api/identity/mfa/totp', json={})
+    assert r.status_code == 409
+
+
+def test_login_totp(user_session_with_password, session):
+    secret = enable_totp(user_session_with_password)
+
+    r = session.post('/login', data={
+        'username': user_session_with_password.username,
+        'password': user_session_with_password.password,
+    }, allow_redirects=False)
+    assert r.status_code == 302
+    assert r.headers['Location'] == '/login/mfa'
+
+    r = session.post('/login/totp', data={
+        'code': get_totp_code(secret, 10),
+    })
+    assert r.status_code == 400
+
+    r = session.post('/login/totp', data={
+        'code': get_totp_code(secret),
+    })
+    assert r.status_code == 204
+
+    r = session.get('/api/identity')
+    assert r.status_code == 200
+
+
+def test_login_totp_inline(user_session_with_password, session):
+    secret = enable_totp(user_session_with_password)
+
+    r = session.post('/login', data={
+        'username': user_session_with_password.username,
+        'password': user_session_with_password.password,
+        'code': get_totp_code(secret),
+    })
+    assert r.status_code == 204
+
+
+def test_basic_auth_totp(user_session_with_password, session):
+    enable_totp(user_session_with_password)
+
+    r = session.get('/api/identity', auth=(
+        user_session_with_password.username,
+        user_session_with_password.password,
+    ))
+    assert r.status_code == 401
+
+    r = session.get('/api/identity', auth=(
+        user_session_with_password.username,
+        user_session_with_password.token['token'],
+    ))
+    assert r.status_code == 200
+
+
+def test_disable_totp(user_session_with_password, session):
+    secret = enable_totp(user_session_with_password)
+
+    r = user_session_with_password.delete('/api/identity/mfa/totp', data={
+        'code': get_totp_code(secret),
+    })
+    assert r.status_code == 204
+
+    r = session.post('/login', data={
+        'username': user_session_with_password.username,
+        'password': user_session_with_password.password,
+    })
+    assert r.status_code == 204
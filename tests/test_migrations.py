@@ -0,0 +1,137 @@
+import hashlib
+import os
+import sqlite3
+import subprocess
+
+import pytest
+
+from conftest import DB_DRIVER
+
+# The schema as it was before migrations were tracked
+OLD_SCHEMA = '''
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY,
+    username TEXT,
+    password TEXT,
+    flags INTEGER,
+    discord_id INTEGER
+);
+CREATE TABLE user_tokens (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER,
+    name TEXT,
+    token TEXT,
+    flags INTEGER
+);
+CREATE TABLE realms (
+    id INTEGER PRIMARY KEY,
+    name TEXT
+);
+CREATE TABLE user_realm_grants (
+    user_id INTEGER,
+    realm_id INTEGER,
+    alias TEXT,
+
+    PRIMARY KEY (user_id, realm_id)
+);
+CREATE TABLE audit_log_entries (
+    id INTEGER PRIMARY KEY,
+    action TEXT,
+    user_id INTEGER,
+    created_at INTEGER,
+    data TEXT
+);
+'''
+
+
+def run_migrate(path):
+    return subprocess.run(['./heracles', 'migrate'], env={
+        'DB_PATH': path,
+    }, check=True)
+
+
+def get_columns(conn, table):
+    return [row[1] for row in conn.execute(f'PRAGMA table_info({table})')]
+
+
+@pytest.mark.skipif(DB_DRIVER != 'sqlite3', reason='builds the old database with sqlite')
+def test_migrate_old_database(tmp_path, random_string):
+    path = str(tmp_path / 'old.db')
+    token = random_string(64)
+
+    conn = sqlite3.connect(path)
+    conn.executescript(OLD_SCHEMA)
+    conn.execute("INSERT INTO users (username, password, flags) VALUES ('admin', '', 1)")
+    conn.execute("INSERT INTO user_tokens (user_id, name, token, flags) VALUES (1, 'old', ?, 1)", (token, ))
+    conn.execute("INSERT INTO realms (name) VALUES ('old')")
+    conn.execute("INSERT INTO realms (name) VALUES ('old.child')")
+    conn.execute("INSERT INTO user_realm_grants (user_id, realm_id) VALUES (1, 1)")
+    conn.commit()
+    conn.close()
+
+    run_migrate(path)
+
+    conn = sqlite3.connect(path)
+    versions = [row[0] for row in conn.execute('SELECT version FROM schema_migrations ORDER BY version')]
+    assert versions == list(range(1, len(versions) + 1))
+
+    assert 'expires_at' in get_columns(conn, 'user_realm_grants')
+    assert 'last_used_at' in get_columns(conn, 'user_tokens')
+    assert conn.execute('SELECT COUNT(*) FROM user_realm_grants').fetchone()[0] == 1
+
+    # Dotted realm names don't imply a parent
+    assert conn.execute('SELECT COUNT(*) FROM realms WHERE parent_id IS NOT NULL').fetchone()[0] == 0
+
+    row = conn.execute('SELECT token, token_hash, token_prefix FROM user_tokens').fetchone()
+    assert row == (None, hashlib.sha256(token.encode()).hexdigest(), token[:8])
+    conn.close()
+
+    # Running again has nothing left to apply
+    run_migrate(path)
+
+    conn = sqlite3.connect(path)
+    assert conn.execute('SELECT COUNT(*) FROM schema_migrations').fetchone()[0] == len(versions)
+    conn.close()
+
+    os.remove(path)
+
+
+@pytest.mark.skipif(DB_DRIVER != 'sqlite3', reason='builds the old database with sqlite')
+def test_migrate_token_realm_names(tmp_path):
+    path = str(tmp_path / 'old.db')
+
+    conn = sqlite3.connect(path)
+    conn.executescript(OLD_SCHEMA)
+    conn.executescript('''
+    CREATE TABLE user_token_realms (
+        token_id INTEGER,
+        realm TEXT,
+
+        PRIMARY KEY (token_id, realm)
+    );
+    CREATE TABLE user_token_scopes (
+        token_id INTEGER,
+        scope TEXT,
+
+        PRIMARY KEY (token_id, scope)
+    );
+    ''')
+    conn.execute("INSERT INTO realms (name) VALUES ('kept')")
+    for name in ('partial', 'stale'):
+        conn.execute("INSERT INTO user_tokens (user_id, name, token, flags) VALUES (1, ?, ?, 1)", (name, name))
+    conn.execute("INSERT INTO user_token_realms (token_id, realm) VALUES (1, 'kept'), (1, 'deleted'), (2, 'deleted')")
+    conn.execute("INSERT INTO user_token_scopes (token_id, scope) VALUES (1, 'identity'), (2, 'identity')")
+    conn.commit()
+    conn.close()
+
+    run_migrate(path)
+
+    # Restrictions now reference realms by id, tokens only restricted to realms
+    #  which no longer exist are gone rather than left unrestricted.
+    conn = sqlite3.connect(path)
+    assert conn.execute('SELECT token_id, realm_id FROM user_token_realms').fetchall() == [(1, 1)]
+    assert conn.execute('SELECT id FROM user_tokens').fetchall() == [(1, )]
+    assert conn.execute('SELECT token_id FROM user_token_scopes').fetchall() == [(1, )]
+    conn.close()
+
+    os.remove(path)
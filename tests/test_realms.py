@@ -1,3 +1,5 @@
+import time
+
 import pytest
 
 
@@ -44,3 +46,140 @@ def test_create_realm_grant(alias, admin_session, user_session, random_string):
         'X-Heracles-Realm': realm['name'],
     })
     assert r.status_code == 204
+
+
+def test_update_realm(admin_session, user_realm, random_string):
+    name = random_string(32)
+
+    r = admin_session.patch(f"/api/realms/{user_realm['id']}", json={
+        'name': name,
+    })
+    assert r.status_code == 200
+    assert r.json()['name'] == name
+
+    r = admin_session.get(f"/api/realms/{user_realm['id']}")
+    assert r.status_code == 200
+    assert r.json()['name'] == name
+
+
+def test_update_and_revoke_realm_grant(admin_session, user_session, user_realm):
+    r = admin_session.get(f"/api/realms/{user_realm['id']}/grants")
+    assert r.status_code == 200
+    assert [g['user_id'] for g in r.json()['grants']] == [user_session.user_id]
+
+    r = admin_session.patch(f"/api/realms/{user_realm['id']}/grants/{user_session.user_id}", json={
+        'alias': 'test_alias',
+    })
+    assert r.status_code == 200
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': user_realm['name'],
+    })
+    assert r.status_code == 204
+    assert r.headers['X-Heracles-User'] == 'test_alias'
+
+    r = admin_session.delete(f"/api/realms/{user_realm['id']}/grants/{user_session.user_id}")
+    assert r.status_code == 204
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': user_realm['name'],
+    })
+    assert r.status_code == 401
+
+
+def test_delete_realm(admin_session, user_session, user_realm):
+    r = admin_session.delete(f"/api/realms/{user_realm['id']}")
+    assert r.status_code == 204
+
+    r = admin_session.get('/api/realms')
+    assert user_realm not in r.json()['realms']
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': user_realm['name'],
+    })
+    assert r.status_code == 401
+
+
+def test_realm_roles(admin_session, user_session, user_realm):
+    for name, level in [('viewer', 10), ('editor', 20)]:
+        r = admin_session.post(f"/api/realms/{user_realm['id']}/roles", json={
+            'name': name,
+            'level': level,
+        })
+        assert r.status_code == 200
+
+    r = admin_session.put(f"/api/realms/{user_realm['id']}/grants/{user_session.user_id}/roles", json={
+        'roles': ['viewer'],
+    })
+    assert r.status_code == 204
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': user_realm['name'],
+        'X-Heracles-Required-Role': 'viewer',
+    })
+    assert r.status_code == 204
+    assert r.headers['X-Heracles-Roles'] == 'viewer'
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': user_realm['name'],
+        'X-Heracles-Required-Role': 'editor',
+    })
+    assert r.status_code == 403
+
+
+def test_realm_hierarchy(admin_session, user_session, user_realm, random_string):
+    # Sharing a dotted prefix alone gives no access
+    r = admin_session.post('/api/realms', data={
+        'name': f"{user_realm['name']}.{random_string(8)}",
+    })
+    assert r.status_code == 200
+    child = r.json()
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': child['name'],
+    })
+    assert r.status_code == 401
+
+    r = admin_session.put(f"/api/realms/{child['id']}/parent", json={
+        'parent_id': user_realm['id'],
+    })
+    assert r.status_code == 200
+    assert r.json()['parent_id'] == user_realm['id']
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': child['name'],
+    })
+    assert r.status_code == 204
+
+    r = admin_session.put(f"/api/realms/{user_realm['id']}/parent", json={
+        'parent_id': child['id'],
+    })
+    assert r.status_code == 400
+
+    r = admin_session.get(f"/api/users/{user_session.user_id}/realms")
+    assert r.status_code == 200
+    assert sorted(e['realm']['name'] for e in r.json()['realms']) == sorted([user_realm['name'], child['name']])
+
+
+def test_time_limited_realm_grant(admin_session, user_session, random_string):
+    r = admin_session.post('/api/realms', data={
+        'name': random_string(32),
+    })
+    realm = r.json()
+
+    r = admin_session.post(f"/api/realms/{realm['id']}/grants", json={
+        'user_id': user_session.user_id,
+        'not_before': int(time.time()) + 3600,
+    })
+    assert r.status_code == 200
+
+    r = user_session.get('/api/validate', headers={
+        'X-Heracles-Realm': realm['name'],
+    })
+    assert r.status_code == 401
+
+    r = admin_session.post(f"/api/realms/{realm['id']}/grants", json={
+        'user_id': user_session.user_id,
+        'expires_at': int(time.time()) - 1,
+    })
+    assert r.status_code == 400
@@ -0,0 +1,121 @@
+from conftest import SessionWithUrlBase
+
+
+def login(heracles, username, password, user_agent):
+    session = SessionWithUrlBase(url_base=heracles)
+    session.headers['User-Agent'] = user_agent
+
+    r = session.post('/login', data={
+        'username': username,
+        'password': password,
+    })
+    assert r.status_code == 204
+    return session
+
+
+def test_list_sessions(heracles, user_session_with_password):
+    first = login(heracles, user_session_with_password.username, user_session_with_password.password, 'first')
+    second = login(heracles, user_session_with_password.username, user_session_with_password.password, 'second')
+
+    r = first.get('/api/identity/sessions')
+    assert r.status_code == 200
+    sessions = r.json()['sessions']
+    assert sorted(s['user_agent'] for s in sessions) == ['first', 'second']
+    assert all(s['user_id'] == user_session_with_password.user_id for s in sessions)
+    assert all('token_hash' not in s for s in sessions)
+
+    current = [s for s in sessions if s['id'] == r.json()['current']]
+    assert len(current) == 1 and current[0]['user_agent'] == 'first'
+
+    r = second.get('/api/identity/sessions')
+    assert r.status_code == 200
+    assert r.json()['current'] != current[0]['id']
+
+    # Token authenticated requests don't belong to any session
+    r = user_session_with_password.get('/api/identity/sessions')
+    assert r.status_code == 200
+    assert r.json()['current'] == 0
+
+
+def test_revoke_session(heracles, admin_session, user_session_with_password):
+    first = login(heracles, user_session_with_password.username, user_session_with_password.password, 'first')
+    second = login(heracles, user_session_with_password.username, user_session_with_password.password, 'second')
+
+    r = second.get('/api/identity/sessions')
+    second_id = r.json()['current']
+
+    # Sessions belonging to other users are hidden
+    r = admin_session.delete(f'/api/identity/sessions/{second_id}')
+    assert r.status_code == 404
+
+    r = first.delete(f'/api/identity/sessions/{second_id}')
+    assert r.status_code == 204
+
+    # The revoked cookie is rejected while the other keeps working
+    r = second.get('/api/identity')
+    assert r.status_code == 401
+
+    r = first.get('/api/identity')
+    assert r.status_code == 200
+
+    r = first.get('/api/identity/sessions')
+    assert [s['user_agent'] for s in r.json()['sessions']] == ['first']
+
+    r = first.delete(f'/api/identity/sessions/{second_id}')
+    assert r.status_code == 404
+
+
+def test_revoke_all_sessions(heracles, user_session_with_password):
+    sessions = [
+        login(heracles, user_session_with_password.username, user_session_with_password.password, user_agent)
+        for user_agent in ('first', 'second', 'third')
+    ]
+
+    r = sessions[0].delete('/api/identity/sessions')
+    assert r.status_code == 204
+
+    # Every session except the one revoking them is logged out
+    r = sessions[0].get('/api/identity')
+    assert r.status_code == 200
+
+    for session in sessions[1:]:
+        r = session.get('/api/identity')
+        assert r.status_code == 401
+
+    r = sessions[0].get('/api/identity/sessions')
+    assert [s['user_agent'] for s in r.json()['sessions']] == ['first']
+
+
+def test_admin_revoke_sessions(heracles, admin_session, user_session_with_password):
+    first = login(heracles, user_session_with_password.username, user_session_with_password.password, 'first')
+    second = login(heracles, user_session_with_password.username, user_session_with_password.password, 'second')
+
+    r = admin_session.get(f'/api/users/{user_session_with_password.user_id}/sessions')
+    assert r.status_code == 200
+    sessions = {s['user_agent']: s['id'] for s in r.json()['sessions']}
+    assert sorted(sessions) == ['first', 'second']
+
+    r = admin_session.delete(f"/api/users/{user_session_with_password.user_id}/sessions/{sessions['first']}")
+    assert r.status_code == 204
+
+    r = first.get('/api/identity')
+    assert r.status_code == 401
+
+    r = second.get('/api/identity')
+    assert r.status_code == 200
+
+    r = admin_session.delete(f'/api/users/{user_session_with_password.user_id}/sessions')
+    assert r.status_code == 204
+
+    r = second.get('/api/identity')
+    assert r.status_code == 401
+
+    # Tokens survive unless explicitly revoked as well
+    r = user_session_with_password.get('/api/identity')
+    assert r.status_code == 200
+
+    r = admin_session.delete(f'/api/users/{user_session_with_password.user_id}/sessions?tokens=1')
+    assert r.status_code == 204
+
+    r = user_session_with_password.get('/api/identity')
+    assert r.status_code == 401
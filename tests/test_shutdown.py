@@ -0,0 +1,73 @@
+import signal
+import socket
+import subprocess
+import time
+
+from conftest import DB_DRIVER, DB_PATH, SessionWithUrlBase
+
+
+def start_heracles(tmp_path, random_string):
+    return subprocess.Popen(['./heracles'], env={
+        'WEB_BIND': 'unix://' + str(tmp_path / 'heracles.sock'),
+        'DB_DRIVER': DB_DRIVER,
+        'DB_PATH': DB_PATH,
+        'SECURITY_SECRET': random_string(64),
+        'SECURITY_BCRYPT_DIFFICULTY': '1',
+    }, stderr=subprocess.PIPE)
+
+
+def test_shutdown_removes_socket(tmp_path, random_string):
+    path = tmp_path / 'heracles.sock'
+    proc = start_heracles(tmp_path, random_string)
+    time.sleep(1)
+
+    try:
+        session = SessionWithUrlBase(url_base='http+unix://' + str(path).replace('/', '%2F'))
+        r = session.get('/login')
+        assert r.status_code == 200
+    finally:
+        proc.send_signal(signal.SIGTERM)
+        _, stderr = proc.communicate(timeout=10)
+
+    assert proc.returncode == 0
+    assert b'Shut down cleanly' in stderr
+    assert not path.exists()
+
+
+def test_stale_socket_is_removed(tmp_path, random_string):
+    path = tmp_path / 'heracles.sock'
+
+    # Left behind by a process which was killed
+    stale = socket.socket(socket.AF_UNIX)
+    stale.bind(str(path))
+    stale.close()
+    assert path.exists()
+
+    proc = start_heracles(tmp_path, random_string)
+    time.sleep(1)
+
+    try:
+        session = SessionWithUrlBase(url_base='http+unix://' + str(path).replace('/', '%2F'))
+        r = session.get('/login')
+        assert r.status_code == 200
+    finally:
+        proc.send_signal(signal.SIGTERM)
+        _, stderr = proc.communicate(timeout=10)
+
+    assert b'Removing stale socket' in stderr
+
+
+def test_socket_in_use_is_kept(tmp_path, random_string):
+    path = tmp_path / 'heracles.sock'
+    first = start_heracles(tmp_path, random_string)
+    time.sleep(1)
+
+    try:
+        second = start_heracles(tmp_path, random_string)
+        _, stderr = second.communicate(timeout=10)
+        assert second.returncode != 0
+        assert b'in use by another process' in stderr
+        assert path.exists()
+    finally:
+        first.send_signal(signal.SIGTERM)
+        first.communicate(timeout=10)
@@ -0,0 +1,84 @@
+import subprocess
+import time
+
+import pytest
+import requests
+
+from conftest import DB_DRIVER, DB_PATH
+
+TLS_PORT = 18443
+REDIRECT_PORT = 18080
+
+
+def openssl(*args):
+    subprocess.run(['openssl'] + list(args), check=True, capture_output=True)
+
+
+def self_signed(tmp_path, name, cn):
+    openssl(
+        'req', '-x509', '-newkey', 'rsa:2048', '-nodes', '-days', '1',
+        '-keyout', str(tmp_path / f'{name}.key'), '-out', str(tmp_path / f'{name}.pem'),
+        '-subj', f'/CN={cn}', '-addext', f'subjectAltName=DNS:{cn}',
+    )
+
+
+def signed_by_ca(tmp_path, name, cn):
+    openssl(
+        'req', '-newkey', 'rsa:2048', '-nodes', '-subj', f'/CN={cn}',
+        '-keyout', str(tmp_path / f'{name}.key'), '-out', str(tmp_path / f'{name}.csr'),
+    )
+    openssl(
+        'x509', '-req', '-days', '1', '-CAcreateserial',
+        '-in', str(tmp_path / f'{name}.csr'), '-out', str(tmp_path / f'{name}.pem'),
+        '-CA', str(tmp_path / 'ca.pem'), '-CAkey', str(tmp_path / 'ca.key'),
+    )
+
+
+@pytest.fixture
+def tls_heracles(tmp_path, random_string):
+    self_signed(tmp_path, 'ca', 'Test CA')
+    self_signed(tmp_path, 'server', 'localhost')
+    signed_by_ca(tmp_path, 'admin', 'admin')
+    self_signed(tmp_path, 'untrusted', 'admin')
+
+    proc = subprocess.Popen(['./heracles'], env={
+        'WEB_BIND': f'127.0.0.1:{TLS_PORT}',
+        'WEB_TLS_CERT': str(tmp_path / 'server.pem'),
+        'WEB_TLS_KEY': str(tmp_path / 'server.key'),
+        'WEB_TLS_CLIENT_CA': str(tmp_path / 'ca.pem'),
+        'WEB_TLS_REDIRECT_BIND': f'127.0.0.1:{REDIRECT_PORT}',
+        'DB_DRIVER': DB_DRIVER,
+        'DB_PATH': DB_PATH,
+        'SECURITY_SECRET': random_string(64),
+        'SECURITY_BCRYPT_DIFFICULTY': '1',
+    })
+    time.sleep(1)
+
+    yield tmp_path
+
+    proc.terminate()
+    proc.wait(timeout=10)
+
+
+def test_tls_client_certificate(tls_heracles):
+    url = f'https://localhost:{TLS_PORT}/api/identity'
+    verify = str(tls_heracles / 'server.pem')
+
+    r = requests.get(url, verify=verify)
+    assert r.status_code == 401
+
+    cert = (str(tls_heracles / 'admin.pem'), str(tls_heracles / 'admin.key'))
+    r = requests.get(url, verify=verify, cert=cert)
+    assert r.status_code == 200
+    assert r.json()['username'] == 'admin'
+
+    # Certificates from other CAs are rejected during the handshake
+    cert = (str(tls_heracles / 'untrusted.pem'), str(tls_heracles / 'untrusted.key'))
+    with pytest.raises(requests.exceptions.ConnectionError):
+        requests.get(url, verify=verify, cert=cert)
+
+
+def test_tls_redirect(tls_heracles):
+    r = requests.get(f'http://localhost:{REDIRECT_PORT}/login?r=test', allow_redirects=False)
+    assert r.status_code == 301
+    assert r.headers['Location'] == f'https://localhost:{TLS_PORT}/login?r=test'
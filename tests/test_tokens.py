@@ -1,10 +1,16 @@
+import time
+
 import pytest
 
 
 def test_get_tokens(user_session):
     r = user_session.get('/api/tokens')
     assert r.status_code == 200
-    assert r.json()['tokens'] == [user_session.token]
+
+    tokens = r.json()['tokens']
+    assert [token['id'] for token in tokens] == [user_session.token['id']]
+    assert tokens[0]['token_prefix'] == user_session.token['token'][:8]
+    assert 'token' not in tokens[0]
 
 
 @pytest.mark.parametrize('admin,private', [(True, True), (False, True), (True, False), (False, False)])
@@ -63,11 +69,274 @@ def test_patch_token(admin, user_token, user_session, admin_session, random_stri
 def test_delete_token(admin, user_token, user_session, admin_session):
     r = user_session.get('/api/tokens')
     assert r.status_code == 200
-    assert user_token in r.json()['tokens']
+    assert user_token['id'] in [token['id'] for token in r.json()['tokens']]
 
     r = (admin_session if admin else user_session).delete(f"/api/tokens/{user_token['id']}")
     assert r.status_code == 204
 
     r = user_session.get('/api/tokens')
     assert r.status_code == 200
-    assert r.json()['tokens'] == [user_session.token]
+    assert [token['id'] for token in r.json()['tokens']] == [user_session.token['id']]
+
+
+def test_token_realm_restriction(session, user_session, admin_session, user_realm, random_string):
+    r = admin_session.post('/api/realms', data={
+        'name': random_string(32),
+    })
+    other_realm = r.json()
+
+    r = admin_session.post(f"/api/realms/{other_realm['id']}/grants", data={
+        'user_id': user_session.user_id,
+    })
+    assert r.status_code == 200
+
+    r = user_session.post('/api/tokens', data={
+        'name': random_string(32),
+        'realms': [user_realm['name']],
+    })
+    assert r.status_code == 200
+    token = r.json()
+    assert token['realms'] == [user_realm['name']]
+
+    r = session.get('/api/validate', headers={
+        'Authorization': token['token'],
+        'X-Heracles-Realm': user_realm['name'],
+    })
+    assert r.status_code == 204
+
+    r = session.get('/api/validate', headers={
+        'Authorization': token['token'],
+        'X-Heracles-Realm': other_realm['name'],
+    })
+    assert r.status_code == 401
+
+
+
+def test_token_realm_restriction_follows_realm(session, user_session, admin_session, user_realm, random_string):
+    r = user_session.post('/api/tokens', data={
+        'name': random_string(32),
+        'realms': [user_realm['name']],
+    })
+    assert r.status_code == 200
+    token = r.json()
+
+    new_name = random_string(32)
+    r = admin_session.patch(f"/api/realms/{user_realm['id']}", json={
+        'name': new_name,
+    })
+    assert r.status_code == 200
+
+    # A new realm taking the old name doesn't inherit the restriction
+    r = admin_session.post('/api/realms', data={
+        'name': user_realm['name'],
+    })
+    impostor = r.json()
+
+    r = admin_session.post(f"/api/realms/{impostor['id']}/grants", data={
+        'user_id': user_session.user_id,
+    })
+    assert r.status_code == 200
+
+    r = user_session.get('/api/tokens')
+    assert [t['realms'] for t in r.json()['tokens'] if t['id'] == token['id']] == [[new_name]]
+
+    r = session.get('/api/validate', headers={
+        'Authorization': token['token'],
+        'X-Heracles-Realm': user_realm['name'],
+    })
+    assert r.status_code == 401
+
+    # Nor does deleting the realm leave the token unrestricted
+    r = admin_session.delete(f"/api/realms/{user_realm['id']}")
+    assert r.status_code == 204
+
+    r = session.get('/api/validate', headers={
+        'Authorization': token['token'],
+        'X-Heracles-Realm': user_realm['name'],
+    })
+    assert r.status_code == 401
+
+    r = user_session.get('/api/tokens')
+    assert token['id'] not in [t['id'] for t in r.json()['tokens']]
+
+def test_token_scopes(session, user_session, random_string):
+    r = user_session.post('/api/tokens', data={
+        'name': random_string(32),
+        'scopes': ['identity:read'],
+    })
+    assert r.status_code == 200
+    token = r.json()
+
+    r = session.get('/api/identity', headers={
+        'Authorization': token['token'],
+    })
+    assert r.status_code == 200
+
+    r = session.get('/api/tokens', headers={
+        'Authorization': token['token'],
+    })
+    assert r.status_code == 403
+
+    r = user_session.post('/api/tokens', data={
+        'name': random_string(32),
+        'scopes': ['bogus'],
+    })
+    assert r.status_code == 400
+
+
+def test_restricted_token_cannot_manage_broader_tokens(session, user_token, user_session, user_realm, random_string):
+    r = user_session.post('/api/tokens', data={
+        'name': random_string(32),
+        'realms': [user_realm['name']],
+        'scopes': ['tokens'],
+    })
+    assert r.status_code == 200
+    restricted = r.json()
+
+    headers = {'Authorization': restricted['token']}
+
+    # user_token has no restrictions, so resetting it would escalate access
+    r = session.patch(f"/api/tokens/{user_token['id']}", json={
+        'reset_token': True,
+    }, headers=headers)
+    assert r.status_code == 403
+
+    r = session.delete(f"/api/tokens/{user_token['id']}", headers=headers)
+    assert r.status_code == 403
+
+    r = session.patch(f"/api/tokens/{restricted['id']}", json={
+        'name': random_string(32),
+    }, headers=headers)
+    assert r.status_code == 200
+
+
+def test_token_expiry(session, user_session, random_string):
+    r = user_session.post('/api/tokens', data={
+        'name': random_string(32),
+        'expires_at': int(time.time()) + 2,
+    })
+    assert r.status_code == 200
+    token = r.json()
+    assert token['created_at'] is not None
+    assert token['last_used_at'] is None
+
+    r = session.get('/api/identity', headers={
+        'Authorization': token['token'],
+    })
+    assert r.status_code == 200
+
+    r = user_session.get('/api/tokens')
+    used = next(t for t in r.json()['tokens'] if t['id'] == token['id'])
+    assert used['last_used_at'] is not None
+
+    time.sleep(3)
+
+    r = session.get('/api/identity', headers={
+        'Authorization': token['token'],
+    })
+    assert r.status_code == 401
+
+    r = user_session.post('/api/tokens', data={
+        'name': random_string(32),
+        'expires_at': int(time.time()) - 1,
+    })
+    assert r.status_code == 400
+
+
+def test_reset_token(session, user_token, user_session):
+    r = user_session.patch(f"/api/tokens/{user_token['id']}", json={
+        'reset_token': True,
+    })
+    assert r.status_code == 200
+    new_token = r.json()['token']
+    assert new_token != user_token['token']
+
+    r = session.get('/api/identity', headers={
+        'Authorization': user_token['token'],
+    })
+    assert r.status_code == 401
+
+    r = session.get('/api/identity', headers={
+        'Authorization': new_token,
+    })
+    assert r.status_code == 200
+
+
+def test_reset_token_rejected_patch(session, user_token, user_session):
+    # A reset which fails validation must leave the existing token working
+    r = user_session.patch(f"/api/tokens/{user_token['id']}", json={
+        'reset_token': True,
+        'expires_at': 1,
+    })
+    assert r.status_code == 400
+
+    r = session.get('/api/identity', headers={
+        'Authorization': user_token['token'],
+    })
+    assert r.status_code == 200
+
+
+def test_token_ownership(user_token, user_session, user_session_with_password, random_string):
+    other_session = user_session_with_password
+
+    r = other_session.patch(f"/api/tokens/{user_token['id']}", data={
+        'name': random_string(32),
+    })
+    assert r.status_code == 404
+
+    r = other_session.delete(f"/api/tokens/{user_token['id']}")
+    assert r.status_code == 404
+
+    r = user_session.get('/api/tokens')
+    assert user_token['id'] in [token['id'] for token in r.json()['tokens']]
+
+
+def test_admin_tokens(user_token, user_session, admin_session):
+    r = admin_session.get('/api/users/tokens', params={
+        'name': user_token['name'],
+    })
+    assert r.status_code == 200
+    assert [token['id'] for token in r.json()['tokens']] == [user_token['id']]
+
+    r = admin_session.get('/api/users/tokens', params={
+        'prefix': user_token['token_prefix'],
+    })
+    assert user_token['id'] in [token['id'] for token in r.json()['tokens']]
+
+    r = user_session.get('/api/users/tokens')
+    assert r.status_code == 401
+
+    r = admin_session.get(f"/api/users/{user_session.user_id}/tokens")
+    assert user_token['id'] in [token['id'] for token in r.json()['tokens']]
+
+    r = admin_session.delete(f"/api/users/{user_session.user_id}/tokens/{user_token['id']}")
+    assert r.status_code == 204
+
+    r = user_session.get('/api/tokens')
+    assert user_token['id'] not in [token['id'] for token in r.json()['tokens']]
+
+
+def test_admin_token_needs_admin_scope(session, user_token, admin_session, random_string):
+    r = admin_session.post('/api/tokens', data={
+        'name': random_string(32),
+        'scopes': ['tokens'],
+    })
+    assert r.status_code == 200
+    headers = {'Authorization': r.json()['token']}
+
+    r = session.patch(f"/api/tokens/{user_token['id']}", json={
+        'reset_token': True,
+    }, headers=headers)
+    assert r.status_code == 404
+
+    r = session.delete(f"/api/tokens/{user_token['id']}", headers=headers)
+    assert r.status_code == 404
+
+    r = admin_session.post('/api/tokens', data={
+        'name': random_string(32),
+    })
+    assert r.status_code == 200
+    headers = {'Authorization': r.json()['token']}
+
+    r = session.delete(f"/api/tokens/{user_token['id']}", headers=headers)
+    assert r.status_code == 204
@@ -0,0 +1,56 @@
+def test_get_user(admin_session, user_session):
+    r = admin_session.get(f'/api/users/{user_session.user_id}')
+    assert r.status_code == 200
+    assert r.json()['username'] == user_session.username
+
+    r = admin_session.get('/api/users/999999')
+    assert r.status_code == 404
+
+
+def test_patch_user(admin_session, user_session, random_string):
+    username = random_string(32)
+
+    r = admin_session.patch(f'/api/users/{user_session.user_id}', json={
+        'username': username,
+        'discord_id': 1234,
+    })
+    assert r.status_code == 200
+    assert r.json()['username'] == username
+    assert r.json()['discord_id'] == 1234
+
+    r = admin_session.patch(f'/api/users/{user_session.user_id}', json={
+        'username': 'admin',
+    })
+    assert r.status_code == 409
+
+
+def test_disable_user(admin_session, user_session):
+    r = user_session.get('/api/identity')
+    assert r.status_code == 200
+
+    r = admin_session.patch(f'/api/users/{user_session.user_id}', json={
+        'disabled': True,
+    })
+    assert r.status_code == 200
+
+    r = user_session.get('/api/identity')
+    assert r.status_code == 401
+
+    r = admin_session.patch(f'/api/users/{user_session.user_id}', json={
+        'disabled': False,
+    })
+    assert r.status_code == 200
+
+    r = user_session.get('/api/identity')
+    assert r.status_code == 200
+
+
+def test_delete_user(admin_session, user_session):
+    r = admin_session.delete(f'/api/users/{user_session.user_id}')
+    assert r.status_code == 204
+
+    r = user_session.get('/api/identity')
+    assert r.status_code == 401
+
+    r = admin_session.get(f'/api/users/{user_session.user_id}')
+    assert r.status_code == 404
@@ -0,0 +1,222 @@
+package heracles
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+// How often the certificate and key are checked for changes
+const certificateReloadInterval = 30 * time.Second
+
+var ErrNoClientCertificate = errors.New("No verified client certificate")
+
+// Serves the certificate loaded from disk, swapping in a new one whenever the
+// files change (e.g. after being renewed) without dropping connections.
+type certificateReloader struct {
+	sync.RWMutex
+
+	certPath string
+	keyPath  string
+
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func newCertificateReloader(certPath, keyPath string) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+	return reloader, reloader.Reload()
+}
+
+// Returns the latest modification time of the certificate and key
+func (c *certificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certPath, c.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certificateReloader) Reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.certificate = &certificate
+	c.modTime = modTime
+	c.Unlock()
+	return nil
+}
+
+// Reloads the certificate if either file has changed since it was last loaded
+func (c *certificateReloader) reloadIfChanged() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	c.RLock()
+	changed := !modTime.Equal(c.modTime)
+	c.RUnlock()
+
+	if !changed {
+		return nil
+	}
+
+	log.Printf("[TLS] certificate changed on disk, reloading")
+	return c.Reload()
+}
+
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.certificate, nil
+}
+
+// Loads the certificate and, when client certificates are configured, the CAs
+// they must be signed by. The CAs are only read at startup.
+func (s *Server) initializeTLS() error {
+	config := s.config.Web.TLS
+
+	var err error
+	s.certificates, err = newCertificateReloader(config.Cert, config.Key)
+	if err != nil {
+		return fmt.Errorf("Failed to load TLS certificate: %v", err)
+	}
+
+	s.tlsConfig = &tls.Config{
+		GetCertificate: s.certificates.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if config.ClientCA == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(config.ClientCA)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("No certificates found in %v", config.ClientCA)
+	}
+
+	s.tlsConfig.ClientCAs = pool
+	if config.RequireClientCert {
+		s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		s.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	switch config.ClientCertUsername {
+	case "cn", "email":
+	default:
+		return fmt.Errorf("Unknown web.tls.client_cert_username: %v", config.ClientCertUsername)
+	}
+
+	return nil
+}
+
+// Reloads the TLS certificate and key from disk, e.g. on SIGHUP
+func (s *Server) ReloadCertificate() error {
+	if s.certificates == nil {
+		return nil
+	}
+	return s.certificates.Reload()
+}
+
+func (s *Server) runCertificateReloader(ctx context.Context) {
+	ticker := time.NewTicker(certificateReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := s.certificates.reloadIfChanged()
+		if err != nil {
+			log.Printf("[TLS] failed to reload certificate: %v", err)
+		}
+	}
+}
+
+// Finds the user named by the verified client certificate the request was made
+// with. Certificates which failed verification never get this far.
+func (s *Server) findRequestUserViaClientCert(r *http.Request) (*db.User, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoClientCertificate
+	}
+
+	certificate := r.TLS.VerifiedChains[0][0]
+
+	var username string
+	switch s.config.Web.TLS.ClientCertUsername {
+	case "cn":
+		username = certificate.Subject.CommonName
+	case "email":
+		if len(certificate.EmailAddresses) > 0 {
+			username = certificate.EmailAddresses[0]
+		}
+	}
+
+	if username == "" {
+		return nil, ErrNoClientCertificate
+	}
+
+	user, err := s.store.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	} else if user.IsDisabled() {
+		return nil, ErrUserDisabled
+	}
+
+	return user, nil
+}
+
+// Redirects plain HTTP requests to the same URL on the TLS listener
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	_, port, err := net.SplitHostPort(s.config.Web.Bind)
+	if err == nil && port != "443" && port != "https" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -1,17 +1,78 @@
 package heracles
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/alioygur/gores"
 	"github.com/b1naryth1ef/heracles/db"
 )
 
-func GetTokensRoute(w http.ResponseWriter, r *http.Request) {
+// How often a tokens last used time and IP are updated
+const tokenTouchInterval = time.Minute
+
+// How often expired tokens are purged
+const tokenSweepInterval = time.Minute
+
+// Looks up the owner of a token, recording that the token was used
+func (s *Server) findUserByToken(r *http.Request, token string, isAPI bool) (*db.User, *db.UserToken, error) {
+	userToken, err := s.store.GetUserTokenByToken(token, isAPI)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := s.store.GetUserById(userToken.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ip := s.getRequestIP(r)
+	if userToken.LastUsedAt == nil || *userToken.LastUsedIP != ip ||
+		time.Since(time.Unix(*userToken.LastUsedAt, 0)) > tokenTouchInterval {
+		err = s.store.TouchUserToken(userToken, ip)
+		if err != nil {
+			log.Printf("[Tokens] failed to update last used for token %v: %v", userToken.Id, err)
+		}
+	}
+
+	return user, userToken, nil
+}
+
+// Validates the requested expiry for a token against `security.token_max_lifetime`,
+// reporting an error to the client if it is invalid. When a maximum lifetime is
+// configured tokens without an expiry are given the maximum.
+func (s *Server) resolveTokenExpiry(w http.ResponseWriter, expiresAt *int64) (*int64, bool) {
+	now := time.Now()
+	if expiresAt != nil && *expiresAt <= now.Unix() {
+		gores.Error(w, http.StatusBadRequest, "expires_at must be in the future")
+		return nil, false
+	}
+
+	maxLifetime := s.config.Security.TokenMaxLifetime
+	if maxLifetime <= 0 {
+		return expiresAt, true
+	}
+
+	maxExpiresAt := now.Add(maxLifetime).Unix()
+	if expiresAt == nil {
+		return &maxExpiresAt, true
+	} else if *expiresAt > maxExpiresAt {
+		gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Tokens may not be valid for longer than %v", maxLifetime))
+		return nil, false
+	}
+
+	return expiresAt, true
+}
+
+func (s *Server) GetTokensRoute(w http.ResponseWriter, r *http.Request) {
 	user := getCurrentUser(r)
 
-	tokens, err := db.GetUserTokensByUserId(user.Id)
+	tokens, err := s.store.GetUserTokensByUserId(user.Id)
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -22,13 +83,77 @@ func GetTokensRoute(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Validates the realms and scopes requested for a token, reporting an error to
+// the client if they are invalid. Tokens created with a restricted token can
+// not be given more access than it has.
+func (s *Server) checkTokenRestrictions(w http.ResponseWriter, r *http.Request, realms, scopes []string) bool {
+	for _, realm := range realms {
+		_, err := s.store.GetRealmByName(realm)
+		if err == sql.ErrNoRows {
+			gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Unknown realm: %v", realm))
+			return false
+		} else if err != nil {
+			reportInternalError(w, err)
+			return false
+		}
+	}
+
+	for _, scope := range scopes {
+		if !db.IsValidUserTokenScope(scope) {
+			gores.Error(w, http.StatusBadRequest, fmt.Sprintf("Unknown scope: %v", scope))
+			return false
+		}
+	}
+
+	return s.checkTokenCovers(w, getCurrentAuthToken(r), realms, scopes)
+}
+
+// Checks that a token restricted to the given realms and scopes would have no
+// more access than authToken, which requests not made with a token always
+// have.
+func (s *Server) checkTokenCovers(w http.ResponseWriter, authToken *db.UserToken, realms, scopes []string) bool {
+	if authToken == nil {
+		return true
+	}
+
+	if len(authToken.Realms) > 0 && len(realms) == 0 {
+		gores.Error(w, http.StatusForbidden, "Token must be restricted to realms")
+		return false
+	}
+	for _, realm := range realms {
+		if !s.tokenAllowsRealm(authToken, realm) {
+			gores.Error(w, http.StatusForbidden, fmt.Sprintf("Token cannot grant access to realm: %v", realm))
+			return false
+		}
+	}
+
+	if len(authToken.Scopes) > 0 && len(scopes) == 0 {
+		gores.Error(w, http.StatusForbidden, "Token must be restricted to scopes")
+		return false
+	}
+	for _, scope := range scopes {
+		name := strings.TrimSuffix(scope, ":read")
+		if !authToken.HasScope(name, name != scope) {
+			gores.Error(w, http.StatusForbidden, fmt.Sprintf("Token cannot grant scope: %v", scope))
+			return false
+		}
+	}
+
+	return true
+}
+
 type CreateTokenPayload struct {
 	Name         string `json:"name" schema:"name"`
 	UserId       *int64 `json:"user_id" schema:"user_id"`
 	CanAccessAPI *bool  `json:"can_access_api" schema:"can_access_api"`
+	ExpiresAt    *int64 `json:"expires_at" schema:"expires_at"`
+
+	// Optionally restricts the realms and API scopes the token can be used for
+	Realms []string `json:"realms" schema:"realms"`
+	Scopes []string `json:"scopes" schema:"scopes"`
 }
 
-func PostTokensRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PostTokensRoute(w http.ResponseWriter, r *http.Request) {
 	var payload CreateTokenPayload
 	if !readRequestData(w, r, &payload) {
 		return
@@ -37,13 +162,15 @@ func PostTokensRoute(w http.ResponseWriter, r *http.Request) {
 	user := getCurrentUser(r)
 
 	if payload.UserId != nil {
-		if !user.IsAdmin() {
+		// Admins using a token also need it to have the admin scope
+		authToken := getCurrentAuthToken(r)
+		if !user.IsAdmin() || (authToken != nil && !authToken.HasScope(db.USER_TOKEN_SCOPE_ADMIN, false)) {
 			gores.Error(w, http.StatusForbidden, "Cannot create tokens for another user")
 			return
 		}
 
 		var err error
-		user, err = db.GetUserById(*payload.UserId)
+		user, err = s.store.GetUserById(*payload.UserId)
 		if err == sql.ErrNoRows {
 			gores.Error(w, http.StatusBadRequest, "Unknown User")
 			return
@@ -53,12 +180,21 @@ func PostTokensRoute(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if !s.checkTokenRestrictions(w, r, payload.Realms, payload.Scopes) {
+		return
+	}
+
+	expiresAt, ok := s.resolveTokenExpiry(w, payload.ExpiresAt)
+	if !ok {
+		return
+	}
+
 	var flags db.Bits
 	if payload.CanAccessAPI == nil || *payload.CanAccessAPI {
 		flags = flags.Set(db.USER_TOKEN_FLAG_API)
 	}
 
-	token, err := db.CreateUserToken(user.Id, payload.Name, flags)
+	token, err := s.store.CreateUserToken(user.Id, payload.Name, flags, expiresAt, payload.Realms, payload.Scopes)
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -67,9 +203,9 @@ func PostTokensRoute(w http.ResponseWriter, r *http.Request) {
 	gores.JSON(w, http.StatusOK, token)
 }
 
-func DeleteTokenRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) DeleteTokenRoute(w http.ResponseWriter, r *http.Request) {
 	userToken := getCurrentUserToken(r)
-	err := userToken.Delete()
+	err := s.store.DeleteUserToken(userToken)
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -79,32 +215,62 @@ func DeleteTokenRoute(w http.ResponseWriter, r *http.Request) {
 }
 
 type PatchTokenPayload struct {
-	Name       *string `json:"name"`
-	ResetToken bool    `json:"reset_token"`
+	Name       *string   `json:"name" schema:"name"`
+	ResetToken bool      `json:"reset_token" schema:"reset_token"`
+	ExpiresAt  *int64    `json:"expires_at" schema:"expires_at"`
+	Realms     *[]string `json:"realms" schema:"realms"`
+	Scopes     *[]string `json:"scopes" schema:"scopes"`
 }
 
-func PatchTokenRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PatchTokenRoute(w http.ResponseWriter, r *http.Request) {
 	var payload PatchTokenPayload
 	if !readRequestData(w, r, &payload) {
 		return
 	}
 
 	userToken := getCurrentUserToken(r)
-	if payload.ResetToken {
-		newToken, err := db.GenerateUserTokenContents()
-		if err != nil {
-			reportInternalError(w, err)
+
+	// Everything is validated before the token is touched so a bad request
+	//  can't leave it half updated, or reset without the new token returned.
+	expiresAt := userToken.ExpiresAt
+	if payload.ExpiresAt != nil {
+		var ok bool
+		expiresAt, ok = s.resolveTokenExpiry(w, payload.ExpiresAt)
+		if !ok {
 			return
 		}
+	}
 
-		userToken.Token = newToken
+	realms, scopes := userToken.Realms, userToken.Scopes
+	if payload.Realms != nil || payload.Scopes != nil {
+		if payload.Realms != nil {
+			realms = *payload.Realms
+		}
+		if payload.Scopes != nil {
+			scopes = *payload.Scopes
+		}
+
+		if !s.checkTokenRestrictions(w, r, realms, scopes) {
+			return
+		}
 	}
 
 	if payload.Name != nil {
 		userToken.Name = *payload.Name
 	}
+	userToken.ExpiresAt = expiresAt
+	userToken.Realms = realms
+	userToken.Scopes = scopes
+
+	if payload.ResetToken {
+		err := userToken.Regenerate()
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	}
 
-	err := userToken.Save()
+	err := s.store.SaveUserToken(userToken)
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -112,3 +278,130 @@ func PatchTokenRoute(w http.ResponseWriter, r *http.Request) {
 
 	gores.JSON(w, http.StatusOK, userToken)
 }
+
+// Searches tokens across all users, `name` matches anywhere within the tokens
+// name and `prefix` matches the start of the token itself.
+func (s *Server) GetAllTokensRoute(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	tokens, err := s.store.SearchUserTokens(query.Get("name"), query.Get("prefix"))
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"tokens": tokens,
+	})
+}
+
+func (s *Server) GetUserTokensRoute(w http.ResponseWriter, r *http.Request) {
+	tokens, err := s.store.GetUserTokensByUserId(getTargetUser(r).Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"tokens": tokens,
+	})
+}
+
+func (s *Server) DeleteUserTokensRoute(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(r)
+
+	err := s.store.DeleteUserTokensByUserId(user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.token_revoke_all", getCurrentUser(r), map[string]interface{}{
+		"user": user.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+func (s *Server) DeleteUserTokenRoute(w http.ResponseWriter, r *http.Request) {
+	user := getTargetUser(r)
+	userToken := getCurrentUserToken(r)
+	if userToken.UserId != user.Id {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	err := s.store.DeleteUserToken(userToken)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.token_revoke", getCurrentUser(r), map[string]interface{}{
+		"user":  user.Id,
+		"token": userToken.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+// Periodically purges tokens which expired more than
+// `security.expired_token_retention` ago. Until then expired tokens are kept
+// (but can not be used) so their owners can see what stopped working.
+func (s *Server) runTokenSweeper(ctx context.Context) {
+	ticker := time.NewTicker(tokenSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		err := s.sweepExpiredTokens()
+		if err != nil {
+			log.Printf("[Tokens] failed to sweep expired tokens: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) sweepExpiredTokens() error {
+	retention := s.config.Security.ExpiredTokenRetention
+
+	tokens, err := s.store.GetUserTokensExpiredBefore(time.Now().Add(-retention).Unix())
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		user, err := s.store.GetUserById(token.UserId)
+		if err != nil {
+			return err
+		}
+
+		err = s.store.DeleteUserToken(&token)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.store.CreateAuditLogEntry("user.token_expire", user, map[string]interface{}{
+			"token":      token.Id,
+			"name":       token.Name,
+			"expires_at": token.ExpiresAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package heracles
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+// Creates a token, authenticating with another token
+func postTestTokenForm(c *testClient, authToken string, form url.Values) *http.Response {
+	c.t.Helper()
+
+	req := c.newRequest("POST", "/api/tokens", bytes.NewReader([]byte(form.Encode())))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", authToken)
+	return c.do(req)
+}
+
+func TestCreateTokenForAnotherUserRequiresAdminScope(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	user, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := newLoggedInClient(t, ts, "admin", "admin")
+
+	var tokens db.UserToken
+	admin.expect(admin.send("POST", "/api/tokens", map[string]interface{}{"name": "tokens", "scopes": []string{db.USER_TOKEN_SCOPE_TOKENS}}), http.StatusOK, &tokens)
+	var full db.UserToken
+	admin.expect(admin.send("POST", "/api/tokens", map[string]interface{}{"name": "full"}), http.StatusOK, &full)
+
+	// A token limited to managing tokens can't be used to act as someone else,
+	//  even for a token it would otherwise cover.
+	c := newTestClient(t, ts)
+	form := url.Values{"name": {"theirs"}, "user_id": {fmt.Sprint(user.Id)}, "scopes": {db.USER_TOKEN_SCOPE_TOKENS}}
+	c.expect(postTestTokenForm(c, tokens.Token, form), http.StatusForbidden)
+
+	var token db.UserToken
+	c.expect(postTestTokenForm(c, full.Token, form), http.StatusOK, &token)
+	if token.UserId != user.Id {
+		t.Fatalf("token was created for %v, not %v", token.UserId, user.Id)
+	}
+}
+
+func grantTestRealms(t *testing.T, store *db.MemoryStore, username string, realms ...db.Realm) {
+	t.Helper()
+
+	user, err := store.GetUserByUsername(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, realm := range realms {
+		_, err = store.CreateUserRealmGrant(user.Id, realm.Id, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTokenRealmsFollowRenamesAndDeletes(t *testing.T) {
+	_, store, ts := newTestServer(t, nil)
+
+	admin := newLoggedInClient(t, ts, "admin", "admin")
+	anonymous := newTestClient(t, ts)
+
+	var infra, grafana db.Realm
+	admin.expect(admin.send("POST", "/api/realms", map[string]string{"name": "infra"}), http.StatusOK, &infra)
+	admin.expect(admin.send("POST", "/api/realms", map[string]string{"name": "grafana"}), http.StatusOK, &grafana)
+	grantTestRealms(t, store, "admin", infra, grafana)
+
+	var single, both db.UserToken
+	admin.expect(admin.send("POST", "/api/tokens", map[string]interface{}{"name": "single", "realms": []string{"infra"}}), http.StatusOK, &single)
+	admin.expect(admin.send("POST", "/api/tokens", map[string]interface{}{"name": "both", "realms": []string{"infra", "grafana"}}), http.StatusOK, &both)
+
+	// A realm taking the old name isn't the one the tokens were restricted to
+	admin.expect(admin.send("PATCH", fmt.Sprintf("/api/realms/%v", infra.Id), map[string]string{"name": "infrastructure"}), http.StatusOK)
+	var impostor db.Realm
+	admin.expect(admin.send("POST", "/api/realms", map[string]string{"name": "infra"}), http.StatusOK, &impostor)
+	grantTestRealms(t, store, "admin", impostor)
+
+	token, err := store.GetUserTokenById(single.Id)
+	if err != nil || len(token.Realms) != 1 || token.Realms[0] != "infrastructure" {
+		t.Fatalf("unexpected token realms %v: %v", token, err)
+	}
+	anonymous.expect(anonymous.get("/api/validate", map[string]string{"X-Heracles-Realm": "infrastructure", "Authorization": single.Token}), http.StatusNoContent)
+	anonymous.expect(anonymous.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra", "Authorization": single.Token}), http.StatusUnauthorized)
+
+	// Deleting the realm mustn't leave either token unrestricted
+	admin.expect(admin.send("DELETE", fmt.Sprintf("/api/realms/%v", infra.Id), nil), http.StatusNoContent)
+
+	_, err = store.GetUserTokenById(single.Id)
+	if err != sql.ErrNoRows {
+		t.Fatalf("token restricted to a deleted realm still exists: %v", err)
+	}
+	anonymous.expect(anonymous.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra", "Authorization": single.Token}), http.StatusUnauthorized)
+
+	token, err = store.GetUserTokenById(both.Id)
+	if err != nil || len(token.Realms) != 1 || token.Realms[0] != "grafana" {
+		t.Fatalf("unexpected token realms %v: %v", token, err)
+	}
+	anonymous.expect(anonymous.get("/api/validate", map[string]string{"X-Heracles-Realm": "infra", "Authorization": both.Token}), http.StatusUnauthorized)
+	anonymous.expect(anonymous.get("/api/validate", map[string]string{"X-Heracles-Realm": "grafana", "Authorization": both.Token}), http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package heracles
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/b1naryth1ef/heracles/db"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpModulo = 1000000
+
+	// Number of periods before and after the current one we accept codes for,
+	//  this allows for some clock drift between the server and the device.
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returns the confirmed TOTP secret for a user, or nil if the user has not
+// enabled TOTP.
+func (s *Server) getUserTOTP(user *db.User) (*db.UserTOTP, error) {
+	userTOTP, err := s.store.GetUserTOTPByUserId(user.Id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !userTOTP.Confirmed {
+		return nil, nil
+	}
+
+	return userTOTP, nil
+}
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func (s *Server) getTOTPProvisioningURI(secret string, username string) string {
+	issuer := s.config.TOTP.Issuer
+
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("digits", fmt.Sprintf("%d", totpDigits))
+	values.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + username,
+		RawQuery: values.Encode(),
+	}
+	return uri.String()
+}
+
+func generateTOTPCode(secret []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulo)
+}
+
+// Checks the code against the secret, returning the time step it was generated
+// for. Codes from lastCounter or any earlier step are never accepted.
+func validateTOTPCode(secret string, code string, lastCounter int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	secretRaw, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	counter := time.Now().Unix() / totpPeriod
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if counter+i <= lastCounter {
+			continue
+		}
+
+		expected := generateTOTPCode(secretRaw, uint64(counter+i))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + i, true
+		}
+	}
+
+	return 0, false
+}
+
+// Checks a code for the user's TOTP secret and marks it as used, so neither it
+// nor any code before it is accepted again.
+func (s *Server) acceptTOTPCode(userTOTP *db.UserTOTP, code string) (bool, error) {
+	counter, ok := validateTOTPCode(userTOTP.Secret, code, userTOTP.LastCounter)
+	if !ok {
+		return false, nil
+	}
+
+	return s.store.UseUserTOTPCounter(userTOTP, counter)
+}
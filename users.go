@@ -1,6 +1,7 @@
 package heracles
 
 import (
+	"database/sql"
 	"net/http"
 
 	"github.com/alioygur/gores"
@@ -14,7 +15,7 @@ type CreateUserPayload struct {
 	DiscordId *int64 `json:"discord_id"`
 }
 
-func PostUsersRoute(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PostUsersRoute(w http.ResponseWriter, r *http.Request) {
 	var payload CreateUserPayload
 
 	if !readRequestData(w, r, &payload) {
@@ -31,7 +32,7 @@ func PostUsersRoute(w http.ResponseWriter, r *http.Request) {
 		flags = flags.Set(db.USER_FLAG_ADMIN)
 	}
 
-	user, err := db.CreateUser(payload.Username, payload.Password, flags, payload.DiscordId)
+	user, err := s.store.CreateUser(payload.Username, payload.Password, flags, payload.DiscordId)
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -40,8 +41,8 @@ func PostUsersRoute(w http.ResponseWriter, r *http.Request) {
 	gores.JSON(w, http.StatusOK, user)
 }
 
-func GetUsersRoute(w http.ResponseWriter, r *http.Request) {
-	users, err := db.GetUsers()
+func (s *Server) GetUsersRoute(w http.ResponseWriter, r *http.Request) {
+	users, err := s.store.GetUsers()
 	if err != nil {
 		reportInternalError(w, err)
 		return
@@ -51,3 +52,152 @@ func GetUsersRoute(w http.ResponseWriter, r *http.Request) {
 		"users": users,
 	})
 }
+
+func (s *Server) GetUserRoute(w http.ResponseWriter, r *http.Request) {
+	gores.JSON(w, http.StatusOK, getTargetUser(r))
+}
+
+type PatchUserPayload struct {
+	Username *string `json:"username" schema:"username"`
+	Password *string `json:"password" schema:"password"`
+	Admin    *bool   `json:"admin" schema:"admin"`
+	Disabled *bool   `json:"disabled" schema:"disabled"`
+
+	// A discord id of zero unlinks the users Discord account
+	DiscordId *int64 `json:"discord_id" schema:"discord_id"`
+}
+
+func (s *Server) PatchUserRoute(w http.ResponseWriter, r *http.Request) {
+	var payload PatchUserPayload
+	if !readRequestData(w, r, &payload) {
+		return
+	}
+
+	currentUser := getCurrentUser(r)
+	user := getTargetUser(r)
+	changes := make([]string, 0)
+
+	if user.Id == currentUser.Id && ((payload.Admin != nil && !*payload.Admin) || (payload.Disabled != nil && *payload.Disabled)) {
+		gores.Error(w, http.StatusBadRequest, "Cannot remove your own access")
+		return
+	}
+
+	if payload.Username != nil && *payload.Username != user.Username {
+		if *payload.Username == "" {
+			gores.Error(w, http.StatusBadRequest, "username cannot be empty")
+			return
+		}
+
+		_, err := s.store.GetUserByUsername(*payload.Username)
+		if err == nil {
+			gores.Error(w, http.StatusConflict, "username is already taken")
+			return
+		} else if err != sql.ErrNoRows {
+			reportInternalError(w, err)
+			return
+		}
+
+		err = s.store.UpdateUsername(user, *payload.Username)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+		changes = append(changes, "username")
+	}
+
+	if payload.DiscordId != nil {
+		discordId := payload.DiscordId
+		if *discordId == 0 {
+			discordId = nil
+		}
+
+		err := s.store.UpdateUserDiscordId(user, discordId)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+		changes = append(changes, "discord_id")
+	}
+
+	flags := user.Flags
+	if payload.Admin != nil {
+		if *payload.Admin {
+			flags = flags.Set(db.USER_FLAG_ADMIN)
+		} else {
+			flags = flags.Clear(db.USER_FLAG_ADMIN)
+		}
+	}
+
+	if payload.Disabled != nil {
+		if *payload.Disabled {
+			flags = flags.Set(db.USER_FLAG_DISABLED)
+		} else {
+			flags = flags.Clear(db.USER_FLAG_DISABLED)
+		}
+	}
+
+	if flags != user.Flags {
+		err := s.store.UpdateUserFlags(user, flags)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+		changes = append(changes, "flags")
+	}
+
+	// Resetting the password or disabling the user logs them out everywhere
+	if payload.Password != nil || user.IsDisabled() {
+		if payload.Password != nil {
+			err := s.store.UpdateUserPassword(user, *payload.Password)
+			if err != nil {
+				reportInternalError(w, err)
+				return
+			}
+			changes = append(changes, "password")
+		}
+
+		err := s.store.DeleteSessionsByUserId(user.Id, 0)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
+	_, err := s.store.CreateAuditLogEntry("admin.user_update", currentUser, map[string]interface{}{
+		"user":    user.Id,
+		"changes": changes,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, user)
+}
+
+func (s *Server) DeleteUserRoute(w http.ResponseWriter, r *http.Request) {
+	currentUser := getCurrentUser(r)
+	user := getTargetUser(r)
+
+	if user.Id == currentUser.Id {
+		gores.Error(w, http.StatusBadRequest, "Cannot delete yourself")
+		return
+	}
+
+	err := s.store.DeleteUser(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("admin.user_delete", currentUser, map[string]interface{}{
+		"user":     user.Id,
+		"username": user.Username,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
@@ -0,0 +1,405 @@
+package heracles
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/alioygur/gores"
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/go-chi/chi"
+	"github.com/gorilla/sessions"
+)
+
+func (s *Server) initializeWebAuthn() error {
+	var err error
+	s.webAuthn, err = webauthn.New(&webauthn.Config{
+		RPDisplayName: s.config.WebAuthn.DisplayName,
+		RPID:          s.config.WebAuthn.RPID,
+		RPOrigin:      s.config.WebAuthn.Origin,
+	})
+	return err
+}
+
+// Wraps a user and their registered credentials for use in WebAuthn ceremonies
+type webAuthnUser struct {
+	user        *db.User
+	credentials []db.UserWebAuthnCredential
+}
+
+func (s *Server) newWebAuthnUser(user *db.User) (*webAuthnUser, error) {
+	credentials, err := s.store.GetUserWebAuthnCredentialsByUserId(user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webAuthnUser{
+		user:        user,
+		credentials: credentials,
+	}, nil
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(strconv.FormatInt(u.user.Id, 10))
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	result := make([]webauthn.Credential, len(u.credentials))
+	for i, credential := range u.credentials {
+		result[i] = webauthn.Credential{
+			ID:              credential.CredentialId,
+			PublicKey:       credential.PublicKey,
+			AttestationType: credential.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    credential.AAGUID,
+				SignCount: credential.SignCount,
+			},
+		}
+	}
+	return result
+}
+
+func (u *webAuthnUser) findCredential(credentialId []byte) *db.UserWebAuthnCredential {
+	for i := range u.credentials {
+		if bytes.Equal(u.credentials[i].CredentialId, credentialId) {
+			return &u.credentials[i]
+		}
+	}
+	return nil
+}
+
+// Stores the state for an in-progress WebAuthn ceremony within the session
+func saveWebAuthnSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, user *db.User, data *webauthn.SessionData) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	session.Values["webauthn"] = string(encoded)
+	session.Values["webauthn_user"] = user.Id
+	return session.Save(r, w)
+}
+
+// Loads (and clears) the state for an in-progress WebAuthn ceremony from the session
+func (s *Server) takeWebAuthnSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) (*db.User, *webauthn.SessionData, error) {
+	encoded, ok := session.Values["webauthn"].(string)
+	userId, _ := session.Values["webauthn_user"].(int64)
+	if !ok {
+		return nil, nil, ErrNoUser
+	}
+
+	delete(session.Values, "webauthn")
+	delete(session.Values, "webauthn_user")
+	err := session.Save(r, w)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var data webauthn.SessionData
+	err = json.Unmarshal([]byte(encoded), &data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := s.store.GetUserById(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, &data, nil
+}
+
+func (s *Server) GetIdentityWebAuthnRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	credentials, err := s.store.GetUserWebAuthnCredentialsByUserId(user.Id)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, map[string]interface{}{
+		"credentials": credentials,
+	})
+}
+
+func (s *Server) PostIdentityWebAuthnRegisterBeginRoute(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	user := getCurrentUser(r)
+
+	wu, err := s.newWebAuthnUser(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	// Prevent the same authenticator from being registered twice
+	exclusions := make([]protocol.CredentialDescriptor, len(wu.credentials))
+	for i, credential := range wu.credentials {
+		exclusions[i] = protocol.CredentialDescriptor{
+			Type:         protocol.PublicKeyCredentialType,
+			CredentialID: credential.CredentialId,
+		}
+	}
+
+	options, sessionData, err := s.webAuthn.BeginRegistration(wu, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = saveWebAuthnSession(w, r, session, user, sessionData)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, options)
+}
+
+func (s *Server) PostIdentityWebAuthnRegisterFinishRoute(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	user := getCurrentUser(r)
+
+	sessionUser, sessionData, err := s.takeWebAuthnSession(w, r, session)
+	if err != nil || sessionUser.Id != user.Id {
+		gores.Error(w, http.StatusBadRequest, "No registration in progress")
+		return
+	}
+
+	wu, err := s.newWebAuthnUser(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	credential, err := s.webAuthn.FinishRegistration(wu, *sessionData, r)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid registration")
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "Security Key"
+	}
+
+	userCredential, err := s.store.CreateUserWebAuthnCredential(
+		user.Id,
+		name,
+		credential.ID,
+		credential.PublicKey,
+		credential.AttestationType,
+		credential.Authenticator.AAGUID,
+		credential.Authenticator.SignCount,
+	)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.webauthn_register", user, map[string]interface{}{
+		"credential": userCredential.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, userCredential)
+}
+
+func (s *Server) DeleteIdentityWebAuthnCredentialRoute(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+
+	credentialId, err := strconv.Atoi(chi.URLParam(r, "credentialId"))
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid credential ID")
+		return
+	}
+
+	credential, err := s.store.GetUserWebAuthnCredentialById(int64(credentialId))
+	if err == sql.ErrNoRows || (err == nil && credential.UserId != user.Id) {
+		gores.Error(w, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = s.store.DeleteUserWebAuthnCredential(credential)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	_, err = s.store.CreateAuditLogEntry("user.webauthn_delete", user, map[string]interface{}{
+		"credential": credential.Id,
+	})
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.NoContent(w)
+}
+
+// Begins a security key login, either for the user currently completing the
+// second step of a password login or for the provided username.
+func (s *Server) PostLoginWebAuthnBeginRoute(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Bad Form Data")
+		return
+	}
+
+	login, err := s.getPendingSecondFactorLogin(session)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	var user *db.User
+
+	username := r.PostForm.Get("username")
+	if username != "" {
+		user, err = s.store.GetUserByUsername(username)
+	} else if login != nil {
+		user, err = s.store.GetUserById(login.UserId)
+	} else {
+		gores.Error(w, http.StatusBadRequest, "username is required")
+		return
+	}
+
+	if err == sql.ErrNoRows {
+		gores.Error(w, http.StatusBadRequest, "Unknown user")
+		return
+	} else if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	wu, err := s.newWebAuthnUser(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	if len(wu.credentials) == 0 {
+		gores.Error(w, http.StatusBadRequest, "No security keys registered")
+		return
+	}
+
+	options, sessionData, err := s.webAuthn.BeginLogin(wu)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	err = saveWebAuthnSession(w, r, session, user, sessionData)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	gores.JSON(w, http.StatusOK, options)
+}
+
+func (s *Server) PostLoginWebAuthnFinishRoute(w http.ResponseWriter, r *http.Request) {
+	session := s.getSession(w, r)
+	if session == nil {
+		return
+	}
+
+	user, sessionData, err := s.takeWebAuthnSession(w, r, session)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "No login in progress")
+		return
+	}
+
+	wu, err := s.newWebAuthnUser(user)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	credential, err := s.webAuthn.FinishLogin(wu, *sessionData, r)
+	if err != nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid security key")
+		return
+	}
+
+	// A clone warning means the signature counter went backwards, which may
+	// indicate the key has been cloned.
+	if credential.Authenticator.CloneWarning {
+		gores.Error(w, http.StatusBadRequest, "Invalid security key")
+		return
+	}
+
+	userCredential := wu.findCredential(credential.ID)
+	if userCredential == nil {
+		gores.Error(w, http.StatusBadRequest, "Invalid security key")
+		return
+	}
+
+	err = s.store.UpdateUserWebAuthnCredentialSignCount(userCredential, credential.Authenticator.SignCount)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	auditData := map[string]interface{}{}
+	redirectURL := r.URL.Query().Get("r")
+
+	// If this completes the second step of a password login we pick up where
+	// that left off.
+	login, err := s.getPendingSecondFactorLogin(session)
+	if err != nil {
+		reportInternalError(w, err)
+		return
+	}
+
+	if login != nil && login.UserId == user.Id {
+		auditData, redirectURL, err = s.takePendingSecondFactorLogin(w, r, session, login)
+		if err != nil {
+			reportInternalError(w, err)
+			return
+		}
+	}
+
+	if auditData == nil {
+		auditData = map[string]interface{}{}
+	}
+	auditData["webauthn"] = userCredential.Id
+
+	s.completeLogin(w, r, user, redirectURL, auditData)
+}
@@ -0,0 +1,247 @@
+package heracles
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/b1naryth1ef/heracles/db"
+	"github.com/duo-labs/webauthn/protocol/webauthncbor"
+	"github.com/duo-labs/webauthn/protocol/webauthncose"
+)
+
+const (
+	testWebAuthnRPID   = "heracles.test"
+	testWebAuthnOrigin = "https://heracles.test"
+)
+
+// A software security key holding a single P-256 credential
+type testAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialId := make([]byte, 16)
+	rand.Read(credentialId)
+
+	return &testAuthenticator{t: t, key: key, credentialId: credentialId}
+}
+
+// Builds the client data for a ceremony, answering the challenge in its options
+func (a *testAuthenticator) clientData(ceremony string, options []byte) []byte {
+	var parsed struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	err := json.Unmarshal(options, &parsed)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	// Like browsers we decode the challenge and answer with it base64url encoded
+	value := strings.TrimRight(strings.NewReplacer("-", "+", "_", "/").Replace(parsed.PublicKey.Challenge), "=")
+	challenge, err := base64.RawStdEncoding.DecodeString(value)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    testWebAuthnOrigin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return clientData
+}
+
+// Builds authenticator data with user presence and verification flagged, and
+// the attested credential (if any) appended.
+func (a *testAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(testWebAuthnRPID))
+
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags|0x01|0x04)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[len(data)-4:], a.signCount)
+	return append(data, attested...)
+}
+
+func (a *testAuthenticator) publicKey() []byte {
+	encoded, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1,
+		XCoord: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return encoded
+}
+
+// Answers registration options with a "none" attestation of the credential
+func (a *testAuthenticator) register(options []byte) map[string]interface{} {
+	attested := make([]byte, 16)
+	attested = append(attested, 0, byte(len(a.credentialId)))
+	attested = append(attested, a.credentialId...)
+	attested = append(attested, a.publicKey()...)
+
+	attestationObject, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authenticatorData(0x40, attested),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return a.credential(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", options)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+	})
+}
+
+// Answers login options with a signed assertion
+func (a *testAuthenticator) login(options []byte) map[string]interface{} {
+	a.signCount++
+
+	clientData := a.clientData("webauthn.get", options)
+	authenticatorData := a.authenticatorData(0, nil)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authenticatorData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return a.credential(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authenticatorData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+func (a *testAuthenticator) credential(response map[string]string) map[string]interface{} {
+	id := base64.RawURLEncoding.EncodeToString(a.credentialId)
+	return map[string]interface{}{
+		"id":       id,
+		"rawId":    id,
+		"type":     "public-key",
+		"response": response,
+	}
+}
+
+// Reads the ceremony options from a begin response
+func readTestWebAuthnOptions(c *testClient, res *http.Response) []byte {
+	var options json.RawMessage
+	c.expect(res, http.StatusOK, &options)
+	return options
+}
+
+func newTestWebAuthnServer(t *testing.T, requireSecondFactor bool) (*db.MemoryStore, *testClient, *testAuthenticator) {
+	_, store, ts := newTestServer(t, func(config *Config) {
+		config.WebAuthn = WebAuthnConfig{
+			Enabled:             true,
+			RPID:                testWebAuthnRPID,
+			Origin:              testWebAuthnOrigin,
+			RequireSecondFactor: requireSecondFactor,
+		}
+	})
+
+	_, err := store.CreateUser("user", "password", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Register a key for the user
+	c := newLoggedInClient(t, ts, "user", "password")
+	authenticator := newTestAuthenticator(t)
+	options := readTestWebAuthnOptions(c, c.send("POST", "/api/identity/mfa/webauthn/register/begin", nil))
+	c.expect(c.send("POST", "/api/identity/mfa/webauthn/register/finish?name=Test", authenticator.register(options)), http.StatusOK)
+
+	var credentials struct {
+		Credentials []db.UserWebAuthnCredential `json:"credentials"`
+	}
+	c.expect(c.get("/api/identity/mfa/webauthn", nil), http.StatusOK, &credentials)
+	if len(credentials.Credentials) != 1 || credentials.Credentials[0].Name != "Test" {
+		t.Fatalf("unexpected credentials %+v", credentials.Credentials)
+	}
+
+	return store, newTestClient(t, ts), authenticator
+}
+
+func TestWebAuthnPasswordlessLogin(t *testing.T) {
+	store, c, authenticator := newTestWebAuthnServer(t, false)
+
+	// Without require_second_factor keys don't get in the way of passwords
+	c.expect(c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}}), http.StatusNoContent)
+	c.expect(c.get("/logout", nil), http.StatusFound)
+
+	options := readTestWebAuthnOptions(c, c.postForm("/login/webauthn/begin", url.Values{"username": {"user"}}))
+	c.expect(c.send("POST", "/login/webauthn/finish", authenticator.login(options)), http.StatusNoContent)
+	c.expect(c.get("/api/identity", nil), http.StatusOK)
+
+	user, _ := store.GetUserByUsername("user")
+	credentials, _ := store.GetUserWebAuthnCredentialsByUserId(user.Id)
+	if credentials[0].SignCount != authenticator.signCount {
+		t.Fatalf("sign count %v was not stored", authenticator.signCount)
+	}
+
+	// Replaying the assertion fails as its challenge has been used
+	c.expect(c.get("/logout", nil), http.StatusFound)
+	options = readTestWebAuthnOptions(c, c.postForm("/login/webauthn/begin", url.Values{"username": {"user"}}))
+	assertion := authenticator.login(options)
+	c.expect(c.send("POST", "/login/webauthn/finish", assertion), http.StatusNoContent)
+	c.expect(c.send("POST", "/login/webauthn/finish", assertion), http.StatusBadRequest)
+}
+
+func TestWebAuthnSecondFactor(t *testing.T) {
+	store, c, authenticator := newTestWebAuthnServer(t, true)
+
+	res := c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}})
+	c.expect(res, http.StatusFound)
+	if res.Header.Get("Location") != "/login/mfa" {
+		t.Fatalf("redirected to %v", res.Header.Get("Location"))
+	}
+	c.expect(c.get("/api/identity", nil), http.StatusUnauthorized)
+
+	// The key is asked for on behalf of the pending login, no username needed
+	options := readTestWebAuthnOptions(c, c.postForm("/login/webauthn/begin", nil))
+	c.expect(c.send("POST", "/login/webauthn/finish", authenticator.login(options)), http.StatusNoContent)
+	c.expect(c.get("/api/identity", nil), http.StatusOK)
+
+	entries, _ := store.GetRecentAuditLogEntries(1)
+	if entries[0].Action != "user.self_login" || entries[0].Data["backend"] != "local" || entries[0].Data["webauthn"] == nil {
+		t.Fatalf("unexpected login audit entry %+v", entries[0])
+	}
+
+	// A key from someone else doesn't complete the login
+	c.expect(c.get("/logout", nil), http.StatusFound)
+	c.expect(c.postForm("/login", url.Values{"username": {"user"}, "password": {"password"}}), http.StatusFound)
+	options = readTestWebAuthnOptions(c, c.postForm("/login/webauthn/begin", nil))
+	c.expect(c.send("POST", "/login/webauthn/finish", newTestAuthenticator(t).login(options)), http.StatusBadRequest)
+	c.expect(c.get("/api/identity", nil), http.StatusUnauthorized)
+}